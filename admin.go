@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminLease is the representation of a lease in admin API responses.
+type adminLease struct {
+	Username string
+	DeviceID string `json:",omitempty"`
+	Hostname string `json:",omitempty"`
+	PubKey   string
+	IP       string
+	IP6      string   `json:",omitempty"`
+	Networks []string `json:",omitempty"`
+	Expires  time.Time
+	Idle     bool `json:",omitempty"`
+}
+
+func newAdminLease(k leaseKey, r WGRecord) adminLease {
+	return adminLease{
+		Username: k.Username,
+		DeviceID: k.DeviceID,
+		Hostname: r.Hostname,
+		PubKey:   r.PubKey,
+		IP:       r.IP.String(),
+		IP6:      formatAddr(r.IP6),
+		Networks: r.Networks,
+		Expires:  r.expires,
+		Idle:     r.idle,
+	}
+}
+
+// adminLeasesResponse defines the payload of the admin API lease responses.
+type adminLeasesResponse struct {
+	Leases []adminLease
+}
+
+// HTTPAdminHandler implements the admin HTTP API, which allows operators to
+// inspect and revoke leases. Requests are authorised either with the static
+// admin token, or with an access token whose `groups` claim contains one of
+// the admin groups.
+type HTTPAdminHandler struct {
+	adminGroups    []string
+	adminToken     string
+	leaseManager   *leaseManager
+	reload         func() error // nil disables the reload endpoint
+	tokenValidator *tokenValidator
+}
+
+func newHTTPAdminHandler(cfg *serverConfig, lm *leaseManager, tv *tokenValidator, reload func() error) (*HTTPAdminHandler, error) {
+	ah := &HTTPAdminHandler{
+		adminGroups:    cfg.AdminGroups,
+		leaseManager:   lm,
+		reload:         reload,
+		tokenValidator: tv,
+	}
+	if cfg.AdminTokenFile != "" {
+		b, err := os.ReadFile(cfg.AdminTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read admin token file: %w", err)
+		}
+		ah.adminToken = strings.TrimSpace(string(b))
+		if ah.adminToken == "" {
+			return nil, fmt.Errorf("admin token file %s is empty", cfg.AdminTokenFile)
+		}
+	}
+	return ah, nil
+}
+
+// authorize returns the HTTP status code to reply with if the request is not
+// authorised, or 0 if it is.
+func (ah *HTTPAdminHandler) authorize(r *http.Request) (int, error) {
+	token, err := extractBearerTokenFromHeader(r, "Authorization")
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+	if ah.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(ah.adminToken)) == 1 {
+		return 0, nil
+	}
+	if len(ah.adminGroups) == 0 || ah.tokenValidator == nil {
+		return http.StatusForbidden, fmt.Errorf("invalid admin token")
+	}
+	tokenInfo, err := ah.tokenValidator.validate(token, "access_token")
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("error checking token validity: %w", err)
+	}
+	if !tokenInfo.Active {
+		return http.StatusUnauthorized, fmt.Errorf("invalid token")
+	}
+	if !containsAny(tokenInfo.Groups, ah.adminGroups) {
+		return http.StatusForbidden, fmt.Errorf("user %s is not an admin", tokenInfo.UserName)
+	}
+	logger.Verbosef("Admin request %s %s by %s", r.Method, r.URL, tokenInfo.UserName)
+	return 0, nil
+}
+
+// leaseFilter returns a function that matches leases against the `user`, `ip`
+// and `pubkey` query parameters. All given parameters must match.
+func leaseFilter(r *http.Request) (func(leaseKey, WGRecord) bool, error) {
+	q := r.URL.Query()
+	user, pubKey := q.Get("user"), q.Get("pubkey")
+	var ip netip.Addr
+	if s := q.Get("ip"); s != "" {
+		var err error
+		if ip, err = netip.ParseAddr(s); err != nil {
+			return nil, fmt.Errorf("invalid ip %q", s)
+		}
+	}
+	return func(k leaseKey, wr WGRecord) bool {
+		if user != "" && k.Username != user {
+			return false
+		}
+		if pubKey != "" && wr.PubKey != pubKey {
+			return false
+		}
+		if ip.IsValid() && wr.IP != ip && wr.IP6 != ip {
+			return false
+		}
+		return true
+	}, nil
+}
+
+func (ah *HTTPAdminHandler) leases(w http.ResponseWriter, r *http.Request) {
+	if code, err := ah.authorize(r); code != 0 {
+		logger.Errorf("Unauthorised admin request %s %s: %v", r.Method, r.URL, err)
+		writeErrorResponse(w, code, err.Error())
+		return
+	}
+	match, err := leaseFilter(r)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		records := ah.leaseManager.listLeases()
+		for k, wr := range records {
+			if !match(k, wr) {
+				delete(records, k)
+			}
+		}
+		writeAdminLeasesResponse(w, records)
+	case http.MethodDelete:
+		// Refuse to revoke every lease by accident.
+		q := r.URL.Query()
+		if q.Get("user") == "" && q.Get("pubkey") == "" {
+			writeErrorResponse(w, http.StatusBadRequest, "one of `user` or `pubkey` is required")
+			return
+		}
+		revoked, err := ah.leaseManager.revokeLeases(match, "revoked via the admin API")
+		if err != nil {
+			logger.Errorf("Cannot revoke leases: %v", err)
+			writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(revoked) == 0 {
+			writeErrorResponse(w, http.StatusNotFound, "no matching leases")
+			return
+		}
+		writeAdminLeasesResponse(w, revoked)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeErrorResponse(w, http.StatusMethodNotAllowed, "only GET and DELETE methods are supported")
+	}
+}
+
+// reloadConfig re-reads the server config file and applies it, replying with
+// the reason if the config is rejected.
+func (ah *HTTPAdminHandler) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if code, err := ah.authorize(r); code != 0 {
+		logger.Errorf("Unauthorised admin request %s %s: %v", r.Method, r.URL, err)
+		writeErrorResponse(w, code, err.Error())
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeErrorResponse(w, http.StatusMethodNotAllowed, "only POST method is supported")
+		return
+	}
+	if ah.reload == nil {
+		writeErrorResponse(w, http.StatusNotFound, "config reload is not available")
+		return
+	}
+	if err := ah.reload(); err != nil {
+		logger.Errorf("Cannot reload config: %v", err)
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAdminLeasesResponse(w http.ResponseWriter, records map[leaseKey]WGRecord) {
+	resp := adminLeasesResponse{Leases: make([]adminLease, 0, len(records))}
+	for k, r := range records {
+		resp.Leases = append(resp.Leases, newAdminLease(k, r))
+	}
+	sort.Slice(resp.Leases, func(i, j int) bool {
+		if resp.Leases[i].Username != resp.Leases[j].Username {
+			return resp.Leases[i].Username < resp.Leases[j].Username
+		}
+		return resp.Leases[i].DeviceID < resp.Leases[j].DeviceID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		logger.Errorf("Cannot encode admin response: %v", err)
+	}
+}
+
+// start serves the admin API at address, over TLS with the certificates of
+// the lease server if certs is not nil.
+func (ah *HTTPAdminHandler) start(address string, certs *certReloader) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/leases", ah.leases)
+	mux.HandleFunc("/reload", ah.reloadConfig)
+
+	server := &http.Server{Addr: address, Handler: mux}
+	var err error
+	if certs != nil {
+		logger.Verbosef("Starting TLS admin server at %s", address)
+		server.TLSConfig = certs.tlsConfig()
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logger.Verbosef("Starting admin server at %s", address)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPAdminHandler_leases(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	expires := time.Unix(9999, 0).UTC()
+	ah := &HTTPAdminHandler{
+		adminToken: "s3cr3t",
+		leaseManager: &leaseManager{
+			wgRecords: map[leaseKey]WGRecord{
+				{Username: "a@example.com", DeviceID: "laptop"}: {
+					PubKey:  "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+					IP:      netip.MustParseAddr("10.90.0.2"),
+					expires: expires,
+				},
+				{Username: "a@example.com", DeviceID: "desktop"}: {
+					PubKey:  "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=",
+					IP:      netip.MustParseAddr("10.90.0.3"),
+					expires: expires,
+				},
+				{Username: "b@example.com"}: {
+					PubKey:  "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=",
+					IP:      netip.MustParseAddr("10.90.0.4"),
+					IP6:     netip.MustParseAddr("fd00::4"),
+					expires: expires,
+				},
+			},
+			store: newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+		},
+	}
+
+	testCases := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		code   int
+		leases []string // expected usernames/device ids
+	}{
+		{"no token", "GET", "/leases", "", http.StatusUnauthorized, nil},
+		{"wrong token", "GET", "/leases", "nope", http.StatusForbidden, nil},
+		{"list", "GET", "/leases", "s3cr3t", http.StatusOK, []string{"a@example.com/desktop", "a@example.com/laptop", "b@example.com"}},
+		{"by user", "GET", "/leases?user=a@example.com", "s3cr3t", http.StatusOK, []string{"a@example.com/desktop", "a@example.com/laptop"}},
+		{"by ip", "GET", "/leases?ip=10.90.0.2", "s3cr3t", http.StatusOK, []string{"a@example.com/laptop"}},
+		{"by ipv6", "GET", "/leases?ip=fd00::4", "s3cr3t", http.StatusOK, []string{"b@example.com"}},
+		{"by pubkey", "GET", "/leases?pubkey=NkEtSA6GosX40iZFNe9%2BbyAkXweYKvQe3utnFYkQ%2B00%3D", "s3cr3t", http.StatusOK, []string{"b@example.com"}},
+		{"no match", "GET", "/leases?user=c@example.com", "s3cr3t", http.StatusOK, []string{}},
+		{"invalid ip", "GET", "/leases?ip=foo", "s3cr3t", http.StatusBadRequest, nil},
+		{"revoke everything", "DELETE", "/leases", "s3cr3t", http.StatusBadRequest, nil},
+		{"revoke missing", "DELETE", "/leases?user=c@example.com", "s3cr3t", http.StatusNotFound, nil},
+		{"unsupported method", "PUT", "/leases", "s3cr3t", http.StatusMethodNotAllowed, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", bearerSchema+tc.token)
+			}
+			w := httptest.NewRecorder()
+			ah.leases(w, req)
+			assert.Equal(t, tc.code, w.Code)
+			if tc.leases == nil {
+				return
+			}
+			resp := &adminLeasesResponse{}
+			if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, l := range resp.Leases {
+				got = append(got, leaseKey{Username: l.Username, DeviceID: l.DeviceID}.String())
+			}
+			assert.Equal(t, tc.leases, got)
+		})
+	}
+}
+
+func TestHTTPAdminHandler_reload(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	var reloadErr error
+	ah := &HTTPAdminHandler{
+		adminToken: "s3cr3t",
+		reload:     func() error { return reloadErr },
+	}
+	testCases := []struct {
+		name   string
+		method string
+		token  string
+		err    error
+		code   int
+	}{
+		{"no token", "POST", "", nil, http.StatusUnauthorized},
+		{"reload", "POST", "s3cr3t", nil, http.StatusNoContent},
+		{"rejected", "POST", "s3cr3t", fmt.Errorf("cannot change `deviceName` without a restart"), http.StatusBadRequest},
+		{"unsupported method", "GET", "s3cr3t", nil, http.StatusMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reloadErr = tc.err
+			req := httptest.NewRequest(tc.method, "/reload", nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", bearerSchema+tc.token)
+			}
+			w := httptest.NewRecorder()
+			ah.reloadConfig(w, req)
+			assert.Equal(t, tc.code, w.Code)
+		})
+	}
+}
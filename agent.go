@@ -1,19 +1,87 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	defaultTokenFileLoc = "/var/lib/wiresteward/token"
+	defaultTokenFileLoc    = "/var/lib/wiresteward/token"
+	defaultDeviceIDFileLoc = "/var/lib/wiresteward/device-id"
 )
 
+// agentIdentity identifies the machine the agent runs on to wiresteward
+// servers, so that a user can hold leases from multiple machines at once.
+type agentIdentity struct {
+	DeviceID string
+	Hostname string
+}
+
+var invalidHostnameCharsRe = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// newAgentIdentity returns the identity of the local machine. The device ID is
+// generated once and persisted in the given file. Failures are logged and
+// result in an empty device ID, which servers treat as a single legacy device.
+// A hostname that servers would refuse, even once its invalid characters are
+// replaced, is left empty.
+func newAgentIdentity(deviceIDFile string) agentIdentity {
+	id := agentIdentity{}
+	deviceID, err := loadOrCreateDeviceID(deviceIDFile)
+	if err != nil {
+		logger.Errorf("Cannot load device id: %v", err)
+	}
+	id.DeviceID = deviceID
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Errorf("Cannot get hostname: %v", err)
+	}
+	hostname = invalidHostnameCharsRe.ReplaceAllString(hostname, "-")
+	if len(hostname) > 253 {
+		hostname = hostname[:253]
+	}
+	if !validHostname(hostname) {
+		logger.Errorf("Hostname %q is not accepted by servers, leaving it out", hostname)
+		hostname = ""
+	}
+	id.Hostname = hostname
+	return id
+}
+
+// loadOrCreateDeviceID returns the device ID persisted in the file. A new one
+// is generated and persisted if the file does not exist, or if it does not
+// hold a device ID that servers accept, as can happen if it was edited by hand.
+func loadOrCreateDeviceID(filename string) (string, error) {
+	b, err := os.ReadFile(filename)
+	if err == nil {
+		deviceID := strings.TrimSpace(string(b))
+		if deviceID != "" && validDeviceID(deviceID) {
+			return deviceID, nil
+		}
+		logger.Errorf("Invalid device id %q in %s, generating a new one", deviceID, filename)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	r := make([]byte, 16)
+	if _, err := rand.Read(r); err != nil {
+		return "", err
+	}
+	deviceID := hex.EncodeToString(r)
+	if err := os.WriteFile(filename, []byte(deviceID+"\n"), 0644); err != nil {
+		return "", err
+	}
+	logger.Verbosef("Generated new device id %s", deviceID)
+	return deviceID, nil
+}
+
 // Agent is the wirestward client instance that manages a set of network devices
 // based on configuration generated by remote wiresteward servers.
 type Agent struct {
@@ -27,23 +95,20 @@ type Agent struct {
 // resources.
 func NewAgent(cfg *agentConfig) *Agent {
 	agent := &Agent{}
+	tokenDir := filepath.Dir(defaultTokenFileLoc)
+	err := os.MkdirAll(tokenDir, 0750)
+	if err != nil {
+		logger.Errorf("Unable to create directory=%s", tokenDir)
+	}
+	identity := newAgentIdentity(defaultDeviceIDFileLoc)
 	for _, dev := range cfg.Devices {
-		urls := []string{}
-		for _, peer := range dev.Peers {
-			urls = append(urls, peer.URL)
-		}
-		dm := newDeviceManager(dev.Name, dev.MTU, urls, cfg.HTTPClient.Timeout, cfg.HealthCheck)
+		dm := newDeviceManager(dev.Name, dev.MTU, dev.Peers, identity, cfg.HTTPClient.Timeout, cfg.HealthCheck)
 		if err := dm.Run(); err != nil {
 			logger.Errorf("Error starting device `%s`: %v", dm.Name(), err)
 			continue
 		}
 		agent.deviceManagers = append(agent.deviceManagers, dm)
 	}
-	tokenDir := filepath.Dir(defaultTokenFileLoc)
-	err := os.MkdirAll(tokenDir, 0750)
-	if err != nil {
-		logger.Errorf("Unable to create directory=%s", tokenDir)
-	}
 	agent.oa = newOAuthTokenHandler(
 		cfg.OAuth.AuthURL,
 		cfg.OAuth.TokenURL,
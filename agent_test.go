@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOrCreateDeviceID(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	filename := filepath.Join(t.TempDir(), "device-id")
+
+	deviceID, err := loadOrCreateDeviceID(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, deviceID, 32)
+	again, err := loadOrCreateDeviceID(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, deviceID, again)
+
+	// Device ids that servers would refuse are replaced.
+	for _, invalid := range []string{"", "-", "two words", "ünïcode"} {
+		if err := os.WriteFile(filename, []byte(invalid+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		deviceID, err := loadOrCreateDeviceID(filename)
+		assert.NoError(t, err)
+		assert.True(t, validDeviceID(deviceID), invalid)
+		assert.Len(t, deviceID, 32, invalid)
+		saved, err := os.ReadFile(filename)
+		assert.NoError(t, err)
+		assert.Equal(t, deviceID+"\n", string(saved))
+	}
+}
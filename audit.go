@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lease lifecycle events recorded in the audit log.
+const (
+	leaseEventCreated    = "created"
+	leaseEventKeyChanged = "key_changed"
+	leaseEventExtended   = "extended"
+	leaseEventExpired    = "expired"
+	leaseEventRevoked    = "revoked"
+	leaseEventRejected   = "rejected"
+)
+
+const (
+	auditWebhookQueueSize   = 1024
+	auditWebhookMaxAttempts = 5
+	auditWebhookTimeout     = 10 * time.Second
+)
+
+// leaseEvent describes a change in the lifecycle of a lease. It is written as
+// a single JSON line to the audit log file and POSTed as a JSON object to the
+// audit webhooks.
+type leaseEvent struct {
+	Time           time.Time `json:"time"`
+	Event          string    `json:"event"`
+	Username       string    `json:"username"`
+	DeviceID       string    `json:"deviceID,omitempty"`
+	Hostname       string    `json:"hostname,omitempty"`
+	IP             string    `json:"ip,omitempty"`
+	IP6            string    `json:"ip6,omitempty"`
+	PubKey         string    `json:"pubKey,omitempty"`
+	PreviousPubKey string    `json:"previousPubKey,omitempty"`
+	Issuer         string    `json:"issuer,omitempty"`
+	SourceIP       string    `json:"sourceIP,omitempty"`
+	Expires        time.Time `json:"expires,omitzero"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+// newLeaseEvent returns an event of the given type for the lease.
+func newLeaseEvent(event string, k leaseKey, r WGRecord) leaseEvent {
+	return leaseEvent{
+		Event:    event,
+		Username: k.Username,
+		DeviceID: k.DeviceID,
+		Hostname: r.Hostname,
+		IP:       formatAddr(r.IP),
+		IP6:      formatAddr(r.IP6),
+		PubKey:   r.PubKey,
+		Issuer:   r.issuer,
+		SourceIP: r.sourceIP,
+		Expires:  r.expires,
+	}
+}
+
+// auditLog records lease events to an append-only file and delivers them to
+// webhooks. Webhook deliveries happen in the background and are retried with
+// a backoff, so that a slow or unavailable receiver does not hold up leases.
+// Each webhook has its own queue, so that it does not hold up the others
+// either. A nil *auditLog discards all events.
+type auditLog struct {
+	file      *os.File
+	fileMutex sync.Mutex
+	webhooks  []string
+	client    *http.Client
+	queues    []chan leaseEvent // one per webhook
+	closed    bool              // guarded by fileMutex, set by Close
+	stop      chan struct{}     // closed by Close to interrupt retries
+	workers   sync.WaitGroup
+	retryMin  time.Duration
+	retryMax  time.Duration
+}
+
+// newAuditLog returns an auditLog for the configured audit file and webhooks,
+// or nil if neither is configured.
+func newAuditLog(cfg *serverConfig) (*auditLog, error) {
+	if cfg.AuditLogFile == "" && len(cfg.AuditWebhookURLs) == 0 {
+		return nil, nil
+	}
+	al := &auditLog{
+		webhooks: cfg.AuditWebhookURLs,
+		client:   &http.Client{Timeout: auditWebhookTimeout},
+		retryMin: time.Second,
+		retryMax: 30 * time.Second,
+	}
+	if cfg.AuditLogFile != "" {
+		f, err := os.OpenFile(cfg.AuditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open audit log file: %w", err)
+		}
+		al.file = f
+	}
+	al.startWebhooks()
+	return al, nil
+}
+
+func (al *auditLog) startWebhooks() {
+	al.stop = make(chan struct{})
+	for _, url := range al.webhooks {
+		queue := make(chan leaseEvent, auditWebhookQueueSize)
+		al.queues = append(al.queues, queue)
+		al.workers.Add(1)
+		go func() {
+			defer al.workers.Done()
+			for ev := range queue {
+				al.deliver(url, ev)
+			}
+		}()
+	}
+}
+
+// record writes the event to the audit file and queues it for delivery to
+// the webhooks.
+func (al *auditLog) record(ev leaseEvent) {
+	if al == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		logger.Errorf("Cannot encode audit event: %v", err)
+		return
+	}
+	al.fileMutex.Lock()
+	defer al.fileMutex.Unlock()
+	if al.closed {
+		return
+	}
+	if al.file != nil {
+		if _, err := al.file.Write(append(line, '\n')); err != nil {
+			logger.Errorf("Cannot write audit event: %v", err)
+		}
+	}
+	for i, queue := range al.queues {
+		select {
+		case queue <- ev:
+		default:
+			logger.Errorf("Audit webhook queue for %s is full, dropping %s event for %s", al.webhooks[i], ev.Event, ev.Username)
+		}
+	}
+}
+
+// deliver POSTs the event to the webhook, retrying failed deliveries. It is
+// only called by the webhook's own worker, so waiting between attempts holds
+// up no other webhook. It returns without delivering once the log is closed.
+func (al *auditLog) deliver(url string, ev leaseEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logger.Errorf("Cannot encode audit event: %v", err)
+		return
+	}
+	b := newBackoff(al.retryMin, al.retryMax, 2)
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-al.stop:
+			logger.Errorf("Audit log closed, dropping %s event for %s to %s", ev.Event, ev.Username, url)
+			return
+		default:
+		}
+		err := al.post(url, body)
+		if err == nil {
+			return
+		}
+		if attempt == auditWebhookMaxAttempts {
+			logger.Errorf("Giving up delivering %s event for %s to %s: %v", ev.Event, ev.Username, url, err)
+			return
+		}
+		d := b.Duration()
+		logger.Verbosef("Cannot deliver audit event to %s, retrying in %s: %v", url, d, err)
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-al.stop:
+			timer.Stop()
+		}
+	}
+}
+
+func (al *auditLog) post(url string, body []byte) error {
+	resp, err := al.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops the webhook workers and closes the audit file. A delivery in
+// progress is waited for, but it is not retried, and queued events that have
+// not been attempted yet are dropped. Events recorded afterwards are
+// discarded.
+func (al *auditLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	al.fileMutex.Lock()
+	if al.closed {
+		al.fileMutex.Unlock()
+		return nil
+	}
+	al.closed = true
+	for _, queue := range al.queues {
+		close(queue)
+	}
+	if al.stop != nil {
+		close(al.stop)
+	}
+	al.fileMutex.Unlock()
+	al.workers.Wait()
+
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+	return err
+}
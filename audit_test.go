@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAuditEvents(t *testing.T, filename string) []leaseEvent {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events := []leaseEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev leaseEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestLeaseManager_auditEvents(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(&serverConfig{AuditLogFile: auditFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	lm := &leaseManager{
+		audit:           audit,
+		wgRecords:       map[leaseKey]WGRecord{},
+		ipPrefix:        netip.MustParsePrefix("10.90.0.1/20"),
+		recentAddresses: make(map[leaseKey]recentAddress),
+		store:           newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+	}
+	p := leaseParams{
+		Username: "alice",
+		DeviceID: "laptop",
+		PubKey:   "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+		Expiry:   time.Now().Add(time.Hour),
+		Issuer:   "https://idp.example.com",
+		SourceIP: "192.0.2.10",
+	}
+	if _, _, err := lm.createOrUpdatePeer(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Expiry = p.Expiry.Add(time.Hour)
+	if _, _, err := lm.createOrUpdatePeer(p); err != nil {
+		t.Fatal(err)
+	}
+	p.PubKey = "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo="
+	if _, _, err := lm.createOrUpdatePeer(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.removeLeases(func(leaseKey, WGRecord) bool { return true }, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := readAuditEvents(t, auditFile)
+	if !assert.Equal(t, 4, len(events)) {
+		return
+	}
+	for i, event := range []string{leaseEventCreated, leaseEventExtended, leaseEventKeyChanged, leaseEventRevoked} {
+		assert.Equal(t, event, events[i].Event)
+		assert.Equal(t, "alice", events[i].Username)
+		assert.Equal(t, "laptop", events[i].DeviceID)
+		assert.Equal(t, "10.90.0.2", events[i].IP)
+		assert.Equal(t, "https://idp.example.com", events[i].Issuer)
+		assert.Equal(t, "192.0.2.10", events[i].SourceIP)
+		assert.False(t, events[i].Time.IsZero())
+	}
+	assert.Equal(t, "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=", events[2].PreviousPubKey)
+	assert.Equal(t, "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=", events[2].PubKey)
+	assert.Equal(t, "test", events[3].Reason)
+}
+
+func TestAuditLog_webhookRetries(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	var attempts atomic.Int32
+	received := make(chan leaseEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev leaseEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer srv.Close()
+
+	al := &auditLog{
+		webhooks: []string{srv.URL},
+		client:   srv.Client(),
+		retryMin: time.Millisecond,
+		retryMax: 10 * time.Millisecond,
+	}
+	al.startWebhooks()
+	defer al.Close()
+	al.record(leaseEvent{Event: leaseEventExpired, Username: "alice", IP: "10.90.0.2"})
+
+	select {
+	case ev := <-received:
+		assert.Equal(t, leaseEventExpired, ev.Event)
+		assert.Equal(t, "alice", ev.Username)
+		assert.Equal(t, "10.90.0.2", ev.IP)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook delivery")
+	}
+	assert.Equal(t, int32(3), attempts.Load())
+}
+
+func TestAuditLog_webhookIsolation(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer dead.Close()
+	received := make(chan leaseEvent, 2)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev leaseEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer healthy.Close()
+
+	// The dead webhook waits an hour before retrying, which must not delay
+	// the deliveries to the healthy one.
+	al := &auditLog{
+		webhooks: []string{dead.URL, healthy.URL},
+		client:   http.DefaultClient,
+		retryMin: time.Hour,
+		retryMax: time.Hour,
+	}
+	al.startWebhooks()
+	defer al.Close()
+	al.record(leaseEvent{Event: leaseEventCreated, Username: "alice"})
+	al.record(leaseEvent{Event: leaseEventExpired, Username: "alice"})
+	for _, want := range []string{leaseEventCreated, leaseEventExpired} {
+		select {
+		case ev := <-received:
+			assert.Equal(t, want, ev.Event)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for webhook delivery")
+		}
+	}
+
+	// Closing interrupts the dead webhook's wait before its next retry.
+	closed := make(chan error)
+	go func() { closed <- al.Close() }()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the audit log to close")
+	}
+	al.record(leaseEvent{Event: leaseEventRevoked, Username: "alice"})
+	assert.Empty(t, received)
+}
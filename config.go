@@ -3,20 +3,29 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/netip"
-	"os"
+	"net/url"
+	"reflect"
 	"strconv"
-	"strings"
 	"time"
+
+	"go4.org/netipx"
 )
 
 const (
-	defaultKeyFilename               = "/etc/wiresteward/key"
-	defaultLeaserSyncInterval        = 1 * time.Minute
-	defaultLeasesFilename            = "/var/lib/wiresteward/leases"
-	defaultServerListenAddress       = "0.0.0.0:8080"
-	defaultAgentHealthCheckThreshold = 3
-	defaultRefreshBeforeExpiry       = 15 * time.Minute
+	defaultIntrospectionCacheNegativeTTL = 10 * time.Second
+	defaultIntrospectionCacheSize        = 10000
+	defaultKeyFilename                   = "/etc/wiresteward/key"
+	defaultLeaserSyncInterval            = 1 * time.Minute
+	defaultLeasesFilename                = "/var/lib/wiresteward/leases"
+	defaultBoltLeasesFilename            = "/var/lib/wiresteward/leases.db"
+	defaultLeaseStore                    = leaseStoreFile
+	defaultMaxDevicesPerUser             = 3
+	defaultPoolExhaustionPolicy          = poolExhaustionReject
+	defaultServerListenAddress           = "0.0.0.0:8080"
+	defaultAgentHealthCheckThreshold     = 3
+	defaultRefreshBeforeExpiry           = 15 * time.Minute
 )
 
 var (
@@ -39,9 +48,14 @@ var defaultAgentOAuthConfig = agentOAuthConfig{
 }
 
 // agentPeerConfig contains the agent-side configuration for a wiresteward
-// server.
+// server. CAFile verifies https servers with a private CA instead of the
+// system roots, and CertFile and KeyFile are the client certificate for
+// servers that require one.
 type agentPeerConfig struct {
-	URL string `json:"url"`
+	URL      string `json:"url"`
+	CAFile   string `json:"caFile"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
 }
 
 // agentDeviceConfig defines a network device and associated wiresteward
@@ -111,6 +125,9 @@ func verifyAgentDevicesConfig(conf *agentConfig) error {
 			if peer.URL == "" {
 				return fmt.Errorf("Missing peer url from config")
 			}
+			if (peer.CertFile == "") != (peer.KeyFile == "") {
+				return fmt.Errorf("Peer %s: `certFile` and `keyFile` must be set together", peer.URL)
+			}
 		}
 	}
 	return nil
@@ -125,18 +142,20 @@ var agentConfRead = &agentConfig{
 }
 
 func readAgentConfig(path string) (*agentConfig, error) {
+	return parseAgentConfig(path, false)
+}
+
+// parseAgentConfig reads and verifies the agent config. In strict mode
+// unknown keys are rejected.
+func parseAgentConfig(path string, strict bool) (*agentConfig, error) {
 	conf := agentConfRead
-	fileContent, err := os.ReadFile(path)
-	if err != nil {
-		return conf, fmt.Errorf("error reading config file: %v", err)
-	}
-	if err = json.Unmarshal(fileContent, conf); err != nil {
-		return nil, fmt.Errorf("error unmarshalling config: %v", err)
+	if err := loadConfig(path, reflect.TypeOf(agentConfig{}), conf, strict); err != nil {
+		return nil, err
 	}
-	if err = verifyAgentOAuthConfig(conf); err != nil {
+	if err := verifyAgentOAuthConfig(conf); err != nil {
 		return nil, err
 	}
-	if err = verifyAgentDevicesConfig(conf); err != nil {
+	if err := verifyAgentDevicesConfig(conf); err != nil {
 		return nil, err
 	}
 	return conf, nil
@@ -145,41 +164,124 @@ func readAgentConfig(path string) (*agentConfig, error) {
 // oauthServerConfig describes a single OAuth server the wiresteward server
 // accepts tokens from. The introspection endpoint is discovered at startup via
 // OIDC discovery (`<server>/.well-known/openid-configuration`). Tokens are
-// routed to the matching server based on the JWT `iss` claim.
+// routed to the matching server based on the JWT `iss` claim. With the `jwks`
+// verification, tokens are verified locally against the keys published at the
+// discovered `jwks_uri` instead, and must be issued for one of the audiences.
+// Users are identified by the value of UsernameClaim, prefixed with
+// UsernamePrefix so that the users of different servers can be told apart.
+// The remaining fields restrict which of the server's users may get a lease,
+// see authorize.
 type oauthServerConfig struct {
-	Server   string `json:"server"`
-	ClientID string `json:"clientID"`
+	Server         string   `json:"server"`
+	ClientID       string   `json:"clientID"`
+	Verification   string   `json:"verification"`
+	Audiences      []string `json:"audiences"`
+	UsernameClaim  string   `json:"usernameClaim"`
+	UsernamePrefix string   `json:"usernamePrefix"`
+	EmailDomains   []string `json:"emailDomains"`
+	Groups         []string `json:"groups"`
+	AllowedUsers   []string `json:"allowedUsers"`
+	DeniedUsers    []string `json:"deniedUsers"`
 }
 
+// Token verification methods of an oauthServerConfig.
+const (
+	tokenVerificationIntrospection = "introspection"
+	tokenVerificationJWKS          = "jwks"
+)
+
+// Claims that can identify the users of an oauthServerConfig.
+const (
+	usernameClaimEmail             = "email"
+	usernameClaimPreferredUsername = "preferred_username"
+	usernameClaimSub               = "sub"
+	usernameClaimUsername          = "username"
+)
+
 // serverConfig describes the server-side configuration of wiresteward.
 type serverConfig struct {
-	Address             string
-	AllowedIPs          []string
-	DeviceMTU           int
-	DeviceName          string
-	Endpoint            string
-	KeyFilename         string
-	LeaserSyncInterval  time.Duration
-	LeasesFilename      string
-	WireguardIPPrefix   netip.Prefix
-	WireguardListenPort int
-	OauthServers        []oauthServerConfig
-	ServerListenAddress string
+	Address                       string
+	AddressReuseGracePeriod       time.Duration
+	AdminGroups                   []string
+	AdminListenAddress            string
+	AdminTokenFile                string
+	Address6                      string
+	AllowedIPs                    []string
+	AuditLogFile                  string
+	AuditWebhookURLs              []string
+	ClientCAFile                  string
+	DeviceMTU                     int
+	DeviceName                    string
+	Endpoint                      string
+	IdlePeerTimeout               time.Duration
+	IntrospectionCacheNegativeTTL time.Duration
+	IntrospectionCacheSize        int
+	IntrospectionCacheTTL         time.Duration
+	KeyFilename                   string
+	LeaserSyncInterval            time.Duration
+	LeaseStore                    string
+	LeasesFilename                string
+	MaxDevicesPerUser             int
+	MaxLeaseDuration              time.Duration
+	MinLeaseDuration              time.Duration
+	PeerFirewall                  bool
+	PersistDevice                 bool
+	PoolExhaustionPolicy          string
+	PresharedKeys                 bool
+	Reservations                  map[string]string
+	ReservedAddresses             map[string]netip.Addr
+	WireguardIPPrefix             netip.Prefix
+	WireguardIP6Prefix            netip.Prefix
+	WireguardListenPort           int
+	OauthServers                  []oauthServerConfig
+	Policies                      []accessPolicy
+	ServerListenAddress           string
+	TLSCertFile                   string
+	TLSKeyFile                    string
+	TokenRevalidationInterval     time.Duration
+}
+
+// serverConfigFile defines the keys of the server config file.
+type serverConfigFile struct {
+	Address                       string              `json:"address"`
+	AddressReuseGracePeriod       string              `json:"addressReuseGracePeriod"`
+	AdminGroups                   []string            `json:"adminGroups"`
+	AdminListenAddress            string              `json:"adminListenAddress"`
+	AdminTokenFile                string              `json:"adminTokenFile"`
+	Address6                      string              `json:"address6"`
+	AllowedIPs                    []string            `json:"allowedIPs"`
+	AuditLogFile                  string              `json:"auditLogFile"`
+	AuditWebhookURLs              []string            `json:"auditWebhookURLs"`
+	ClientCAFile                  string              `json:"clientCAFile"`
+	DeviceMTU                     int                 `json:"deviceMTU"`
+	DeviceName                    string              `json:"deviceName"`
+	Endpoint                      string              `json:"endpoint"`
+	IdlePeerTimeout               string              `json:"idlePeerTimeout"`
+	IntrospectionCacheNegativeTTL string              `json:"introspectionCacheNegativeTTL"`
+	IntrospectionCacheSize        int                 `json:"introspectionCacheSize"`
+	IntrospectionCacheTTL         string              `json:"introspectionCacheTTL"`
+	KeyFilename                   string              `json:"keyFilename"`
+	LeaserSyncInterval            string              `json:"leaserSyncInterval"`
+	LeaseStore                    string              `json:"leaseStore"`
+	LeasesFilename                string              `json:"leasesFilename"`
+	MaxDevicesPerUser             int                 `json:"maxDevicesPerUser"`
+	MaxLeaseDuration              string              `json:"maxLeaseDuration"`
+	MinLeaseDuration              string              `json:"minLeaseDuration"`
+	PeerFirewall                  bool                `json:"peerFirewall"`
+	PersistDevice                 bool                `json:"persistDevice"`
+	PoolExhaustionPolicy          string              `json:"poolExhaustionPolicy"`
+	PresharedKeys                 bool                `json:"presharedKeys"`
+	Reservations                  map[string]string   `json:"reservations"`
+	OauthServers                  []oauthServerConfig `json:"oauthServers"`
+	Policies                      []accessPolicy      `json:"policies"`
+	ServerListenAddress           string              `json:"serverListenAddress"`
+	TLSCertFile                   string              `json:"tlsCertFile"`
+	TLSKeyFile                    string              `json:"tlsKeyFile"`
+	TokenRevalidationInterval     string              `json:"tokenRevalidationInterval"`
 }
 
 func (c *serverConfig) UnmarshalJSON(data []byte) error {
-	cfg := &struct {
-		Address             string              `json:"address"`
-		AllowedIPs          []string            `json:"allowedIPs"`
-		DeviceMTU           int                 `json:"deviceMTU"`
-		DeviceName          string              `json:"deviceName"`
-		Endpoint            string              `json:"endpoint"`
-		KeyFilename         string              `json:"keyFilename"`
-		LeaserSyncInterval  string              `json:"leaserSyncInterval"`
-		LeasesFilename      string              `json:"leasesFilename"`
-		OauthServers        []oauthServerConfig `json:"oauthServers"`
-		ServerListenAddress string              `json:"serverListenAddress"`
-	}{}
+	cfg := &serverConfigFile{}
 	if err := json.Unmarshal(data, cfg); err != nil {
 		return err
 	}
@@ -190,23 +292,135 @@ func (c *serverConfig) UnmarshalJSON(data []byte) error {
 		}
 		c.LeaserSyncInterval = lsi
 	}
+	if cfg.TokenRevalidationInterval != "" {
+		tri, err := time.ParseDuration(cfg.TokenRevalidationInterval)
+		if err != nil {
+			return err
+		}
+		c.TokenRevalidationInterval = tri
+	}
+	if cfg.AddressReuseGracePeriod != "" {
+		grace, err := time.ParseDuration(cfg.AddressReuseGracePeriod)
+		if err != nil {
+			return err
+		}
+		c.AddressReuseGracePeriod = grace
+	}
+	if cfg.IdlePeerTimeout != "" {
+		ipt, err := time.ParseDuration(cfg.IdlePeerTimeout)
+		if err != nil {
+			return err
+		}
+		c.IdlePeerTimeout = ipt
+	}
+	if cfg.IntrospectionCacheTTL != "" {
+		ttl, err := time.ParseDuration(cfg.IntrospectionCacheTTL)
+		if err != nil {
+			return err
+		}
+		c.IntrospectionCacheTTL = ttl
+	}
+	if cfg.IntrospectionCacheNegativeTTL != "" {
+		ttl, err := time.ParseDuration(cfg.IntrospectionCacheNegativeTTL)
+		if err != nil {
+			return err
+		}
+		c.IntrospectionCacheNegativeTTL = ttl
+	}
+	if cfg.MaxLeaseDuration != "" {
+		maxLease, err := time.ParseDuration(cfg.MaxLeaseDuration)
+		if err != nil {
+			return err
+		}
+		c.MaxLeaseDuration = maxLease
+	}
+	if cfg.MinLeaseDuration != "" {
+		minLease, err := time.ParseDuration(cfg.MinLeaseDuration)
+		if err != nil {
+			return err
+		}
+		c.MinLeaseDuration = minLease
+	}
 	c.Address = cfg.Address
+	c.Address6 = cfg.Address6
+	c.AdminGroups = cfg.AdminGroups
+	c.AdminListenAddress = cfg.AdminListenAddress
+	c.AdminTokenFile = cfg.AdminTokenFile
 	c.AllowedIPs = cfg.AllowedIPs
+	c.AuditLogFile = cfg.AuditLogFile
+	c.AuditWebhookURLs = cfg.AuditWebhookURLs
+	c.ClientCAFile = cfg.ClientCAFile
 	c.DeviceMTU = cfg.DeviceMTU
 	c.DeviceName = cfg.DeviceName
 	c.Endpoint = cfg.Endpoint
+	c.IntrospectionCacheSize = cfg.IntrospectionCacheSize
 	c.KeyFilename = cfg.KeyFilename
+	c.LeaseStore = cfg.LeaseStore
 	c.LeasesFilename = cfg.LeasesFilename
+	c.MaxDevicesPerUser = cfg.MaxDevicesPerUser
+	c.PeerFirewall = cfg.PeerFirewall
+	c.PersistDevice = cfg.PersistDevice
+	c.PoolExhaustionPolicy = cfg.PoolExhaustionPolicy
+	c.PresharedKeys = cfg.PresharedKeys
+	c.Reservations = cfg.Reservations
 	c.OauthServers = cfg.OauthServers
+	c.Policies = cfg.Policies
 	c.ServerListenAddress = cfg.ServerListenAddress
+	c.TLSCertFile = cfg.TLSCertFile
+	c.TLSKeyFile = cfg.TLSKeyFile
 	return nil
 }
 
+// MarshalJSON encodes the config in the format of the config file.
+func (c *serverConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&serverConfigFile{
+		Address:                       c.Address,
+		AddressReuseGracePeriod:       c.AddressReuseGracePeriod.String(),
+		AdminGroups:                   c.AdminGroups,
+		AdminListenAddress:            c.AdminListenAddress,
+		AdminTokenFile:                c.AdminTokenFile,
+		Address6:                      c.Address6,
+		AllowedIPs:                    c.AllowedIPs,
+		AuditLogFile:                  c.AuditLogFile,
+		AuditWebhookURLs:              c.AuditWebhookURLs,
+		ClientCAFile:                  c.ClientCAFile,
+		DeviceMTU:                     c.DeviceMTU,
+		DeviceName:                    c.DeviceName,
+		Endpoint:                      c.Endpoint,
+		IdlePeerTimeout:               c.IdlePeerTimeout.String(),
+		IntrospectionCacheNegativeTTL: c.IntrospectionCacheNegativeTTL.String(),
+		IntrospectionCacheSize:        c.IntrospectionCacheSize,
+		IntrospectionCacheTTL:         c.IntrospectionCacheTTL.String(),
+		KeyFilename:                   c.KeyFilename,
+		LeaserSyncInterval:            c.LeaserSyncInterval.String(),
+		LeaseStore:                    c.LeaseStore,
+		LeasesFilename:                c.LeasesFilename,
+		MaxDevicesPerUser:             c.MaxDevicesPerUser,
+		MaxLeaseDuration:              c.MaxLeaseDuration.String(),
+		MinLeaseDuration:              c.MinLeaseDuration.String(),
+		PeerFirewall:                  c.PeerFirewall,
+		PersistDevice:                 c.PersistDevice,
+		PoolExhaustionPolicy:          c.PoolExhaustionPolicy,
+		PresharedKeys:                 c.PresharedKeys,
+		Reservations:                  c.Reservations,
+		OauthServers:                  c.OauthServers,
+		Policies:                      c.Policies,
+		ServerListenAddress:           c.ServerListenAddress,
+		TLSCertFile:                   c.TLSCertFile,
+		TLSKeyFile:                    c.TLSKeyFile,
+		TokenRevalidationInterval:     c.TokenRevalidationInterval.String(),
+	})
+}
+
 func verifyServerConfig(conf *serverConfig, allowPublicRoutes bool) error {
 	if conf.Address == "" {
 		return fmt.Errorf("config missing `address`")
 	}
-	conf.WireguardIPPrefix = netip.MustParsePrefix(conf.Address)
+	prefix, err := netip.ParsePrefix(conf.Address)
+	if err != nil {
+		return fmt.Errorf("invalid `address` value: %w", err)
+	}
+	conf.WireguardIPPrefix = prefix
 	if !allowPublicRoutes {
 		ok, err := isPrivateCIDR(conf.Address)
 		if err != nil {
@@ -222,6 +436,31 @@ func verifyServerConfig(conf *serverConfig, allowPublicRoutes bool) error {
 			)
 		}
 	}
+	if conf.Address6 != "" {
+		prefix, err := netip.ParsePrefix(conf.Address6)
+		if err != nil {
+			return fmt.Errorf("invalid `address6` value: %w", err)
+		}
+		if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			return fmt.Errorf("`address6` must be an IPv6 CIDR, got: %s", conf.Address6)
+		}
+		conf.WireguardIP6Prefix = prefix
+		if !allowPublicRoutes {
+			ok, err := isPrivateCIDR(conf.Address6)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf(
+					"address6 %q is not a private CIDR: refusing "+
+						"to configure a public range as the "+
+						"WireGuard interface address; use "+
+						"-allow-public-routes to override",
+					conf.Address6,
+				)
+			}
+		}
+	}
 	if len(conf.AllowedIPs) == 0 {
 		logger.Verbosef("config missing `allowedIPs`, this server is not exposing any networks")
 	}
@@ -243,7 +482,10 @@ func verifyServerConfig(conf *serverConfig, allowPublicRoutes bool) error {
 	}
 	// Append the server wg /32 ip to the allowed ips in case the agent
 	// wants to ping it for health checking
-	conf.AllowedIPs = append(conf.AllowedIPs, fmt.Sprintf("%s/32", conf.WireguardIPPrefix.Addr().String()))
+	conf.AllowedIPs = append(conf.AllowedIPs, serverAddressCIDRs(conf)...)
+	if err := verifyPolicies(conf); err != nil {
+		return err
+	}
 
 	if conf.DeviceName == "" {
 		conf.DeviceName = defaultWireguardDeviceName
@@ -255,11 +497,11 @@ func verifyServerConfig(conf *serverConfig, allowPublicRoutes bool) error {
 	if conf.Endpoint == "" {
 		return fmt.Errorf("config missing `endpoint`")
 	}
-	ep := strings.Split(conf.Endpoint, ":")
-	if len(ep) != 2 {
+	_, epPort, err := net.SplitHostPort(conf.Endpoint)
+	if err != nil {
 		return fmt.Errorf("invalid `endpoint` value, it must be of the format `<host>:<port>`, got: %s", conf.Endpoint)
 	}
-	port, err := strconv.Atoi(ep[1])
+	port, err := strconv.Atoi(epPort)
 	if err != nil {
 		return fmt.Errorf("could not parse listen port value: %w", err)
 	}
@@ -278,12 +520,118 @@ func verifyServerConfig(conf *serverConfig, allowPublicRoutes bool) error {
 			defaultLeaserSyncInterval,
 		)
 	}
+	switch conf.LeaseStore {
+	case "":
+		conf.LeaseStore = defaultLeaseStore
+		logger.Verbosef(
+			"config missing `leaseStore`, using default: %s",
+			defaultLeaseStore,
+		)
+	case leaseStoreFile, leaseStoreBolt:
+	default:
+		return fmt.Errorf(
+			"invalid `leaseStore` value %q, must be one of: %s, %s",
+			conf.LeaseStore,
+			leaseStoreFile,
+			leaseStoreBolt,
+		)
+	}
 	if conf.LeasesFilename == "" {
+		// The stores use different formats, so that switching to bolt
+		// must not open the leases file of the file store.
 		conf.LeasesFilename = defaultLeasesFilename
+		if conf.LeaseStore == leaseStoreBolt {
+			conf.LeasesFilename = defaultBoltLeasesFilename
+		}
 		logger.Verbosef(
 			"config missing `leasesFilename`, using default: %s",
-			defaultLeasesFilename,
+			conf.LeasesFilename,
+		)
+	}
+	if conf.TokenRevalidationInterval < 0 {
+		return fmt.Errorf("`tokenRevalidationInterval` cannot be negative")
+	}
+	if conf.AddressReuseGracePeriod < 0 {
+		return fmt.Errorf("`addressReuseGracePeriod` cannot be negative")
+	}
+	if conf.IdlePeerTimeout < 0 {
+		return fmt.Errorf("`idlePeerTimeout` cannot be negative")
+	}
+	if conf.IdlePeerTimeout > 0 && conf.IdlePeerTimeout < minIdlePeerTimeout {
+		return fmt.Errorf("`idlePeerTimeout` must be at least %s", minIdlePeerTimeout)
+	}
+	if conf.IntrospectionCacheTTL < 0 {
+		return fmt.Errorf("`introspectionCacheTTL` cannot be negative")
+	}
+	if conf.IntrospectionCacheNegativeTTL < 0 {
+		return fmt.Errorf("`introspectionCacheNegativeTTL` cannot be negative")
+	}
+	if conf.IntrospectionCacheSize < 0 {
+		return fmt.Errorf("`introspectionCacheSize` cannot be negative")
+	}
+	if conf.IntrospectionCacheTTL == 0 && (conf.IntrospectionCacheNegativeTTL > 0 || conf.IntrospectionCacheSize > 0) {
+		return fmt.Errorf("`introspectionCacheNegativeTTL` and `introspectionCacheSize` require `introspectionCacheTTL` to be set")
+	}
+	if conf.IntrospectionCacheTTL > 0 {
+		if conf.IntrospectionCacheNegativeTTL == 0 {
+			conf.IntrospectionCacheNegativeTTL = min(defaultIntrospectionCacheNegativeTTL, conf.IntrospectionCacheTTL)
+		}
+		if conf.IntrospectionCacheNegativeTTL > conf.IntrospectionCacheTTL {
+			return fmt.Errorf("`introspectionCacheNegativeTTL` cannot be greater than `introspectionCacheTTL`")
+		}
+		if conf.IntrospectionCacheSize == 0 {
+			conf.IntrospectionCacheSize = defaultIntrospectionCacheSize
+		}
+	}
+	if conf.MaxLeaseDuration < 0 {
+		return fmt.Errorf("`maxLeaseDuration` cannot be negative")
+	}
+	if conf.MinLeaseDuration < 0 {
+		return fmt.Errorf("`minLeaseDuration` cannot be negative")
+	}
+	if conf.MaxLeaseDuration > 0 && conf.MinLeaseDuration > conf.MaxLeaseDuration {
+		return fmt.Errorf("`minLeaseDuration` cannot be greater than `maxLeaseDuration`")
+	}
+	switch {
+	case conf.MaxDevicesPerUser == 0:
+		conf.MaxDevicesPerUser = defaultMaxDevicesPerUser
+		logger.Verbosef(
+			"config missing `maxDevicesPerUser`, using default: %d",
+			defaultMaxDevicesPerUser,
+		)
+	case conf.MaxDevicesPerUser < -1:
+		return fmt.Errorf("`maxDevicesPerUser` must be positive, or -1 for no limit")
+	}
+	switch conf.PoolExhaustionPolicy {
+	case "":
+		conf.PoolExhaustionPolicy = defaultPoolExhaustionPolicy
+		logger.Verbosef(
+			"config missing `poolExhaustionPolicy`, using default: %s",
+			defaultPoolExhaustionPolicy,
 		)
+	case poolExhaustionReject, poolExhaustionReclaim:
+	default:
+		return fmt.Errorf(
+			"invalid `poolExhaustionPolicy` value %q, must be one of: %s, %s",
+			conf.PoolExhaustionPolicy,
+			poolExhaustionReject,
+			poolExhaustionReclaim,
+		)
+	}
+	if err := verifyReservations(conf); err != nil {
+		return err
+	}
+	for i, u := range conf.AuditWebhookURLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid auditWebhookURLs[%d]: %w", i, err)
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid auditWebhookURLs[%d] %q, must be an http or https URL", i, u)
+		}
+	}
+	if conf.AdminListenAddress != "" && len(conf.AdminGroups) == 0 && conf.AdminTokenFile == "" {
+		return fmt.Errorf("`adminListenAddress` requires `adminGroups` or `adminTokenFile` to be set")
 	}
 	if len(conf.OauthServers) == 0 {
 		return fmt.Errorf("config missing `oauthServers`, at least one entry is required")
@@ -292,10 +640,47 @@ func verifyServerConfig(conf *serverConfig, allowPublicRoutes bool) error {
 		if s.Server == "" {
 			return fmt.Errorf("oauthServers[%d] missing `server`", i)
 		}
-		if s.ClientID == "" {
-			return fmt.Errorf("oauthServers[%d] missing `clientID`", i)
+		switch s.Verification {
+		case "", tokenVerificationIntrospection:
+			if s.ClientID == "" {
+				return fmt.Errorf("oauthServers[%d] missing `clientID`", i)
+			}
+		case tokenVerificationJWKS:
+			if len(s.Audiences) == 0 {
+				return fmt.Errorf("oauthServers[%d] missing `audiences`, required with `jwks` verification", i)
+			}
+		default:
+			return fmt.Errorf(
+				"invalid oauthServers[%d] `verification` %q, must be one of %q or %q",
+				i, s.Verification, tokenVerificationIntrospection, tokenVerificationJWKS,
+			)
+		}
+		switch s.UsernameClaim {
+		case "", usernameClaimEmail, usernameClaimPreferredUsername, usernameClaimSub, usernameClaimUsername:
+		default:
+			return fmt.Errorf(
+				"invalid oauthServers[%d] `usernameClaim` %q, must be one of %q, %q, %q or %q",
+				i, s.UsernameClaim, usernameClaimSub, usernameClaimEmail, usernameClaimPreferredUsername, usernameClaimUsername,
+			)
+		}
+		if s.UsernamePrefix != "" && !usernameRe.MatchString(s.UsernamePrefix) {
+			return fmt.Errorf("invalid oauthServers[%d] `usernamePrefix` %q, must not contain whitespace or control characters", i, s.UsernamePrefix)
 		}
 	}
+	if (conf.TLSCertFile == "") != (conf.TLSKeyFile == "") {
+		return fmt.Errorf("`tlsCertFile` and `tlsKeyFile` must be set together")
+	}
+	if conf.ClientCAFile != "" && conf.TLSCertFile == "" {
+		return fmt.Errorf("`clientCAFile` requires `tlsCertFile` and `tlsKeyFile` to be set")
+	}
+	// The admin API carries admin tokens, which must not cross the network
+	// in the clear.
+	if conf.AdminListenAddress != "" && conf.TLSCertFile == "" && !isLoopbackAddress(conf.AdminListenAddress) {
+		return fmt.Errorf(
+			"`adminListenAddress` must be a loopback address unless `tlsCertFile` and `tlsKeyFile` are set, got: %s",
+			conf.AdminListenAddress,
+		)
+	}
 	if conf.ServerListenAddress == "" {
 		conf.ServerListenAddress = defaultServerListenAddress
 		logger.Verbosef(
@@ -306,16 +691,62 @@ func verifyServerConfig(conf *serverConfig, allowPublicRoutes bool) error {
 	return nil
 }
 
-func readServerConfig(path string, allowPublicRoutes bool) (*serverConfig, error) {
-	conf := &serverConfig{}
-	fileContent, err := os.ReadFile(path)
+// isLoopbackAddress reports whether a listen address of the form
+// `<host>:<port>` only accepts connections from the local host.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
-		return nil, fmt.Errorf("error reading config file: %v", err)
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// verifyReservations parses the static address reservations and checks that
+// every reserved address is a leasable address of the pool and that no
+// address is reserved twice.
+func verifyReservations(conf *serverConfig) error {
+	if len(conf.Reservations) == 0 {
+		return nil
+	}
+	pool := conf.WireguardIPPrefix.Masked()
+	conf.ReservedAddresses = make(map[string]netip.Addr, len(conf.Reservations))
+	reservedBy := make(map[netip.Addr]string, len(conf.Reservations))
+	for name, addr := range conf.Reservations {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return fmt.Errorf("invalid reserved address for %q: %w", name, err)
+		}
+		if !pool.Contains(ip) {
+			return fmt.Errorf("reserved address %s for %q is outside of `address` range %s", ip, name, pool)
+		}
+		if ip == conf.WireguardIPPrefix.Addr() || ip == pool.Addr() || ip == netipx.PrefixLastIP(pool) {
+			return fmt.Errorf("reserved address %s for %q is not assignable to peers", ip, name)
+		}
+		if other, ok := reservedBy[ip]; ok {
+			return fmt.Errorf("address %s is reserved for both %q and %q", ip, other, name)
+		}
+		reservedBy[ip] = name
+		conf.ReservedAddresses[name] = ip
 	}
-	if err = json.Unmarshal(fileContent, conf); err != nil {
-		return nil, fmt.Errorf("error unmarshalling config: %v", err)
+	return nil
+}
+
+func readServerConfig(path string, allowPublicRoutes bool) (*serverConfig, error) {
+	return parseServerConfig(path, allowPublicRoutes, false)
+}
+
+// parseServerConfig reads and verifies the server config. In strict mode
+// unknown keys are rejected.
+func parseServerConfig(path string, allowPublicRoutes, strict bool) (*serverConfig, error) {
+	conf := &serverConfig{}
+	if err := loadConfig(path, reflect.TypeOf(serverConfigFile{}), conf, strict); err != nil {
+		return nil, err
 	}
-	if err = verifyServerConfig(conf, allowPublicRoutes); err != nil {
+	if err := verifyServerConfig(conf, allowPublicRoutes); err != nil {
 		return nil, err
 	}
 	return conf, nil
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables that override config
+// file keys and command line flags.
+const envPrefix = "WIRESTEWARD_"
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// configEnvVar is an environment variable that overrides a config key.
+type configEnvVar struct {
+	Name string
+	Path []string // the key, and the keys of the objects it is nested in
+}
+
+// envName returns the environment variable name for the given config key or
+// flag name, e.g. WIRESTEWARD_ALLOWED_IPS for `allowedIPs`. A word following
+// an acronym is split off, so `clientCAFile` becomes
+// WIRESTEWARD_CLIENT_CA_FILE, unless it is only a plural "s" as in `IPs`.
+func envName(parts ...string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteByte('_')
+		}
+		runes := []rune(part)
+		for j, r := range runes {
+			switch {
+			case r == '-':
+				b.WriteByte('_')
+			case unicode.IsUpper(r) && j > 0 && (unicode.IsLower(runes[j-1]) || unicode.IsDigit(runes[j-1])):
+				b.WriteByte('_')
+				b.WriteRune(r)
+			case unicode.IsUpper(r) && j > 0 && unicode.IsUpper(runes[j-1]) && startsWord(runes[j+1:]):
+				b.WriteByte('_')
+				b.WriteRune(r)
+			default:
+				b.WriteRune(unicode.ToUpper(r))
+			}
+		}
+	}
+	return b.String()
+}
+
+// startsWord reports whether runes begin with a lowercase word longer than a
+// plural "s".
+func startsWord(runes []rune) bool {
+	n := 0
+	for n < len(runes) && unicode.IsLower(runes[n]) {
+		n++
+	}
+	return n > 1 || n == 1 && runes[0] != 's'
+}
+
+// configEnvVars returns the environment variables of the keys defined by the
+// json tags of t. Objects are descended into, so that each of their keys gets
+// its own variable, unless they decode themselves. Lists and maps are set as a
+// whole, with a JSON value.
+func configEnvVars(t reflect.Type, path ...string) []configEnvVar {
+	vars := []configEnvVar{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		p := append(append([]string{}, path...), key)
+		if f.Type.Kind() == reflect.Struct && !reflect.PointerTo(f.Type).Implements(jsonUnmarshalerType) {
+			vars = append(vars, configEnvVars(f.Type, p...)...)
+			continue
+		}
+		vars = append(vars, configEnvVar{Name: envName(p...), Path: p})
+	}
+	return vars
+}
+
+// envValue returns the JSON encoding of an environment variable value for a
+// key of type t. Values that are valid JSON for the key are used as they are,
+// and anything else is taken to be a string.
+func envValue(t reflect.Type, value string) (json.RawMessage, error) {
+	if json.Unmarshal([]byte(value), reflect.New(t).Interface()) == nil {
+		return json.RawMessage(value), nil
+	}
+	quoted, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(quoted, reflect.New(t).Interface()); err != nil {
+		return nil, err
+	}
+	return quoted, nil
+}
+
+// fieldType returns the type of the key at path in t.
+func fieldType(t reflect.Type, path []string) reflect.Type {
+	for _, key := range path {
+		for i := 0; i < t.NumField(); i++ {
+			if k, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); k == key {
+				t = t.Field(i).Type
+				break
+			}
+		}
+	}
+	return t
+}
+
+// decodeConfigFile decodes a JSON or YAML config file, depending on its
+// extension, into a generic object.
+func decodeConfigFile(path string, content []byte) (map[string]interface{}, error) {
+	doc := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			return nil, err
+		}
+	default:
+		if err := json.Unmarshal(content, &doc); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// overlayEnv sets the keys of doc that are overridden by environment
+// variables. The keys are those of the json tags of t.
+func overlayEnv(doc map[string]interface{}, t reflect.Type) error {
+	for _, v := range configEnvVars(t) {
+		value, ok := os.LookupEnv(v.Name)
+		if !ok {
+			continue
+		}
+		raw, err := envValue(fieldType(t, v.Path), value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", v.Name, err)
+		}
+		obj := doc
+		for _, key := range v.Path[:len(v.Path)-1] {
+			child, ok := obj[key].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				obj[key] = child
+			}
+			obj = child
+		}
+		obj[v.Path[len(v.Path)-1]] = raw
+	}
+	return nil
+}
+
+// loadConfig reads the config file at path, overrides its keys with the
+// environment variables defined by the json tags of t, and decodes the result
+// into conf. In strict mode keys that are not defined by t are rejected,
+// rather than ignored.
+func loadConfig(path string, t reflect.Type, conf interface{}, strict bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	doc, err := decodeConfigFile(path, content)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling config: %v", err)
+	}
+	if err := overlayEnv(doc, t); err != nil {
+		return err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling config: %v", err)
+	}
+	if strict {
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("error unmarshalling config: %v", err)
+		}
+		if unknown := unknownKeys(v, t, ""); len(unknown) > 0 {
+			return fmt.Errorf("unknown config keys: %s", strings.Join(unknown, ", "))
+		}
+	}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return fmt.Errorf("error unmarshalling config: %v", err)
+	}
+	return nil
+}
+
+// unknownKeys returns the keys of v, at any depth, that are not defined by the
+// json tags of t. Keys are matched exactly, and a key that only differs in
+// case from a defined one is reported with a suggestion.
+func unknownKeys(v interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+	unknown := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			field, suggestion := configField(t, k)
+			if field == nil {
+				msg := "`" + path + k + "`"
+				if suggestion != "" {
+					msg += " (did you mean `" + path + suggestion + "`?)"
+				}
+				unknown = append(unknown, msg)
+				continue
+			}
+			unknown = append(unknown, unknownKeys(obj[k], field.Type, path+k+".")...)
+		}
+	case reflect.Slice:
+		list, _ := v.([]interface{})
+		for i, e := range list {
+			unknown = append(unknown, unknownKeys(e, t.Elem(), fmt.Sprintf("%s[%d].", strings.TrimSuffix(path, "."), i))...)
+		}
+	case reflect.Map:
+		obj, _ := v.(map[string]interface{})
+		for k, e := range obj {
+			unknown = append(unknown, unknownKeys(e, t.Elem(), path+k+".")...)
+		}
+	}
+	return unknown
+}
+
+// configField returns the field of t with the given json key, or the key of a
+// field that only differs in case.
+func configField(t reflect.Type, key string) (*reflect.StructField, string) {
+	suggestion := ""
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		k, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if k == key {
+			return &f, ""
+		}
+		if strings.EqualFold(k, key) {
+			suggestion = k
+		}
+	}
+	return nil, suggestion
+}
+
+// validateConfig strictly reads the agent or the server config file, runs
+// all the checks that do not need the network, and writes the effective
+// config with all defaults applied to w.
+func validateConfig(w io.Writer, path string, agent, allowPublicRoutes bool) error {
+	var conf interface{}
+	var err error
+	if agent {
+		conf, err = parseAgentConfig(path, true)
+	} else {
+		conf, err = parseServerConfig(path, allowPublicRoutes, true)
+	}
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+// setFlagsFromEnv sets the flags that were not given on the command line from
+// their environment variables, e.g. -log-level from WIRESTEWARD_LOG_LEVEL.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("invalid value for %s: %v", name, e)
+			}
+		}
+	})
+	return err
+}
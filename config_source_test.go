@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvName(t *testing.T) {
+	for key, want := range map[string]string{
+		"endpoint":              "WIRESTEWARD_ENDPOINT",
+		"oauthServers":          "WIRESTEWARD_OAUTH_SERVERS",
+		"allowedIPs":            "WIRESTEWARD_ALLOWED_IPS",
+		"auditWebhookURLs":      "WIRESTEWARD_AUDIT_WEBHOOK_URLS",
+		"deviceMTU":             "WIRESTEWARD_DEVICE_MTU",
+		"address6":              "WIRESTEWARD_ADDRESS6",
+		"log-level":             "WIRESTEWARD_LOG_LEVEL",
+		"leaserSyncInterval":    "WIRESTEWARD_LEASER_SYNC_INTERVAL",
+		"clientCAFile":          "WIRESTEWARD_CLIENT_CA_FILE",
+		"introspectionCacheTTL": "WIRESTEWARD_INTROSPECTION_CACHE_TTL",
+		"URLsFile":              "WIRESTEWARD_URLS_FILE",
+	} {
+		assert.Equal(t, want, envName(key))
+	}
+	assert.Equal(t, "WIRESTEWARD_HEALTHCHECK_INTERVAL_AF", envName("healthcheck", "intervalAF"))
+}
+
+func TestConfigEnvVars_noFlagCollisions(t *testing.T) {
+	names := map[string]bool{}
+	for _, typ := range []reflect.Type{reflect.TypeOf(serverConfigFile{}), reflect.TypeOf(agentConfig{})} {
+		for _, v := range configEnvVars(typ) {
+			names[v.Name] = true
+		}
+	}
+	assert.Contains(t, names, "WIRESTEWARD_OAUTH_CLIENT_ID")
+	flag.VisitAll(func(f *flag.Flag) {
+		assert.NotContains(t, names, envName(f.Name), "flag -%s", f.Name)
+	})
+}
+
+func TestReadServerConfig_yamlAndEnv(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	content := []byte(`
+address: 10.90.0.1/20
+allowedIPs:
+  - 10.1.0.0/16
+endpoint: 1.2.3.4:51820
+leaserSyncInterval: 30s
+oauthServers:
+  - server: https://idp.example.com
+    clientID: from-file
+`)
+	if err := os.WriteFile(filename, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readServerConfig(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1.2.3.4:51820", cfg.Endpoint)
+	assert.Equal(t, 30*time.Second, cfg.LeaserSyncInterval)
+	assert.Equal(t, []oauthServerConfig{{Server: "https://idp.example.com", ClientID: "from-file"}}, cfg.OauthServers)
+
+	t.Setenv("WIRESTEWARD_ENDPOINT", "5.6.7.8:51820")
+	t.Setenv("WIRESTEWARD_OAUTH_SERVERS", `[{"server": "https://idp.example.com", "clientID": "from-env"}]`)
+	t.Setenv("WIRESTEWARD_MAX_DEVICES_PER_USER", "3")
+	t.Setenv("WIRESTEWARD_PEER_FIREWALL", "true")
+	cfg, err = readServerConfig(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "5.6.7.8:51820", cfg.Endpoint)
+	assert.Equal(t, []oauthServerConfig{{Server: "https://idp.example.com", ClientID: "from-env"}}, cfg.OauthServers)
+	assert.Equal(t, 3, cfg.MaxDevicesPerUser)
+	assert.True(t, cfg.PeerFirewall)
+	assert.Equal(t, 30*time.Second, cfg.LeaserSyncInterval)
+
+	t.Setenv("WIRESTEWARD_MAX_DEVICES_PER_USER", "three")
+	_, err = readServerConfig(filename, false)
+	assert.ErrorContains(t, err, "invalid value for WIRESTEWARD_MAX_DEVICES_PER_USER")
+}
+
+func TestReadAgentConfig_env(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	content := []byte(`{
+		"oauth": {"authUrl": "example.com/auth", "tokenUrl": "example.com/token"},
+		"devices": [{"name": "wg_test", "peers": [{"url": "example1.com"}]}]
+	}`)
+	if err := os.WriteFile(filename, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// readAgentConfig decodes into the shared defaults.
+	defaults := *agentConfRead
+	defer func() { *agentConfRead = defaults }()
+
+	t.Setenv("WIRESTEWARD_OAUTH_CLIENT_ID", "xxxxx")
+	t.Setenv("WIRESTEWARD_HEALTHCHECK_INTERVAL_AF", "2s")
+	conf, err := readAgentConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "xxxxx", conf.OAuth.ClientID)
+	assert.Equal(t, "example.com/auth", conf.OAuth.AuthURL)
+	assert.Equal(t, Duration{2 * time.Second}, conf.HealthCheck.IntervalAfterFailure)
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	logLevel := fs.String("log-level", "error", "")
+	metrics := fs.String("metrics-address", ":8081", "")
+	server := fs.Bool("server", false, "")
+	if err := fs.Parse([]string{"-metrics-address", ":9090"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WIRESTEWARD_LOG_LEVEL", "debug")
+	t.Setenv("WIRESTEWARD_METRICS_ADDRESS", ":9999")
+	t.Setenv("WIRESTEWARD_SERVER", "true")
+	assert.NoError(t, setFlagsFromEnv(fs))
+	assert.Equal(t, "debug", *logLevel)
+	// Command line flags take precedence over the environment.
+	assert.Equal(t, ":9090", *metrics)
+	assert.True(t, *server)
+
+	t.Setenv("WIRESTEWARD_SERVER", "maybe")
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("server", false, "")
+	assert.ErrorContains(t, setFlagsFromEnv(fs), "invalid value for WIRESTEWARD_SERVER")
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	server := filepath.Join(dir, "server.json")
+	content := []byte(`{
+		"address": "10.90.0.1/20",
+		"allowedIPs": ["10.1.0.0/16"],
+		"endpoint": "1.2.3.4:51820",
+		"leaserSyncIntervall": "30s",
+		"oauthServers": [{"server": "https://idp.example.com", "clientId": "client_id"}]
+	}`)
+	if err := os.WriteFile(server, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Unknown keys are ignored when the server starts.
+	if _, err := readServerConfig(server, false); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	assert.EqualError(
+		t,
+		validateConfig(&out, server, false, false),
+		"unknown config keys: `leaserSyncIntervall`, `oauthServers[0].clientId` (did you mean `oauthServers[0].clientID`?)",
+	)
+	assert.Empty(t, out.String())
+
+	content = []byte(`{
+		"address": "10.90.0.1/20",
+		"allowedIPs": ["10.1.0.0/16"],
+		"endpoint": "1.2.3.4:51820",
+		"oauthServers": [{"server": "https://idp.example.com", "clientID": "client_id"}]
+	}`)
+	if err := os.WriteFile(server, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, validateConfig(&out, server, false, false))
+	// The effective config can be read back.
+	effective := filepath.Join(dir, "effective.json")
+	if err := os.WriteFile(effective, []byte(out.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := readServerConfig(server, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := parseServerConfig(effective, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected.LeaserSyncInterval, actual.LeaserSyncInterval)
+	assert.Equal(t, expected.KeyFilename, actual.KeyFilename)
+	assert.Equal(t, expected.OauthServers, actual.OauthServers)
+
+	// Invalid values are reported, not a panic.
+	content = []byte(`{
+		"address": "10.90.0.1",
+		"allowedIPs": ["10.1.0.0/16"],
+		"endpoint": "1.2.3.4:51820",
+		"oauthServers": [{"server": "https://idp.example.com", "clientID": "client_id"}]
+	}`)
+	if err := os.WriteFile(server, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorContains(t, validateConfig(io.Discard, server, false, false), "invalid `address` value")
+
+	defaults := *agentConfRead
+	defer func() { *agentConfRead = defaults }()
+	agent := filepath.Join(dir, "agent.yaml")
+	content = []byte(`
+oauth:
+  clientID: xxxxx
+  authUrl: example.com/auth
+  tokenUrl: example.com/token
+devices:
+  - name: wg_test
+    peers:
+      - url: example1.com
+healthcheck:
+  intervalAf: 2s
+`)
+	if err := os.WriteFile(agent, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(
+		t,
+		validateConfig(&out, agent, true, false),
+		"unknown config keys: `healthcheck.intervalAf` (did you mean `healthcheck.intervalAF`?)",
+	)
+}
@@ -138,6 +138,25 @@ func TestAgentConfigFmt(t *testing.T) {
 	assert.Equal(t, Duration{5 * time.Minute}, conf.OAuth.RefreshBeforeExpiry)
 }
 
+func TestVerifyAgentDevicesConfig_peerTLS(t *testing.T) {
+	conf := &agentConfig{Devices: []agentDeviceConfig{{
+		Name: "wg_test",
+		Peers: []agentPeerConfig{{
+			URL:      "https://example1.com",
+			CAFile:   "/etc/wiresteward/ca.pem",
+			CertFile: "/etc/wiresteward/client.pem",
+			KeyFile:  "/etc/wiresteward/client-key.pem",
+		}},
+	}}}
+	assert.NoError(t, verifyAgentDevicesConfig(conf))
+	conf.Devices[0].Peers[0].KeyFile = ""
+	assert.EqualError(
+		t,
+		verifyAgentDevicesConfig(conf),
+		"Peer https://example1.com: `certFile` and `keyFile` must be set together",
+	)
+}
+
 func TestServerConfig(t *testing.T) {
 	setLogLevel("error")
 	logger = newLogger("wiresteward-test")
@@ -158,15 +177,50 @@ func TestServerConfig(t *testing.T) {
 				]
 			}`),
 			&serverConfig{
-				Address:             "10.0.0.1/24",
-				AllowedIPs:          []string{"192.168.1.0/24", "10.0.0.1/32"},
-				DeviceName:          "wg0",
-				Endpoint:            "1.2.3.4:1234",
-				KeyFilename:         defaultKeyFilename,
-				LeaserSyncInterval:  defaultLeaserSyncInterval,
-				LeasesFilename:      defaultLeasesFilename,
-				WireguardIPPrefix:   ipPrefix,
-				WireguardListenPort: 1234,
+				Address:              "10.0.0.1/24",
+				AllowedIPs:           []string{"192.168.1.0/24", "10.0.0.1/32"},
+				DeviceName:           "wg0",
+				Endpoint:             "1.2.3.4:1234",
+				KeyFilename:          defaultKeyFilename,
+				LeaserSyncInterval:   defaultLeaserSyncInterval,
+				LeaseStore:           defaultLeaseStore,
+				LeasesFilename:       defaultLeasesFilename,
+				MaxDevicesPerUser:    defaultMaxDevicesPerUser,
+				PoolExhaustionPolicy: defaultPoolExhaustionPolicy,
+				WireguardIPPrefix:    ipPrefix,
+				WireguardListenPort:  1234,
+				OauthServers: []oauthServerConfig{
+					{Server: "https://idp.example.com", ClientID: "client_id"},
+				},
+				ServerListenAddress: "0.0.0.0:8080",
+			},
+			false,
+			false,
+		},
+		{
+			// The bolt store defaults to a file of its own
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"allowedIPs": ["192.168.1.0/24"],
+				"endpoint": "1.2.3.4:1234",
+				"leaseStore": "bolt",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			&serverConfig{
+				Address:              "10.0.0.1/24",
+				AllowedIPs:           []string{"192.168.1.0/24", "10.0.0.1/32"},
+				DeviceName:           "wg0",
+				Endpoint:             "1.2.3.4:1234",
+				KeyFilename:          defaultKeyFilename,
+				LeaserSyncInterval:   defaultLeaserSyncInterval,
+				LeaseStore:           leaseStoreBolt,
+				LeasesFilename:       defaultBoltLeasesFilename,
+				MaxDevicesPerUser:    defaultMaxDevicesPerUser,
+				PoolExhaustionPolicy: defaultPoolExhaustionPolicy,
+				WireguardIPPrefix:    ipPrefix,
+				WireguardListenPort:  1234,
 				OauthServers: []oauthServerConfig{
 					{Server: "https://idp.example.com", ClientID: "client_id"},
 				},
@@ -187,15 +241,18 @@ func TestServerConfig(t *testing.T) {
 				]
 			}`),
 			&serverConfig{
-				Address:             "10.0.0.1/24",
-				AllowedIPs:          []string{"192.168.1.0/24", "10.0.0.1/32"},
-				DeviceName:          "wg0",
-				Endpoint:            "1.2.3.4:1234",
-				KeyFilename:         defaultKeyFilename,
-				LeaserSyncInterval:  defaultLeaserSyncInterval,
-				LeasesFilename:      defaultLeasesFilename,
-				WireguardIPPrefix:   ipPrefix,
-				WireguardListenPort: 1234,
+				Address:              "10.0.0.1/24",
+				AllowedIPs:           []string{"192.168.1.0/24", "10.0.0.1/32"},
+				DeviceName:           "wg0",
+				Endpoint:             "1.2.3.4:1234",
+				KeyFilename:          defaultKeyFilename,
+				LeaserSyncInterval:   defaultLeaserSyncInterval,
+				LeaseStore:           defaultLeaseStore,
+				LeasesFilename:       defaultLeasesFilename,
+				MaxDevicesPerUser:    defaultMaxDevicesPerUser,
+				PoolExhaustionPolicy: defaultPoolExhaustionPolicy,
+				WireguardIPPrefix:    ipPrefix,
+				WireguardListenPort:  1234,
 				OauthServers: []oauthServerConfig{
 					{Server: "https://idp1.example.com", ClientID: "client_id_1"},
 					{Server: "https://idp2.example.com", ClientID: "client_id_2"},
@@ -212,27 +269,51 @@ func TestServerConfig(t *testing.T) {
 				"deviceMTU": 1300,
 				"deviceName": "wg1",
 				"keyFilename": "bar",
+				"idlePeerTimeout": "30m",
 				"leaserSyncInterval": "3h",
+				"addressReuseGracePeriod": "12h",
+				"tokenRevalidationInterval": "5m",
+				"adminGroups": ["sre"],
+				"adminListenAddress": "127.0.0.1:8081",
+				"auditLogFile": "/var/log/wiresteward/audit.log",
+				"auditWebhookURLs": ["https://audit.example.com/events"],
+				"leaseStore": "bolt",
 				"leasesFilename": "foo",
+				"maxDevicesPerUser": 2,
+				"maxLeaseDuration": "12h",
+				"minLeaseDuration": "30m",
+				"poolExhaustionPolicy": "reclaim",
 				"oauthServers": [
 					{"server": "https://idp.example.com", "clientID": "client_id"}
 				]
 			}`),
 			&serverConfig{
-				Address:             "10.0.0.1/24",
-				AllowedIPs:          []string{"10.0.0.1/32"},
-				DeviceMTU:           1300,
-				DeviceName:          "wg1",
-				Endpoint:            "1.2.3.4:12345",
-				KeyFilename:         "bar",
-				LeasesFilename:      "foo",
-				LeaserSyncInterval:  time.Duration(time.Hour * 3),
-				WireguardIPPrefix:   ipPrefix,
-				WireguardListenPort: 12345,
+				Address:                 "10.0.0.1/24",
+				AddressReuseGracePeriod: 12 * time.Hour,
+				AdminGroups:             []string{"sre"},
+				AdminListenAddress:      "127.0.0.1:8081",
+				AllowedIPs:              []string{"10.0.0.1/32"},
+				AuditLogFile:            "/var/log/wiresteward/audit.log",
+				AuditWebhookURLs:        []string{"https://audit.example.com/events"},
+				DeviceMTU:               1300,
+				DeviceName:              "wg1",
+				Endpoint:                "1.2.3.4:12345",
+				IdlePeerTimeout:         30 * time.Minute,
+				KeyFilename:             "bar",
+				LeaseStore:              leaseStoreBolt,
+				LeasesFilename:          "foo",
+				MaxDevicesPerUser:       2,
+				MaxLeaseDuration:        12 * time.Hour,
+				MinLeaseDuration:        30 * time.Minute,
+				PoolExhaustionPolicy:    poolExhaustionReclaim,
+				LeaserSyncInterval:      time.Duration(time.Hour * 3),
+				WireguardIPPrefix:       ipPrefix,
+				WireguardListenPort:     12345,
 				OauthServers: []oauthServerConfig{
 					{Server: "https://idp.example.com", ClientID: "client_id"},
 				},
-				ServerListenAddress: "0.0.0.0:8080",
+				ServerListenAddress:       "0.0.0.0:8080",
+				TokenRevalidationInterval: 5 * time.Minute,
 			},
 			false,
 			false,
@@ -302,15 +383,18 @@ func TestServerConfig(t *testing.T) {
 				]
 			}`),
 			&serverConfig{
-				Address:             "10.0.0.1/24",
-				AllowedIPs:          []string{"1.2.3.4/8", "10.0.0.1/32"},
-				DeviceName:          "wg0",
-				Endpoint:            "1.2.3.4:1234",
-				KeyFilename:         defaultKeyFilename,
-				LeaserSyncInterval:  defaultLeaserSyncInterval,
-				LeasesFilename:      defaultLeasesFilename,
-				WireguardIPPrefix:   ipPrefix,
-				WireguardListenPort: 1234,
+				Address:              "10.0.0.1/24",
+				AllowedIPs:           []string{"1.2.3.4/8", "10.0.0.1/32"},
+				DeviceName:           "wg0",
+				Endpoint:             "1.2.3.4:1234",
+				KeyFilename:          defaultKeyFilename,
+				LeaserSyncInterval:   defaultLeaserSyncInterval,
+				LeaseStore:           defaultLeaseStore,
+				LeasesFilename:       defaultLeasesFilename,
+				MaxDevicesPerUser:    defaultMaxDevicesPerUser,
+				PoolExhaustionPolicy: defaultPoolExhaustionPolicy,
+				WireguardIPPrefix:    ipPrefix,
+				WireguardListenPort:  1234,
 				OauthServers: []oauthServerConfig{
 					{Server: "https://idp.example.com", ClientID: "client_id"},
 				},
@@ -344,15 +428,18 @@ func TestServerConfig(t *testing.T) {
 				]
 			}`),
 			&serverConfig{
-				Address:             "1.2.3.4/24",
-				AllowedIPs:          []string{"192.168.1.0/24", "1.2.3.4/32"},
-				DeviceName:          "wg0",
-				Endpoint:            "1.2.3.4:1234",
-				KeyFilename:         defaultKeyFilename,
-				LeaserSyncInterval:  defaultLeaserSyncInterval,
-				LeasesFilename:      defaultLeasesFilename,
-				WireguardIPPrefix:   netip.MustParsePrefix("1.2.3.4/24"),
-				WireguardListenPort: 1234,
+				Address:              "1.2.3.4/24",
+				AllowedIPs:           []string{"192.168.1.0/24", "1.2.3.4/32"},
+				DeviceName:           "wg0",
+				Endpoint:             "1.2.3.4:1234",
+				KeyFilename:          defaultKeyFilename,
+				LeaserSyncInterval:   defaultLeaserSyncInterval,
+				LeaseStore:           defaultLeaseStore,
+				LeasesFilename:       defaultLeasesFilename,
+				MaxDevicesPerUser:    defaultMaxDevicesPerUser,
+				PoolExhaustionPolicy: defaultPoolExhaustionPolicy,
+				WireguardIPPrefix:    netip.MustParsePrefix("1.2.3.4/24"),
+				WireguardListenPort:  1234,
 				OauthServers: []oauthServerConfig{
 					{Server: "https://idp.example.com", ClientID: "client_id"},
 				},
@@ -361,6 +448,383 @@ func TestServerConfig(t *testing.T) {
 			true,
 			false,
 		},
+		{
+			// Static address reservations
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				],
+				"reservations": {
+					"oncall@example.com": "10.0.0.10",
+					"sre": "10.0.0.11"
+				}
+			}`),
+			&serverConfig{
+				Address:              "10.0.0.1/24",
+				AllowedIPs:           []string{"10.0.0.1/32"},
+				DeviceName:           "wg0",
+				Endpoint:             "1.2.3.4:1234",
+				KeyFilename:          defaultKeyFilename,
+				LeaserSyncInterval:   defaultLeaserSyncInterval,
+				LeaseStore:           defaultLeaseStore,
+				LeasesFilename:       defaultLeasesFilename,
+				MaxDevicesPerUser:    defaultMaxDevicesPerUser,
+				PoolExhaustionPolicy: defaultPoolExhaustionPolicy,
+				WireguardIPPrefix:    ipPrefix,
+				WireguardListenPort:  1234,
+				OauthServers: []oauthServerConfig{
+					{Server: "https://idp.example.com", ClientID: "client_id"},
+				},
+				Reservations: map[string]string{
+					"oncall@example.com": "10.0.0.10",
+					"sre":                "10.0.0.11",
+				},
+				ReservedAddresses: map[string]netip.Addr{
+					"oncall@example.com": netip.MustParseAddr("10.0.0.10"),
+					"sre":                netip.MustParseAddr("10.0.0.11"),
+				},
+				ServerListenAddress: "0.0.0.0:8080",
+			},
+			false,
+			false,
+		},
+		{
+			// Dual-stack
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"address6": "fd00:10::1/64",
+				"allowedIPs": ["192.168.1.0/24", "fd00:20::/48"],
+				"endpoint": "1.2.3.4:1234",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			&serverConfig{
+				Address:              "10.0.0.1/24",
+				Address6:             "fd00:10::1/64",
+				AllowedIPs:           []string{"192.168.1.0/24", "fd00:20::/48", "10.0.0.1/32", "fd00:10::1/128"},
+				DeviceName:           "wg0",
+				Endpoint:             "1.2.3.4:1234",
+				KeyFilename:          defaultKeyFilename,
+				LeaserSyncInterval:   defaultLeaserSyncInterval,
+				LeaseStore:           defaultLeaseStore,
+				LeasesFilename:       defaultLeasesFilename,
+				MaxDevicesPerUser:    defaultMaxDevicesPerUser,
+				PoolExhaustionPolicy: defaultPoolExhaustionPolicy,
+				WireguardIPPrefix:    ipPrefix,
+				WireguardIP6Prefix:   netip.MustParsePrefix("fd00:10::1/64"),
+				WireguardListenPort:  1234,
+				OauthServers: []oauthServerConfig{
+					{Server: "https://idp.example.com", ClientID: "client_id"},
+				},
+				ServerListenAddress: "0.0.0.0:8080",
+			},
+			false,
+			false,
+		},
+		{
+			// IPv4 range as address6 — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"address6": "10.1.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Unknown pool exhaustion policy — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"poolExhaustionPolicy": "evict",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Admin API without authentication — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"adminListenAddress": "127.0.0.1:8081",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Audit webhook without a scheme — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"auditWebhookURLs": ["audit.example.com/events"],
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// JWKS verification does not need a client ID
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"allowedIPs": ["192.168.1.0/24"],
+				"endpoint": "1.2.3.4:1234",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "verification": "jwks", "audiences": ["api://wiresteward"]}
+				]
+			}`),
+			&serverConfig{
+				Address:              "10.0.0.1/24",
+				AllowedIPs:           []string{"192.168.1.0/24", "10.0.0.1/32"},
+				DeviceName:           "wg0",
+				Endpoint:             "1.2.3.4:1234",
+				KeyFilename:          defaultKeyFilename,
+				LeaserSyncInterval:   defaultLeaserSyncInterval,
+				LeaseStore:           defaultLeaseStore,
+				LeasesFilename:       defaultLeasesFilename,
+				MaxDevicesPerUser:    defaultMaxDevicesPerUser,
+				PoolExhaustionPolicy: defaultPoolExhaustionPolicy,
+				WireguardIPPrefix:    ipPrefix,
+				WireguardListenPort:  1234,
+				OauthServers: []oauthServerConfig{
+					{Server: "https://idp.example.com", Verification: "jwks", Audiences: []string{"api://wiresteward"}},
+				},
+				ServerListenAddress: "0.0.0.0:8080",
+			},
+			false,
+			false,
+		},
+		{
+			// Authorization rules
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"allowedIPs": ["192.168.1.0/24"],
+				"endpoint": "1.2.3.4:1234",
+				"oauthServers": [
+					{
+						"server": "https://idp.example.com",
+						"clientID": "client_id",
+						"usernameClaim": "email",
+						"usernamePrefix": "corp/",
+						"emailDomains": ["example.com"],
+						"groups": ["engineering"],
+						"allowedUsers": ["alice@example.com"],
+						"deniedUsers": ["mallory@example.com"]
+					}
+				]
+			}`),
+			&serverConfig{
+				Address:              "10.0.0.1/24",
+				AllowedIPs:           []string{"192.168.1.0/24", "10.0.0.1/32"},
+				DeviceName:           "wg0",
+				Endpoint:             "1.2.3.4:1234",
+				KeyFilename:          defaultKeyFilename,
+				LeaserSyncInterval:   defaultLeaserSyncInterval,
+				LeaseStore:           defaultLeaseStore,
+				LeasesFilename:       defaultLeasesFilename,
+				MaxDevicesPerUser:    defaultMaxDevicesPerUser,
+				PoolExhaustionPolicy: defaultPoolExhaustionPolicy,
+				WireguardIPPrefix:    ipPrefix,
+				WireguardListenPort:  1234,
+				OauthServers: []oauthServerConfig{
+					{
+						Server:         "https://idp.example.com",
+						ClientID:       "client_id",
+						UsernameClaim:  "email",
+						UsernamePrefix: "corp/",
+						EmailDomains:   []string{"example.com"},
+						Groups:         []string{"engineering"},
+						AllowedUsers:   []string{"alice@example.com"},
+						DeniedUsers:    []string{"mallory@example.com"},
+					},
+				},
+				ServerListenAddress: "0.0.0.0:8080",
+			},
+			false,
+			false,
+		},
+		{
+			// Introspection cache bounds without a TTL — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"introspectionCacheNegativeTTL": "5s",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Negative TTL longer than the TTL — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"introspectionCacheTTL": "30s",
+				"introspectionCacheNegativeTTL": "1m",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// JWKS verification without audiences — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "verification": "jwks"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Unknown token verification method — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id", "verification": "userinfo"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Unknown username claim — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id", "usernameClaim": "upn"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Admin API on a public address without TLS — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"adminListenAddress": ":8082",
+				"adminGroups": ["admins"],
+				"oauthServers": [{"server": "https://idp.example.com", "clientID": "client_id"}]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Username prefix with whitespace — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id", "usernamePrefix": "corp /"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// TLS certificate without a key — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"tlsCertFile": "/etc/wiresteward/tls.crt",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Client CA without a server certificate — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"clientCAFile": "/etc/wiresteward/ca.crt",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Idle peer timeout shorter than the handshake interval — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"idlePeerTimeout": "1m",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Minimum lease duration above the maximum — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"maxLeaseDuration": "1h",
+				"minLeaseDuration": "2h",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
+		{
+			// Unknown lease store — should fail
+			[]byte(`{
+				"address": "10.0.0.1/24",
+				"endpoint": "1.2.3.4:1234",
+				"leaseStore": "etcd",
+				"oauthServers": [
+					{"server": "https://idp.example.com", "clientID": "client_id"}
+				]
+			}`),
+			nil,
+			false,
+			true,
+		},
 		{
 			[]byte(`{
 				"endpoint": ""
@@ -387,3 +851,48 @@ func TestServerConfig(t *testing.T) {
 		assert.Equal(t, tc.expected, cfg)
 	}
 }
+
+func TestIsLoopbackAddress(t *testing.T) {
+	for address, want := range map[string]bool{
+		"127.0.0.1:8082": true,
+		"[::1]:8082":     true,
+		"localhost:8082": true,
+		":8082":          false,
+		"0.0.0.0:8082":   false,
+		"10.0.0.1:8082":  false,
+		"127.0.0.1":      false,
+	} {
+		assert.Equal(t, want, isLoopbackAddress(address), address)
+	}
+}
+
+func TestVerifyReservations(t *testing.T) {
+	testCases := []struct {
+		name         string
+		reservations map[string]string
+		err          bool
+	}{
+		{"valid", map[string]string{"a": "10.0.0.2", "b": "10.0.0.254"}, false},
+		{"invalid address", map[string]string{"a": "10.0.0.x"}, true},
+		{"outside of pool", map[string]string{"a": "10.0.1.2"}, true},
+		{"server address", map[string]string{"a": "10.0.0.1"}, true},
+		{"network address", map[string]string{"a": "10.0.0.0"}, true},
+		{"broadcast address", map[string]string{"a": "10.0.0.255"}, true},
+		{"duplicate", map[string]string{"a": "10.0.0.2", "b": "10.0.0.2"}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := &serverConfig{
+				WireguardIPPrefix: netip.MustParsePrefix("10.0.0.1/24"),
+				Reservations:      tc.reservations,
+			}
+			err := verifyReservations(conf)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, len(tc.reservations), len(conf.ReservedAddresses))
+		})
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -206,14 +208,126 @@ func (wd *WireguardDevice) Stop() {
 
 // ServerDevice represents a wireguard network device on the system, setup
 // for use with kernel space wireguard. This is utilised by the server-side
-// wiresteward.
+// wiresteward. If persist is set, an existing device is adopted on start and
+// left in place on stop, so that tunnels survive restarts.
 type ServerDevice struct {
-	deviceAddress netlink.Addr
-	deviceMTU     int
-	iptablesRule  []string
-	keyFilename   string
-	link          netlink.Link
-	listenPort    int
+	deviceAddress  netlink.Addr
+	deviceAddress6 *netlink.Addr
+	deviceMTU      int
+	iptablesRules  []iptablesRule
+	keyFilename    string
+	link           netlink.Link
+	listenPort     int
+	persist        bool
+	// masqueradeSources holds the peer address range of each IP protocol,
+	// as listed by iptables, to identify stale masquerade rules.
+	masqueradeSources map[iptables.Protocol]string
+}
+
+// iptablesRule describes an iptables rule specification for the given IP
+// protocol.
+type iptablesRule struct {
+	proto iptables.Protocol
+	spec  []string
+}
+
+func (r iptablesRule) String() string {
+	return fmt.Sprintf("%s %v", iptablesCommand(r.proto), r.spec)
+}
+
+func iptablesCommand(proto iptables.Protocol) string {
+	if proto == iptables.ProtocolIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// masqueradeComment returns the comment that tags the masquerade rules of the
+// device, so that they can be told apart from other rules, and found again
+// after the peer address ranges change.
+func masqueradeComment(deviceName string) string {
+	return "wiresteward-" + deviceName
+}
+
+// masqueradeRules returns the rules that masquerade traffic from the peer
+// address ranges to the allowed networks of the matching IP family. There is
+// one rule per network, with addresses masked and options ordered the way
+// iptables lists them.
+func masqueradeRules(cfg *serverConfig) []iptablesRule {
+	rules := []iptablesRule{}
+	for _, cidr := range cfg.AllowedIPs {
+		dst, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			logger.Errorf("Skipping invalid allowed network %q: %v", cidr, err)
+			continue
+		}
+		src, proto := cfg.WireguardIPPrefix, iptables.ProtocolIPv4
+		if dst.Addr().Is6() {
+			src, proto = cfg.WireguardIP6Prefix, iptables.ProtocolIPv6
+		}
+		if !src.IsValid() {
+			continue
+		}
+		rules = append(rules, iptablesRule{
+			proto: proto,
+			spec: []string{
+				"-s", src.Masked().String(),
+				"-d", dst.Masked().String(),
+				"-m", "comment", "--comment", masqueradeComment(cfg.DeviceName),
+				"-j", "MASQUERADE",
+			},
+		})
+	}
+	return rules
+}
+
+// removeStaleMasqueradeRules deletes the masquerade rules tagged with comment
+// that are not in rules, which are left behind when a previous run did not
+// clean up, or used different allowed networks or peer address ranges. Rules
+// of releases that did not tag them are only recognised by the current peer
+// address range source.
+func removeStaleMasqueradeRules(ipt iptablesClient, proto iptables.Protocol, source, comment string, rules []iptablesRule) error {
+	current, err := ipt.List("nat", "POSTROUTING")
+	if err != nil {
+		return err
+	}
+	desired := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		desired[strings.Join(r.spec, " ")] = true
+	}
+	for _, line := range current {
+		spec, ok := strings.CutPrefix(line, "-A POSTROUTING ")
+		if !ok {
+			continue
+		}
+		// Comments are quoted in listings if they contain characters
+		// other than letters, digits, '-' and '_'.
+		fields := strings.Fields(spec)
+		for i, f := range fields {
+			fields[i] = strings.Trim(f, `"`)
+		}
+		if desired[strings.Join(fields, " ")] {
+			continue
+		}
+		if !isTaggedMasqueradeRule(fields, comment) && !isUntaggedMasqueradeRule(fields, source) {
+			continue
+		}
+		logger.Verbosef("Removing stale %s rule", iptablesRule{proto: proto, spec: fields})
+		if err := ipt.Delete("nat", "POSTROUTING", fields...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isTaggedMasqueradeRule(fields []string, comment string) bool {
+	i := slices.Index(fields, "--comment")
+	return i >= 0 && i+1 < len(fields) && fields[i+1] == comment &&
+		slices.Equal(fields[len(fields)-2:], []string{"-j", "MASQUERADE"})
+}
+
+func isUntaggedMasqueradeRule(fields []string, source string) bool {
+	return len(fields) == 6 && fields[0] == "-s" && fields[1] == source && fields[2] == "-d" && fields[4] == "-j" && fields[5] == "MASQUERADE"
 }
 
 func newServerDevice(cfg *serverConfig) *ServerDevice {
@@ -223,40 +337,128 @@ func newServerDevice(cfg *serverConfig) *ServerDevice {
 			TxQLen: 1000,
 		},
 	}
-	return &ServerDevice{
+	sd := &ServerDevice{
 		deviceAddress: netlink.Addr{
 			IPNet: netipx.PrefixIPNet(cfg.WireguardIPPrefix),
 		},
-		deviceMTU: cfg.DeviceMTU,
-		iptablesRule: []string{
-			"-s", cfg.WireguardIPPrefix.String(),
-			"-d", strings.Join(cfg.AllowedIPs, ","),
-			"-j", "MASQUERADE",
+		deviceMTU:     cfg.DeviceMTU,
+		iptablesRules: masqueradeRules(cfg),
+		keyFilename:   cfg.KeyFilename,
+		link:          link,
+		listenPort:    cfg.WireguardListenPort,
+		persist:       cfg.PersistDevice,
+		masqueradeSources: map[iptables.Protocol]string{
+			iptables.ProtocolIPv4: cfg.WireguardIPPrefix.Masked().String(),
 		},
-		keyFilename: cfg.KeyFilename,
-		link:        link,
-		listenPort:  cfg.WireguardListenPort,
 	}
+	if cfg.WireguardIP6Prefix.IsValid() {
+		sd.deviceAddress6 = &netlink.Addr{
+			IPNet: netipx.PrefixIPNet(cfg.WireguardIP6Prefix),
+		}
+		sd.masqueradeSources[iptables.ProtocolIPv6] = cfg.WireguardIP6Prefix.Masked().String()
+	}
+	return sd
 }
 
-// Start will create and setup the wireguard device.
-func (sd *ServerDevice) Start() error {
-	ipt, err := iptables.New()
-	if err != nil {
-		return err
+// addIPTablesRules adds the masquerade rules that are missing and removes
+// stale ones.
+func (sd *ServerDevice) addIPTablesRules() error {
+	for proto, source := range sd.masqueradeSources {
+		rules := []iptablesRule{}
+		for _, r := range sd.iptablesRules {
+			if r.proto == proto {
+				rules = append(rules, r)
+			}
+		}
+		ipt, err := iptables.New(iptables.IPFamily(proto))
+		if err != nil {
+			return err
+		}
+		if err := removeStaleMasqueradeRules(ipt, proto, source, masqueradeComment(sd.link.Attrs().Name), rules); err != nil {
+			return err
+		}
+		for _, r := range rules {
+			logger.Verbosef("Adding %s rule", r)
+			if err := ipt.AppendUnique("nat", "POSTROUTING", r.spec...); err != nil {
+				return err
+			}
+		}
 	}
-	logger.Verbosef("Adding iptables rule %v", sd.iptablesRule)
-	if err := ipt.AppendUnique("nat", "POSTROUTING", sd.iptablesRule...); err != nil {
-		return err
+	return nil
+}
+
+// updateMasqueradeRules replaces the masquerade rules with the ones of the
+// given configuration, removing the rules of networks no longer allowed.
+func (sd *ServerDevice) updateMasqueradeRules(cfg *serverConfig) error {
+	sd.iptablesRules = masqueradeRules(cfg)
+	return sd.addIPTablesRules()
+}
+
+// createOrAdoptLink creates the wireguard link, or when persisting the device
+// reuses an existing one. It returns whether an existing link was adopted.
+func (sd *ServerDevice) createOrAdoptLink(h netlink.Handle) (bool, error) {
+	if sd.persist {
+		link, err := h.LinkByName(sd.link.Attrs().Name)
+		if err == nil {
+			if link.Type() != sd.link.Type() {
+				return false, fmt.Errorf(
+					"cannot adopt device %s of type %s, expected %s",
+					link.Attrs().Name,
+					link.Type(),
+					sd.link.Type(),
+				)
+			}
+			logger.Verbosef("Adopting existing device %s", link.Attrs().Name)
+			sd.link = link
+			return true, nil
+		}
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return false, err
+		}
 	}
-	h := netlink.Handle{}
-	defer h.Delete()
 	logger.Verbosef(
 		"Creating device %s with address %s",
 		sd.link.Attrs().Name,
 		sd.deviceAddress,
 	)
-	if err := h.LinkAdd(sd.link); err != nil {
+	return false, h.LinkAdd(sd.link)
+}
+
+// removeStaleAddresses deletes addresses of an adopted device that are no
+// longer configured. IPv6 link-local addresses are managed by the kernel and
+// kept.
+func (sd *ServerDevice) removeStaleAddresses(h netlink.Handle) error {
+	addrs, err := h.AddrList(sd.link, unix.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if a.IP.IsLinkLocalUnicast() || a.Equal(sd.deviceAddress) {
+			continue
+		}
+		if sd.deviceAddress6 != nil && a.Equal(*sd.deviceAddress6) {
+			continue
+		}
+		logger.Verbosef("Removing stale address %s from device %s", a.IPNet, sd.link.Attrs().Name)
+		if err := h.AddrDel(sd.link, &a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start will create and setup the wireguard device. When persisting the
+// device, an existing device is reconciled with the configuration instead, and
+// its peers are kept until the lease manager updates them.
+func (sd *ServerDevice) Start() error {
+	if err := sd.addIPTablesRules(); err != nil {
+		return err
+	}
+	h := netlink.Handle{}
+	defer h.Delete()
+	adopted, err := sd.createOrAdoptLink(h)
+	if err != nil {
 		return err
 	}
 	if err := sd.ensureLinkIsUp(h); err != nil {
@@ -265,9 +467,25 @@ func (sd *ServerDevice) Start() error {
 	if err := sd.configureWireguard(); err != nil {
 		return err
 	}
-	if err := h.AddrAdd(sd.link, &sd.deviceAddress); err != nil {
+	if adopted {
+		if err := sd.removeStaleAddresses(h); err != nil {
+			return err
+		}
+	}
+	// Adopted devices may already have the addresses.
+	if err := h.AddrAdd(sd.link, &sd.deviceAddress); err != nil && !errors.Is(err, unix.EEXIST) {
 		return err
 	}
+	if sd.deviceAddress6 != nil {
+		logger.Verbosef(
+			"Adding address %s to device %s",
+			sd.deviceAddress6,
+			sd.link.Attrs().Name,
+		)
+		if err := h.AddrAdd(sd.link, sd.deviceAddress6); err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+	}
 	mtu := sd.deviceMTU
 	if mtu <= 0 {
 		defaultMTU, err := sd.defaultMTU(h)
@@ -289,8 +507,13 @@ func (sd *ServerDevice) Start() error {
 	return nil
 }
 
-// Stop will cleanup and delete the wireguard device.
+// Stop will cleanup and delete the wireguard device, unless the device is
+// persisted, in which case it is left in place with its peers and rules.
 func (sd *ServerDevice) Stop() error {
+	if sd.persist {
+		logger.Verbosef("Leaving device %s in place", sd.link.Attrs().Name)
+		return nil
+	}
 	h := netlink.Handle{}
 	defer h.Delete()
 	if err := h.LinkSetDown(sd.link); err != nil {
@@ -299,13 +522,15 @@ func (sd *ServerDevice) Stop() error {
 	if err := h.LinkDel(sd.link); err != nil {
 		return err
 	}
-	ipt, err := iptables.New()
-	if err != nil {
-		return err
-	}
-	logger.Verbosef("Removing iptables rule %v", sd.iptablesRule)
-	if err := ipt.Delete("nat", "POSTROUTING", sd.iptablesRule...); err != nil {
-		return err
+	for _, r := range sd.iptablesRules {
+		ipt, err := iptables.New(iptables.IPFamily(r.proto))
+		if err != nil {
+			return err
+		}
+		logger.Verbosef("Removing %s rule", r)
+		if err := ipt.Delete("nat", "POSTROUTING", r.spec...); err != nil {
+			return err
+		}
 	}
 	logger.Verbosef("Cleaned up device %s", sd.link.Attrs().Name)
 	return nil
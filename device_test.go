@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMasqueradeRules(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	rules := masqueradeRules(&serverConfig{
+		AllowedIPs:         []string{"10.1.2.3/16", "10.0.0.1/32", "fd00:1::/64"},
+		DeviceName:         "wg0",
+		WireguardIPPrefix:  netip.MustParsePrefix("10.0.0.1/24"),
+		WireguardIP6Prefix: netip.MustParsePrefix("fd00:10::1/64"),
+	})
+	assert.Equal(t, []iptablesRule{
+		{proto: iptables.ProtocolIPv4, spec: []string{"-s", "10.0.0.0/24", "-d", "10.1.0.0/16", "-m", "comment", "--comment", "wiresteward-wg0", "-j", "MASQUERADE"}},
+		{proto: iptables.ProtocolIPv4, spec: []string{"-s", "10.0.0.0/24", "-d", "10.0.0.1/32", "-m", "comment", "--comment", "wiresteward-wg0", "-j", "MASQUERADE"}},
+		{proto: iptables.ProtocolIPv6, spec: []string{"-s", "fd00:10::/64", "-d", "fd00:1::/64", "-m", "comment", "--comment", "wiresteward-wg0", "-j", "MASQUERADE"}},
+	}, rules)
+
+	// IPv6 networks are skipped without an IPv6 address range.
+	rules = masqueradeRules(&serverConfig{
+		AllowedIPs:        []string{"10.1.0.0/16", "fd00:1::/64"},
+		WireguardIPPrefix: netip.MustParsePrefix("10.0.0.1/24"),
+	})
+	assert.Equal(t, 1, len(rules))
+}
+
+func TestRemoveStaleMasqueradeRules(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ipt := newFakeIPTables()
+	ipt.chains["nat/POSTROUTING"] = []string{
+		"-s 10.0.0.0/24 -d 10.1.0.0/16 -m comment --comment wiresteward-wg0 -j MASQUERADE",
+		"-s 10.0.0.0/24 -d 10.2.0.0/16 -m comment --comment wiresteward-wg0 -j MASQUERADE",
+		// A previous peer address range.
+		"-s 10.9.0.0/24 -d 10.1.0.0/16 -m comment --comment wiresteward-wg0 -j MASQUERADE",
+		// Written by a release that did not tag rules.
+		"-s 10.0.0.0/24 -d 10.3.0.0/16 -j MASQUERADE",
+		// Rules of other devices and other software.
+		"-s 10.8.0.0/24 -d 10.1.0.0/16 -m comment --comment wiresteward-wg1 -j MASQUERADE",
+		"-s 192.168.0.0/24 -d 10.2.0.0/16 -j MASQUERADE",
+		"-o eth0 -j MASQUERADE",
+	}
+	rules := []iptablesRule{
+		{proto: iptables.ProtocolIPv4, spec: []string{"-s", "10.0.0.0/24", "-d", "10.1.0.0/16", "-m", "comment", "--comment", "wiresteward-wg0", "-j", "MASQUERADE"}},
+	}
+	assert.NoError(t, removeStaleMasqueradeRules(ipt, iptables.ProtocolIPv4, "10.0.0.0/24", "wiresteward-wg0", rules))
+	// Only the rules of the device that are no longer wanted are removed.
+	assert.Equal(t, []string{
+		"-s 10.0.0.0/24 -d 10.1.0.0/16 -m comment --comment wiresteward-wg0 -j MASQUERADE",
+		"-s 10.8.0.0/24 -d 10.1.0.0/16 -m comment --comment wiresteward-wg1 -j MASQUERADE",
+		"-s 192.168.0.0/24 -d 10.2.0.0/16 -j MASQUERADE",
+		"-o eth0 -j MASQUERADE",
+	}, ipt.chains["nat/POSTROUTING"])
+
+	// Quoted comments are recognised too.
+	ipt.chains["nat/POSTROUTING"] = []string{
+		`-s 10.0.0.0/24 -d 10.1.0.0/16 -m comment --comment "wiresteward-wg.0" -j MASQUERADE`,
+		`-s 10.0.0.0/24 -d 10.2.0.0/16 -m comment --comment "wiresteward-wg.0" -j MASQUERADE`,
+	}
+	rules[0].spec[7] = "wiresteward-wg.0"
+	assert.NoError(t, removeStaleMasqueradeRules(ipt, iptables.ProtocolIPv4, "10.0.0.0/24", "wiresteward-wg.0", rules))
+	assert.Equal(t, []string{
+		`-s 10.0.0.0/24 -d 10.1.0.0/16 -m comment --comment "wiresteward-wg.0" -j MASQUERADE`,
+	}, ipt.chains["nat/POSTROUTING"])
+}
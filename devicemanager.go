@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -27,6 +28,8 @@ type DeviceManager struct {
 	config               *WirestewardPeerConfig // To keep the current config
 	currentServerURL     string                 // URL of the server that last successfully provided a lease
 	serverURLs           []string
+	peers                map[string]agentPeerConfig // keyed by URL
+	identity             agentIdentity
 	backoff              *backoff // backoff timer for retries to get a new lease
 	hcMutex              sync.RWMutex
 	healthCheck          *healthCheck // Pointer to the device manager running healthchek
@@ -36,18 +39,36 @@ type DeviceManager struct {
 	stopLeaseBackoff     chan struct{}
 	inBackoffLoop        atomic.Bool // signals if there is a backoff loop in progress
 	httpClientTimeout    Duration
+	renewTimerMutex      sync.Mutex
+	renewTimer           *time.Timer // triggers a renewal before the current lease expires
 }
 
-func newDeviceManager(deviceName string, mtu int, wirestewardURLs []string, httpClientTimeout Duration, hcc agentHealthCheckConfig) *DeviceManager {
+const (
+	// leaseRenewalFraction is the fraction of the remaining lease duration
+	// after which the agent renews a lease that carries an expiry.
+	leaseRenewalFraction = 0.8
+	// minLeaseRenewalInterval bounds how often a short lease is renewed.
+	minLeaseRenewalInterval = 10 * time.Second
+)
+
+func newDeviceManager(deviceName string, mtu int, peers []agentPeerConfig, identity agentIdentity, httpClientTimeout Duration, hcc agentHealthCheckConfig) *DeviceManager {
 	var device agentDevice
 	if *flagDeviceType == "wireguard" {
 		device = newWireguardDevice(deviceName, mtu)
 	} else {
 		device = newTunDevice(deviceName, mtu)
 	}
+	urls := []string{}
+	peersByURL := make(map[string]agentPeerConfig, len(peers))
+	for _, p := range peers {
+		urls = append(urls, p.URL)
+		peersByURL[p.URL] = p
+	}
 	return &DeviceManager{
 		agentDevice:          device,
-		serverURLs:           wirestewardURLs,
+		serverURLs:           urls,
+		peers:                peersByURL,
+		identity:             identity,
 		backoff:              newBackoff(1*time.Second, 64*time.Second, 2),
 		healthCheck:          &healthCheck{},
 		healthCheckConf:      hcc,
@@ -173,6 +194,39 @@ func (dm *DeviceManager) triggerLeaseRenewal() {
 	}
 }
 
+// leaseRenewalInterval returns how long to wait before renewing a lease that
+// expires at expires.
+func leaseRenewalInterval(now, expires time.Time) time.Duration {
+	d := time.Duration(float64(expires.Sub(now)) * leaseRenewalFraction)
+	if d < minLeaseRenewalInterval {
+		return minLeaseRenewalInterval
+	}
+	return d
+}
+
+// scheduleLeaseRenewal replaces any pending scheduled renewal with one that
+// fires before the lease expires. Leases from servers that do not report an
+// expiry are only renewed when the token is refreshed.
+func (dm *DeviceManager) scheduleLeaseRenewal(expires time.Time) {
+	dm.renewTimerMutex.Lock()
+	defer dm.renewTimerMutex.Unlock()
+	if dm.renewTimer != nil {
+		dm.renewTimer.Stop()
+		dm.renewTimer = nil
+	}
+	if expires.IsZero() {
+		return
+	}
+	d := leaseRenewalInterval(time.Now(), expires)
+	logger.Verbosef("Lease for device %s expires at %s, renewing in %s", dm.Name(), expires, d)
+	dm.renewTimer = time.AfterFunc(d, func() {
+		select {
+		case dm.renewLeaseChan <- struct{}{}:
+		default:
+		}
+	})
+}
+
 // renewLease uses the provided oauth2 token to retrieve a new leases from one
 // of the healthy wiresteward servers associated with the underlying device. If
 // healthchecks are disabled then all serveres would be considered healthy. The
@@ -195,13 +249,19 @@ func (dm *DeviceManager) renewLease() error {
 	if serverURL == "" {
 		return fmt.Errorf("No healthy servers found for device: %s", dm.Name())
 	}
-	config, wgServerAddr, err := requestWirestewardPeerConfig(serverURL, token, publicKey, dm.httpClientTimeout)
+	tlsConfig, err := dm.peers[serverURL].tlsConfig()
+	if err != nil {
+		dm.currentServerURL = ""
+		return fmt.Errorf("Cannot configure TLS for %s: %w", serverURL, err)
+	}
+	config, wgServerAddr, err := requestWirestewardPeerConfig(serverURL, tlsConfig, token, publicKey, dm.identity, dm.httpClientTimeout)
 	if err != nil {
 		// Clear current server so the next retry picks a random one.
 		dm.currentServerURL = ""
 		return fmt.Errorf("requestWirestewardPeerConfig: %w", err)
 	}
 	dm.currentServerURL = serverURL
+	dm.scheduleLeaseRenewal(config.Expires)
 
 	dm.configMutex.RLock()
 	oldConfig := dm.config
@@ -231,6 +291,16 @@ func (dm *DeviceManager) renewLease() error {
 		if err := setPeers(dm.Name(), []wgtypes.PeerConfig{*config.PeerConfig}); err != nil {
 			return fmt.Errorf("Error setting new peers for device %s: %w", dm.Name(), err)
 		}
+	} else if !presharedKeysEqual(oldConfig, config) {
+		// Only the peer needs updating when the server rotates the
+		// preshared key on renewal.
+		logger.Verbosef("Received a new preshared key from `%s`, updating peer", serverURL)
+		dm.configMutex.Lock()
+		dm.config = config
+		dm.configMutex.Unlock()
+		if err := setPeers(dm.Name(), []wgtypes.PeerConfig{*config.PeerConfig}); err != nil {
+			return fmt.Errorf("Error setting new peers for device %s: %w", dm.Name(), err)
+		}
 	} else {
 		logger.Verbosef(
 			"Received unchanged config from `%s`, skipping device update",
@@ -265,8 +335,8 @@ func (dm *DeviceManager) renewLease() error {
 }
 
 // wirestewardPeerConfigsEqual returns true if both configs represent the same
-// network configuration (local address, peer public key, endpoint, and allowed
-// IPs). A nil config is only equal to another nil config.
+// network configuration (local addresses, peer public key, endpoint, and
+// allowed IPs). A nil config is only equal to another nil config.
 func wirestewardPeerConfigsEqual(a, b *WirestewardPeerConfig) bool {
 	if a == nil || b == nil {
 		return a == b
@@ -274,6 +344,9 @@ func wirestewardPeerConfigsEqual(a, b *WirestewardPeerConfig) bool {
 	if a.LocalAddress.String() != b.LocalAddress.String() {
 		return false
 	}
+	if a.LocalAddress6.String() != b.LocalAddress6.String() {
+		return false
+	}
 	if a.PublicKey != b.PublicKey {
 		return false
 	}
@@ -298,11 +371,28 @@ func wirestewardPeerConfigsEqual(a, b *WirestewardPeerConfig) bool {
 	return true
 }
 
+// presharedKeysEqual returns true if both configs carry the same preshared
+// key, where a missing key is equal to the all-zero key that disables it.
+func presharedKeysEqual(a, b *WirestewardPeerConfig) bool {
+	keyA, keyB := wgtypes.Key{}, wgtypes.Key{}
+	if a != nil && a.PresharedKey != nil {
+		keyA = *a.PresharedKey
+	}
+	if b != nil && b.PresharedKey != nil {
+		keyB = *b.PresharedKey
+	}
+	return keyA == keyB
+}
+
 // WirestewardPeerConfig embeds wgtypes.PeerConfig and additional configuration
-// received from a wiresteward server.
+// received from a wiresteward server. LocalAddress6 is nil unless the server
+// leases IPv6 addresses, and Expires is zero unless the server reports the
+// lease expiry.
 type WirestewardPeerConfig struct {
 	*wgtypes.PeerConfig
-	LocalAddress *net.IPNet
+	LocalAddress  *net.IPNet
+	LocalAddress6 *net.IPNet
+	Expires       time.Time
 }
 
 func newWirestewardPeerConfigFromLeaseResponse(lr *leaseResponse) (*WirestewardPeerConfig, string, error) {
@@ -311,19 +401,33 @@ func newWirestewardPeerConfigFromLeaseResponse(lr *leaseResponse) (*WirestewardP
 		return nil, "", err
 	}
 	address := &net.IPNet{IP: ip, Mask: mask.Mask}
-	pc, err := newPeerConfig(lr.PubKey, "", lr.Endpoint, lr.AllowedIPs)
+	var address6 *net.IPNet
+	if lr.IP6 != "" {
+		ip6, mask6, err := net.ParseCIDR(lr.IP6)
+		if err != nil {
+			return nil, "", err
+		}
+		address6 = &net.IPNet{IP: ip6, Mask: mask6.Mask}
+	}
+	pc, err := newPeerConfig(lr.PubKey, lr.PresharedKey, lr.Endpoint, lr.AllowedIPs)
 	if err != nil {
 		return nil, "", err
 	}
 	return &WirestewardPeerConfig{
-		PeerConfig:   pc,
-		LocalAddress: address,
+		PeerConfig:    pc,
+		LocalAddress:  address,
+		LocalAddress6: address6,
+		Expires:       lr.Expires,
 	}, lr.ServerWireguardIP, nil
 }
 
-func requestWirestewardPeerConfig(serverURL, token, publicKey string, timeout Duration) (*WirestewardPeerConfig, string, error) {
+func requestWirestewardPeerConfig(serverURL string, tlsConfig *tls.Config, token, publicKey string, identity agentIdentity, timeout Duration) (*WirestewardPeerConfig, string, error) {
 	// Marshal key into json
-	r, err := json.Marshal(&leaseRequest{PubKey: publicKey})
+	r, err := json.Marshal(&leaseRequest{
+		PubKey:   publicKey,
+		DeviceID: identity.DeviceID,
+		Hostname: identity.Hostname,
+	})
 	if err != nil {
 		return nil, "", fmt.Errorf("requestWirestewardPeerConfig(%s): marshal request: %w", serverURL, err)
 	}
@@ -338,12 +442,23 @@ func requestWirestewardPeerConfig(serverURL, token, publicKey string, timeout Du
 	req.Header.Set("Authorization", "Bearer "+token)
 
 	client := &http.Client{Timeout: timeout.Duration}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		// The client is only used for this request.
+		transport.DisableKeepAlives = true
+		client.Transport = transport
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, "", fmt.Errorf("requestWirestewardPeerConfig(%s): do request: %w", serverURL, err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
+		er := &errorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(er); err == nil && er.Message != "" {
+			return nil, "", fmt.Errorf("requestWirestewardPeerConfig(%s): response status: %s: %s", serverURL, resp.Status, er.Message)
+		}
 		return nil, "", fmt.Errorf("requestWirestewardPeerConfig(%s): response status: %s", serverURL, resp.Status)
 	}
 
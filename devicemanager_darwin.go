@@ -28,6 +28,16 @@ func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerCo
 				"Could not close AF_INET socket: %v", err)
 		}
 	}()
+	fdInet6, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, unix.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := unix.Close(fdInet6); err != nil {
+			logger.Errorf(
+				"Could not close AF_INET6 socket: %v", err)
+		}
+	}()
 	fdRoute, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
 	if err != nil {
 		return err
@@ -45,7 +55,11 @@ func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerCo
 		// linux implementation and because it will be needed if we should to
 		// routes via interfaces.
 		for _, r := range oldConfig.AllowedIPs {
-			if err := delRoute(fdRoute, oldConfig.LocalAddress.IP, r.IP, r.Mask); err != nil {
+			gw := routeGateway(oldConfig, r)
+			if gw == nil {
+				continue
+			}
+			if err := delRoute(fdRoute, gw, r.IP, r.Mask); err != nil {
 				logger.Errorf(
 					"Could not remove old route (%s): %s",
 					r,
@@ -60,12 +74,31 @@ func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerCo
 				err,
 			)
 		}
+		if oldConfig.LocalAddress6 != nil {
+			if err := deleteAddress6(fdInet6, dm.Name(), oldConfig.LocalAddress6.IP); err != nil {
+				logger.Errorf(
+					"Could not remove old address: (%s): %s",
+					oldConfig.LocalAddress6,
+					err,
+				)
+			}
+		}
 	}
 	if err := addAddress(fdInet, dm.Name(), config.LocalAddress.IP, config.LocalAddress.IP, config.LocalAddress.Mask); err != nil {
 		return err
 	}
+	if config.LocalAddress6 != nil {
+		if err := addAddress6(fdInet6, dm.Name(), config.LocalAddress6.IP, config.LocalAddress6.Mask); err != nil {
+			return err
+		}
+	}
 	for _, r := range config.AllowedIPs {
-		if err := addRoute(fdRoute, config.LocalAddress.IP, r.IP, r.Mask); err != nil {
+		gw := routeGateway(config, r)
+		if gw == nil {
+			logger.Errorf("Skipping route (%s): no local IPv6 address", r)
+			continue
+		}
+		if err := addRoute(fdRoute, gw, r.IP, r.Mask); err != nil {
 			logger.Errorf(
 				"Could not add new route (%s): %s", r, err)
 		}
@@ -73,6 +106,18 @@ func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerCo
 	return nil
 }
 
+// routeGateway returns the local address of the same family as the given
+// destination, or nil if the config has no such address.
+func routeGateway(config *WirestewardPeerConfig, dst net.IPNet) net.IP {
+	if dst.IP.To4() != nil {
+		return config.LocalAddress.IP
+	}
+	if config.LocalAddress6 == nil {
+		return nil
+	}
+	return config.LocalAddress6.IP
+}
+
 // This is a no-op for darwin, the device seems to be ready on creation.
 func (dm *DeviceManager) ensureLinkUp() error {
 	return nil
@@ -170,6 +215,83 @@ func deleteAddress(fd int, name string, addr net.IP) error {
 	return nil
 }
 
+// https://opensource.apple.com/source/xnu/xnu-6153.81.5/bsd/netinet6/in6_var.h.auto.html
+const (
+	siocAIFAddrIn6 = 0x8080691a // _IOW('i', 26, struct in6_aliasreq)
+	siocDIFAddrIn6 = 0x81206919 // _IOW('i', 25, struct in6_ifreq)
+	// nd6InfiniteLifetime marks an address that never expires.
+	nd6InfiniteLifetime = 0xffffffff
+)
+
+func unixRawSockaddrInet6FromNetIP(ip []byte) unix.RawSockaddrInet6 {
+	sa := unix.RawSockaddrInet6{
+		Len:    unix.SizeofSockaddrInet6,
+		Family: unix.AF_INET6,
+	}
+	copy(sa.Addr[:], ip)
+	return sa
+}
+
+type in6AddrLifetime struct {
+	Expire    int64
+	Preferred int64
+	Vltime    uint32
+	Pltime    uint32
+}
+
+// in6AliasReq mirrors struct in6_aliasreq.
+type in6AliasReq struct {
+	Name       [unix.IFNAMSIZ]byte
+	Addr       unix.RawSockaddrInet6
+	DstAddr    unix.RawSockaddrInet6
+	PrefixMask unix.RawSockaddrInet6
+	Flags      int32
+	Lifetime   in6AddrLifetime
+}
+
+// in6IfReq mirrors struct in6_ifreq, whose union is padded to the size of its
+// largest member.
+type in6IfReq struct {
+	Name [unix.IFNAMSIZ]byte
+	Addr unix.RawSockaddrInet6
+	_    [244]byte
+}
+
+func addAddress6(fd int, name string, addr net.IP, mask net.IPMask) error {
+	ifar := in6AliasReq{
+		Addr:       unixRawSockaddrInet6FromNetIP(addr.To16()),
+		PrefixMask: unixRawSockaddrInet6FromNetIP(mask),
+		Lifetime: in6AddrLifetime{
+			Vltime: nd6InfiniteLifetime,
+			Pltime: nd6InfiniteLifetime,
+		},
+	}
+	copy(ifar.Name[:], name)
+	if _, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(siocAIFAddrIn6),
+		uintptr(unsafe.Pointer(&ifar)),
+	); errno != 0 {
+		return fmt.Errorf("SIOCAIFADDR_IN6 on %s: %w (%v)", name, errno, unix.ErrnoName(errno))
+	}
+	return nil
+}
+
+func deleteAddress6(fd int, name string, addr net.IP) error {
+	ifr := in6IfReq{Addr: unixRawSockaddrInet6FromNetIP(addr.To16())}
+	copy(ifr.Name[:], name)
+	if _, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(siocDIFAddrIn6),
+		uintptr(unsafe.Pointer(&ifr)),
+	); errno != 0 {
+		return fmt.Errorf("SIOCDIFADDR_IN6 on %s: %w (%v)", name, errno, unix.ErrnoName(errno))
+	}
+	return nil
+}
+
 func flushAddresses(fd int, name string) error {
 	for {
 		ip, err := getAddress(fd, name)
@@ -187,6 +309,13 @@ func flushAddresses(fd int, name string) error {
 }
 
 func newRoute(gateway, dst net.IP, mask net.IPMask) []route.Addr {
+	if dst.To4() == nil {
+		return []route.Addr{
+			syscall.RTAX_DST:     &route.Inet6Addr{IP: unixRawSockaddrInet6FromNetIP(dst).Addr},
+			syscall.RTAX_GATEWAY: &route.Inet6Addr{IP: unixRawSockaddrInet6FromNetIP(gateway).Addr},
+			syscall.RTAX_NETMASK: &route.Inet6Addr{IP: unixRawSockaddrInet6FromNetIP(mask).Addr},
+		}
+	}
 	return []route.Addr{
 		syscall.RTAX_DST:     &route.Inet4Addr{IP: unixRawSockaddrInet4FromNetIP(dst).Addr},
 		syscall.RTAX_GATEWAY: &route.Inet4Addr{IP: unixRawSockaddrInet4FromNetIP(gateway).Addr},
@@ -37,12 +37,34 @@ func (dm *DeviceManager) updateDeviceConfig(oldConfig, config *WirestewardPeerCo
 				err,
 			)
 		}
+		if oldConfig.LocalAddress6 != nil {
+			if err := h.AddrDel(link, &netlink.Addr{IPNet: oldConfig.LocalAddress6}); err != nil {
+				logger.Errorf(
+					"Could not remove old address (%s): %s",
+					oldConfig.LocalAddress6,
+					err,
+				)
+			}
+		}
 	}
 	if err := h.AddrAdd(link, &netlink.Addr{IPNet: config.LocalAddress}); err != nil {
 		return err
 	}
+	if config.LocalAddress6 != nil {
+		if err := h.AddrAdd(link, &netlink.Addr{IPNet: config.LocalAddress6}); err != nil {
+			return err
+		}
+	}
 	for _, r := range config.AllowedIPs {
-		if err := h.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &r, Gw: config.LocalAddress.IP}); err != nil {
+		gw := config.LocalAddress.IP
+		if r.IP.To4() == nil {
+			if config.LocalAddress6 == nil {
+				logger.Errorf("Skipping route (%s): no local IPv6 address", r)
+				continue
+			}
+			gw = config.LocalAddress6.IP
+		}
+		if err := h.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &r, Gw: gw}); err != nil {
 			logger.Errorf(
 				"Could not add new route (%s): %s", r, err)
 		}
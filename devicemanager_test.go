@@ -4,6 +4,7 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -130,3 +131,33 @@ func TestDeviceManager_inBackoffLoopConcurrent(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+func TestNewWirestewardPeerConfigFromLeaseResponse_presharedKey(t *testing.T) {
+	lr := &leaseResponse{
+		IP:         "10.90.0.2/32",
+		AllowedIPs: []string{"10.90.0.1/32"},
+		PubKey:     "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=",
+	}
+	withoutKey, _, err := newWirestewardPeerConfigFromLeaseResponse(lr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr.PresharedKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	withKey, _, err := newWirestewardPeerConfigFromLeaseResponse(lr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, lr.PresharedKey, withKey.PresharedKey.String())
+	// A rotated key only changes the peer, not the device configuration.
+	assert.True(t, wirestewardPeerConfigsEqual(withoutKey, withKey))
+	assert.False(t, presharedKeysEqual(withoutKey, withKey))
+	assert.True(t, presharedKeysEqual(withKey, withKey))
+	assert.True(t, presharedKeysEqual(nil, withoutKey))
+}
+
+func TestLeaseRenewalInterval(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 48*time.Minute, leaseRenewalInterval(now, now.Add(time.Hour)))
+	assert.Equal(t, minLeaseRenewalInterval, leaseRenewalInterval(now, now.Add(time.Second)))
+	assert.Equal(t, minLeaseRenewalInterval, leaseRenewalInterval(now, now.Add(-time.Hour)))
+}
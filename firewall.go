@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const peerFirewallChain = "WIRESTEWARD-FORWARD"
+
+// iptablesClient is the subset of the go-iptables API used to manage the peer
+// firewall, so that it can be faked in tests.
+type iptablesClient interface {
+	ChainExists(table, chain string) (bool, error)
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	List(table, chain string) ([]string, error)
+}
+
+// peerFirewall maintains a filter chain that limits the traffic each peer may
+// forward to the networks it was granted. Traffic entering from the
+// WireGuard device is sent to the chain, which accepts it if it matches a
+// rule for the source peer address and drops it otherwise. If persist is set,
+// the chain is adopted on setup and left in place on teardown, along with the
+// WireGuard device.
+type peerFirewall struct {
+	device     string
+	allowedIPs []string // granted to leases without policy networks
+	clients    map[iptables.Protocol]iptablesClient
+	persist    bool
+	rules      map[string]iptablesRule // installed peer rules, keyed by String()
+	mutex      sync.Mutex
+}
+
+func newPeerFirewall(cfg *serverConfig) (*peerFirewall, error) {
+	pf := &peerFirewall{
+		device:     cfg.DeviceName,
+		allowedIPs: cfg.AllowedIPs,
+		clients:    make(map[iptables.Protocol]iptablesClient),
+		persist:    cfg.PersistDevice,
+		rules:      make(map[string]iptablesRule),
+	}
+	protos := []iptables.Protocol{iptables.ProtocolIPv4}
+	if cfg.WireguardIP6Prefix.IsValid() {
+		protos = append(protos, iptables.ProtocolIPv6)
+	}
+	for _, proto := range protos {
+		ipt, err := iptables.New(iptables.IPFamily(proto))
+		if err != nil {
+			return nil, err
+		}
+		pf.clients[proto] = ipt
+	}
+	return pf, nil
+}
+
+func (pf *peerFirewall) jumpRule() []string {
+	return []string{"-i", pf.device, "-j", peerFirewallChain}
+}
+
+// setup creates or flushes the peer chain, so that it only drops traffic
+// until reconcile is called, and sends forwarded peer traffic to it. When
+// persisting, an existing chain is kept and its rules are adopted instead, so
+// that traffic is not interrupted until reconcile is called.
+func (pf *peerFirewall) setup() error {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	pf.rules = make(map[string]iptablesRule)
+	for proto, ipt := range pf.clients {
+		adopt := false
+		if pf.persist {
+			var err error
+			if adopt, err = ipt.ChainExists("filter", peerFirewallChain); err != nil {
+				return err
+			}
+		}
+		if adopt {
+			logger.Verbosef("Adopting %s chain %s", iptablesCommand(proto), peerFirewallChain)
+			if err := pf.adoptRules(proto, ipt); err != nil {
+				return err
+			}
+		} else {
+			logger.Verbosef("Setting up %s chain %s", iptablesCommand(proto), peerFirewallChain)
+			if err := ipt.ClearChain("filter", peerFirewallChain); err != nil {
+				return err
+			}
+			if err := ipt.Append("filter", peerFirewallChain, "-j", "DROP"); err != nil {
+				return err
+			}
+		}
+		exists, err := ipt.Exists("filter", "FORWARD", pf.jumpRule()...)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := ipt.Insert("filter", "FORWARD", 1, pf.jumpRule()...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adoptRules records the peer rules of an existing chain as installed, so that
+// reconcile only changes the rules that differ, and makes sure the chain ends
+// with the DROP rule. The caller must hold mutex.
+func (pf *peerFirewall) adoptRules(proto iptables.Protocol, ipt iptablesClient) error {
+	lines, err := ipt.List("filter", peerFirewallChain)
+	if err != nil {
+		return err
+	}
+	hasDrop := false
+	for _, line := range lines {
+		spec, ok := strings.CutPrefix(line, "-A "+peerFirewallChain+" ")
+		if !ok {
+			continue
+		}
+		if spec == "-j DROP" {
+			hasDrop = true
+			continue
+		}
+		rule := iptablesRule{proto: proto, spec: strings.Fields(spec)}
+		pf.rules[rule.String()] = rule
+	}
+	if !hasDrop {
+		return ipt.Append("filter", peerFirewallChain, "-j", "DROP")
+	}
+	return nil
+}
+
+// teardown removes the jump to the peer chain and the chain itself, unless
+// persisting.
+func (pf *peerFirewall) teardown() error {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	if pf.persist {
+		logger.Verbosef("Leaving chain %s in place", peerFirewallChain)
+		return nil
+	}
+	for proto, ipt := range pf.clients {
+		logger.Verbosef("Removing %s chain %s", iptablesCommand(proto), peerFirewallChain)
+		if err := ipt.Delete("filter", "FORWARD", pf.jumpRule()...); err != nil {
+			return err
+		}
+		if err := ipt.ClearChain("filter", peerFirewallChain); err != nil {
+			return err
+		}
+		if err := ipt.DeleteChain("filter", peerFirewallChain); err != nil {
+			return err
+		}
+	}
+	pf.rules = make(map[string]iptablesRule)
+	return nil
+}
+
+// setAllowedIPs replaces the networks granted to leases without policy
+// networks. The rules are updated on the next reconcile.
+func (pf *peerFirewall) setAllowedIPs(allowedIPs []string) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	pf.allowedIPs = allowedIPs
+}
+
+// peerRules returns the rules that accept traffic from the lease addresses to
+// the networks granted to the lease.
+func (pf *peerFirewall) peerRules(r WGRecord) []iptablesRule {
+	networks := r.Networks
+	if networks == nil {
+		networks = pf.allowedIPs
+	}
+	rules := []iptablesRule{}
+	for _, n := range networks {
+		dst, err := netip.ParsePrefix(n)
+		if err != nil {
+			logger.Errorf("Skipping invalid network %q for peer %s: %v", n, r.PubKey, err)
+			continue
+		}
+		src, proto := r.IP, iptables.ProtocolIPv4
+		if dst.Addr().Is6() {
+			src, proto = r.IP6, iptables.ProtocolIPv6
+		}
+		if !src.IsValid() || pf.clients[proto] == nil {
+			continue
+		}
+		rules = append(rules, iptablesRule{
+			proto: proto,
+			spec: []string{
+				"-s", netip.PrefixFrom(src, src.BitLen()).String(),
+				"-d", dst.Masked().String(),
+				"-j", "ACCEPT",
+			},
+		})
+	}
+	return rules
+}
+
+// reconcile brings the peer chain in line with the given leases, adding the
+// rules of new leases and removing the rules of leases that are gone.
+func (pf *peerFirewall) reconcile(records map[leaseKey]WGRecord) error {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	desired := make(map[string]iptablesRule)
+	for _, r := range records {
+		for _, rule := range pf.peerRules(r) {
+			desired[rule.String()] = rule
+		}
+	}
+	errs := []string{}
+	for k, rule := range pf.rules {
+		if _, ok := desired[k]; ok {
+			continue
+		}
+		logger.Verbosef("Removing %s rule from %s", rule, peerFirewallChain)
+		if err := pf.clients[rule.proto].Delete("filter", peerFirewallChain, rule.spec...); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(pf.rules, k)
+	}
+	for k, rule := range desired {
+		if _, ok := pf.rules[k]; ok {
+			continue
+		}
+		logger.Verbosef("Adding %s rule to %s", rule, peerFirewallChain)
+		// Insert at the top, ahead of the final DROP rule.
+		if err := pf.clients[rule.proto].Insert("filter", peerFirewallChain, 1, rule.spec...); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		pf.rules[k] = rule
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot update peer firewall: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIPTables keeps the rules of each table/chain in memory.
+type fakeIPTables struct {
+	chains map[string][]string
+}
+
+func newFakeIPTables() *fakeIPTables {
+	return &fakeIPTables{chains: map[string][]string{"filter/FORWARD": {}}}
+}
+
+func (f *fakeIPTables) ChainExists(table, chain string) (bool, error) {
+	_, ok := f.chains[table+"/"+chain]
+	return ok, nil
+}
+
+func (f *fakeIPTables) ClearChain(table, chain string) error {
+	f.chains[table+"/"+chain] = []string{}
+	return nil
+}
+
+func (f *fakeIPTables) DeleteChain(table, chain string) error {
+	delete(f.chains, table+"/"+chain)
+	return nil
+}
+
+func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return slices.Contains(f.chains[table+"/"+chain], strings.Join(rulespec, " ")), nil
+}
+
+func (f *fakeIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	k := table + "/" + chain
+	f.chains[k] = slices.Insert(f.chains[k], pos-1, strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *fakeIPTables) Append(table, chain string, rulespec ...string) error {
+	k := table + "/" + chain
+	f.chains[k] = append(f.chains[k], strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *fakeIPTables) List(table, chain string) ([]string, error) {
+	lines := []string{"-N " + chain}
+	for _, r := range f.chains[table+"/"+chain] {
+		lines = append(lines, "-A "+chain+" "+r)
+	}
+	return lines, nil
+}
+
+func (f *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	k := table + "/" + chain
+	// Rules are stored the way they are listed, with quoted arguments.
+	f.chains[k] = slices.DeleteFunc(f.chains[k], func(r string) bool {
+		return strings.ReplaceAll(r, `"`, "") == strings.Join(rulespec, " ")
+	})
+	return nil
+}
+
+func TestPeerFirewall(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ipt4, ipt6 := newFakeIPTables(), newFakeIPTables()
+	pf := &peerFirewall{
+		device:     "wg0",
+		allowedIPs: []string{"10.0.0.0/24", "10.90.0.0/16"},
+		clients: map[iptables.Protocol]iptablesClient{
+			iptables.ProtocolIPv4: ipt4,
+			iptables.ProtocolIPv6: ipt6,
+		},
+		rules: make(map[string]iptablesRule),
+	}
+	assert.NoError(t, pf.setup())
+	for _, ipt := range []*fakeIPTables{ipt4, ipt6} {
+		assert.Equal(t, []string{"-i wg0 -j WIRESTEWARD-FORWARD"}, ipt.chains["filter/FORWARD"])
+		assert.Equal(t, []string{"-j DROP"}, ipt.chains["filter/WIRESTEWARD-FORWARD"])
+	}
+	// setup is idempotent
+	assert.NoError(t, pf.setup())
+	assert.Equal(t, []string{"-i wg0 -j WIRESTEWARD-FORWARD"}, ipt4.chains["filter/FORWARD"])
+
+	records := map[leaseKey]WGRecord{
+		{Username: "alice"}: {
+			PubKey: "a",
+			IP:     netip.MustParseAddr("10.0.0.2"),
+		},
+		{Username: "bob"}: {
+			PubKey:   "b",
+			IP:       netip.MustParseAddr("10.0.0.3"),
+			IP6:      netip.MustParseAddr("fd00::3"),
+			Networks: []string{"10.0.0.0/24", "10.20.0.0/16", "fd00:1::/64"},
+		},
+	}
+	assert.NoError(t, pf.reconcile(records))
+	assert.ElementsMatch(t, []string{
+		"-s 10.0.0.2/32 -d 10.0.0.0/24 -j ACCEPT",
+		"-s 10.0.0.2/32 -d 10.90.0.0/16 -j ACCEPT",
+		"-s 10.0.0.3/32 -d 10.0.0.0/24 -j ACCEPT",
+		"-s 10.0.0.3/32 -d 10.20.0.0/16 -j ACCEPT",
+		"-j DROP",
+	}, ipt4.chains["filter/WIRESTEWARD-FORWARD"])
+	assert.Equal(t, []string{
+		"-s fd00::3/128 -d fd00:1::/64 -j ACCEPT",
+		"-j DROP",
+	}, ipt6.chains["filter/WIRESTEWARD-FORWARD"])
+	assert.Equal(t, "-j DROP", ipt4.chains["filter/WIRESTEWARD-FORWARD"][4])
+
+	delete(records, leaseKey{Username: "bob"})
+	assert.NoError(t, pf.reconcile(records))
+	assert.ElementsMatch(t, []string{
+		"-s 10.0.0.2/32 -d 10.0.0.0/24 -j ACCEPT",
+		"-s 10.0.0.2/32 -d 10.90.0.0/16 -j ACCEPT",
+		"-j DROP",
+	}, ipt4.chains["filter/WIRESTEWARD-FORWARD"])
+	assert.Equal(t, []string{"-j DROP"}, ipt6.chains["filter/WIRESTEWARD-FORWARD"])
+
+	assert.NoError(t, pf.teardown())
+	for _, ipt := range []*fakeIPTables{ipt4, ipt6} {
+		assert.Empty(t, ipt.chains["filter/FORWARD"])
+		_, ok := ipt.chains["filter/WIRESTEWARD-FORWARD"]
+		assert.False(t, ok)
+	}
+}
+
+func TestPeerFirewall_persist(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ipt := newFakeIPTables()
+	newFirewall := func() *peerFirewall {
+		return &peerFirewall{
+			device:     "wg0",
+			allowedIPs: []string{"10.0.0.0/24"},
+			clients:    map[iptables.Protocol]iptablesClient{iptables.ProtocolIPv4: ipt},
+			persist:    true,
+			rules:      make(map[string]iptablesRule),
+		}
+	}
+	records := map[leaseKey]WGRecord{
+		{Username: "alice"}: {PubKey: "a", IP: netip.MustParseAddr("10.0.0.2")},
+	}
+	pf := newFirewall()
+	assert.NoError(t, pf.setup())
+	assert.NoError(t, pf.reconcile(records))
+	assert.NoError(t, pf.teardown())
+	// The chain is left in place.
+	want := []string{"-s 10.0.0.2/32 -d 10.0.0.0/24 -j ACCEPT", "-j DROP"}
+	assert.Equal(t, want, ipt.chains["filter/WIRESTEWARD-FORWARD"])
+	assert.Equal(t, []string{"-i wg0 -j WIRESTEWARD-FORWARD"}, ipt.chains["filter/FORWARD"])
+
+	// A restarted server adopts the existing rules rather than flushing them.
+	pf = newFirewall()
+	assert.NoError(t, pf.setup())
+	assert.Equal(t, want, ipt.chains["filter/WIRESTEWARD-FORWARD"])
+	assert.Equal(t, 1, len(pf.rules))
+	assert.NoError(t, pf.reconcile(records))
+	assert.Equal(t, want, ipt.chains["filter/WIRESTEWARD-FORWARD"])
+	assert.Equal(t, []string{"-i wg0 -j WIRESTEWARD-FORWARD"}, ipt.chains["filter/FORWARD"])
+
+	// Rules of leases that are gone are removed on reconcile.
+	pf = newFirewall()
+	assert.NoError(t, pf.setup())
+	assert.NoError(t, pf.reconcile(map[leaseKey]WGRecord{}))
+	assert.Equal(t, []string{"-j DROP"}, ipt.chains["filter/WIRESTEWARD-FORWARD"])
+}
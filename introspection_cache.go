@@ -0,0 +1,113 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// introspectionCache is an LRU cache of introspection results, keyed by the
+// hash of the token so that tokens are not kept around. Active results are
+// cached until the token expires, for at most ttl, and inactive ones for
+// negativeTTL. Errors are never cached.
+type introspectionCache struct {
+	entries     map[[sha256.Size]byte]*list.Element
+	lru         *list.List // most recently used first
+	mutex       sync.Mutex
+	negativeTTL time.Duration
+	size        int
+	ttl         time.Duration
+	now         func() time.Time
+}
+
+type introspectionCacheEntry struct {
+	key      [sha256.Size]byte
+	response introspectionResponse
+	expires  time.Time
+}
+
+// newIntrospectionCache returns a cache with the configured bounds, or nil
+// if caching is disabled.
+func newIntrospectionCache(cfg *serverConfig) *introspectionCache {
+	if cfg.IntrospectionCacheTTL <= 0 {
+		return nil
+	}
+	return &introspectionCache{
+		entries:     make(map[[sha256.Size]byte]*list.Element),
+		lru:         list.New(),
+		negativeTTL: cfg.IntrospectionCacheNegativeTTL,
+		size:        cfg.IntrospectionCacheSize,
+		ttl:         cfg.IntrospectionCacheTTL,
+		now:         time.Now,
+	}
+}
+
+// get returns a copy of the cached result for the token, if there is one that
+// has not expired. A nil cache is always empty.
+func (c *introspectionCache) get(token string) (*introspectionResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := sha256.Sum256([]byte(token))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*introspectionCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	response := entry.response
+	return &response, true
+}
+
+// put caches the result for the token, evicting the least recently used
+// results if the cache is full.
+func (c *introspectionCache) put(token string, response *introspectionResponse) {
+	if c == nil {
+		return
+	}
+	now := c.now()
+	expires := now.Add(c.negativeTTL)
+	if response.Active {
+		expires = now.Add(c.ttl)
+		if exp := time.Unix(response.Exp, 0); exp.Before(expires) {
+			expires = exp
+		}
+	}
+	if !now.Before(expires) {
+		return
+	}
+	key := sha256.Sum256([]byte(token))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := &introspectionCacheEntry{key: key, response: *response, expires: expires}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*introspectionCacheEntry).key)
+	}
+}
+
+// clear removes all cached results.
+func (c *introspectionCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[[sha256.Size]byte]*list.Element)
+	c.lru.Init()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntrospectionCache(t *testing.T) {
+	now := time.Unix(100000, 0)
+	c := newIntrospectionCache(&serverConfig{
+		IntrospectionCacheTTL:         time.Minute,
+		IntrospectionCacheNegativeTTL: 10 * time.Second,
+		IntrospectionCacheSize:        2,
+	})
+	c.now = func() time.Time { return now }
+
+	c.put("a", &introspectionResponse{Active: true, UserName: "alice", Exp: now.Add(time.Hour).Unix()})
+	c.put("b", &introspectionResponse{Active: true, UserName: "bob", Exp: now.Add(30 * time.Second).Unix()})
+	c.put("inactive", &introspectionResponse{})
+	// The least recently used result was evicted.
+	_, ok := c.get("a")
+	assert.False(t, ok)
+	r, ok := c.get("b")
+	assert.True(t, ok)
+	assert.Equal(t, "bob", r.UserName)
+	r, ok = c.get("inactive")
+	assert.True(t, ok)
+	assert.False(t, r.Active)
+
+	// Inactive results expire after the negative TTL.
+	now = now.Add(10 * time.Second)
+	_, ok = c.get("inactive")
+	assert.False(t, ok)
+	// Active results expire with the token, before the TTL.
+	now = now.Add(20 * time.Second)
+	_, ok = c.get("b")
+	assert.False(t, ok)
+
+	// And after the TTL, before the token.
+	c.put("a", &introspectionResponse{Active: true, Exp: now.Add(time.Hour).Unix()})
+	now = now.Add(59 * time.Second)
+	_, ok = c.get("a")
+	assert.True(t, ok)
+	now = now.Add(time.Second)
+	_, ok = c.get("a")
+	assert.False(t, ok)
+
+	// Results of expired tokens are not cached.
+	c.put("expired", &introspectionResponse{Active: true, Exp: now.Add(-time.Second).Unix()})
+	_, ok = c.get("expired")
+	assert.False(t, ok)
+
+	var nilCache *introspectionCache
+	nilCache.put("a", &introspectionResponse{Active: true})
+	_, ok = nilCache.get("a")
+	assert.False(t, ok)
+}
+
+func TestTokenValidator_cache(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	var serverURL string
+	var introspections atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": "%[1]s", "introspection_endpoint": "%[1]s/introspect"}`, serverURL)
+	})
+	mux.HandleFunc("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		introspections.Add(1)
+		fmt.Fprintf(w, `{"active": true, "username": "alice", "exp": %d}`, time.Now().Add(time.Hour).Unix())
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	serverURL = srv.URL
+
+	tv, err := newTokenValidator([]oauthServerConfig{{Server: serverURL, ClientID: "test-client"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tv.cache = newIntrospectionCache(&serverConfig{
+		IntrospectionCacheTTL:         time.Minute,
+		IntrospectionCacheNegativeTTL: 10 * time.Second,
+		IntrospectionCacheSize:        10,
+	})
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("0102030405060708090A0B0C0D0E0F10")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer: serverURL,
+		Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		tokenInfo, err := tv.validate(token, "access_token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "alice", tokenInfo.UserName)
+	}
+	assert.Equal(t, int32(1), introspections.Load())
+	// Re-validation always goes to the IdP.
+	if _, err := tv.revalidate(token, "access_token"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int32(2), introspections.Load())
+	// Discovery on config reload empties the cache.
+	if err := tv.setServers([]oauthServerConfig{{Server: serverURL, ClientID: "test-client"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tv.validate(token, "access_token"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int32(3), introspections.Load())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	jwksFetchTimeout = 10 * time.Second
+	// jwksMinRefreshInterval limits how often the key set is fetched again
+	// for tokens signed with an unknown key, so that tokens with made up
+	// key ids cannot be used to hammer the IdP.
+	jwksMinRefreshInterval = time.Minute
+)
+
+// jwksAlgValues are the signature algorithms accepted for tokens verified
+// against a key set. Only asymmetric algorithms make sense for published
+// keys.
+var jwksAlgValues = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// jwksCache holds the key set published by an OAuth server. The keys are
+// fetched when the cache is created and again when a token is signed with a
+// key that is not in the set, as happens after the IdP rotates its keys. If
+// fetching fails the cached keys keep being used.
+type jwksCache struct {
+	client             *http.Client
+	url                string
+	keys               jose.JSONWebKeySet
+	fetched            time.Time
+	minRefreshInterval time.Duration
+	mutex              sync.Mutex
+}
+
+func newJWKSCache(url string) (*jwksCache, error) {
+	c := &jwksCache{
+		client:             &http.Client{Timeout: jwksFetchTimeout},
+		url:                url,
+		minRefreshInterval: jwksMinRefreshInterval,
+	}
+	if err := c.fetch(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// fetch replaces the cached keys with the ones currently published. It must
+// be called with the mutex held, or before the cache is shared.
+func (c *jwksCache) fetch() error {
+	c.fetched = time.Now()
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return fmt.Errorf("cannot fetch key set: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot fetch key set: status %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot fetch key set: %w", err)
+	}
+	keys := jose.JSONWebKeySet{}
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return fmt.Errorf("cannot decode key set: %w", err)
+	}
+	c.keys = keys
+	return nil
+}
+
+// lookup returns the keys with the given key id, or all keys if the id is
+// empty. The key set is fetched again if there is no such key and it was not
+// fetched recently. An error is only returned if fetching fails.
+func (c *jwksCache) lookup(kid string) ([]jose.JSONWebKey, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	find := func() []jose.JSONWebKey {
+		if kid == "" {
+			return c.keys.Keys
+		}
+		return c.keys.Key(kid)
+	}
+	if keys := find(); len(keys) > 0 {
+		return keys, nil
+	}
+	if time.Since(c.fetched) < c.minRefreshInterval {
+		return nil, nil
+	}
+	logger.Verbosef("No key with id %q in %s, fetching the key set again", kid, c.url)
+	if err := c.fetch(); err != nil {
+		return nil, err
+	}
+	return find(), nil
+}
+
+// jwtUserClaims are the claims, in addition to the registered ones, that
+// describe the user a token was issued to.
+type jwtUserClaims struct {
+	UserName          string     `json:"username"`
+	PreferredUsername string     `json:"preferred_username"`
+	Email             string     `json:"email"`
+	EmailVerified     *claimBool `json:"email_verified"`
+	Groups            []string   `json:"groups"`
+}
+
+// verifyJWT verifies the signature and the `iss`, `aud`, `exp` and `nbf`
+// claims of a token locally, against the key set of the server. Tokens that
+// fail verification are reported as inactive, like an introspection endpoint
+// would. An error is only returned if the key set cannot be fetched.
+func verifyJWT(token, issuer string, s oauthServer) (*introspectionResponse, error) {
+	inactive := func(reason string, args ...interface{}) (*introspectionResponse, error) {
+		logger.Verbosef("Token of issuer %q failed verification: %s", issuer, fmt.Sprintf(reason, args...))
+		tokenValidations.WithLabelValues(issuer, "inactive").Inc()
+		return &introspectionResponse{Issuer: issuer}, nil
+	}
+	tok, err := jwt.ParseSigned(token, jwksAlgValues)
+	if err != nil {
+		return inactive("%v", err)
+	}
+	keys, err := s.jwks.lookup(tok.Headers[0].KeyID)
+	if err != nil {
+		tokenValidations.WithLabelValues(issuer, "error").Inc()
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return inactive("no key with id %q", tok.Headers[0].KeyID)
+	}
+	claims, user := jwt.Claims{}, jwtUserClaims{}
+	verified := false
+	for _, k := range keys {
+		if err := tok.Claims(k.Key, &claims, &user); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return inactive("invalid signature")
+	}
+	if claims.Expiry == nil {
+		return inactive("no exp claim")
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      issuer,
+		AnyAudience: s.Audiences,
+		Time:        time.Now(),
+	}, jwt.DefaultLeeway); err != nil {
+		return inactive("%v", err)
+	}
+	response := &introspectionResponse{
+		Active:            true,
+		Exp:               claims.Expiry.Time().Unix(),
+		UserName:          user.UserName,
+		Email:             user.Email,
+		EmailVerified:     user.EmailVerified,
+		Groups:            user.Groups,
+		Issuer:            issuer,
+		Audience:          claims.Audience,
+		Subject:           claims.Subject,
+		PreferredUsername: user.PreferredUsername,
+	}
+	tokenValidations.WithLabelValues(issuer, "active").Inc()
+	return response, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// testJWKSServer serves an OIDC discovery document and a key set, and signs
+// tokens with the keys in the set.
+type testJWKSServer struct {
+	*httptest.Server
+	keys  map[string]*rsa.PrivateKey
+	mutex sync.Mutex
+}
+
+func newTestJWKSServer(t *testing.T) *testJWKSServer {
+	ts := &testJWKSServer{keys: map[string]*rsa.PrivateKey{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": "%[1]s", "jwks_uri": "%[1]s/keys", "userinfo_endpoint": "%[1]s/userinfo"}`, ts.URL)
+	})
+	// Tokens are verified locally, without requests to the IdP.
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected userinfo request")
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		ts.mutex.Lock()
+		defer ts.mutex.Unlock()
+		set := jose.JSONWebKeySet{}
+		for kid, k := range ts.keys {
+			set.Keys = append(set.Keys, jose.JSONWebKey{Key: k.Public(), KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"})
+		}
+		if err := json.NewEncoder(w).Encode(set); err != nil {
+			t.Error(err)
+		}
+	})
+	ts.Server = httptest.NewServer(mux)
+	return ts
+}
+
+func (ts *testJWKSServer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.keys[kid] = k
+	return k
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.Claims, extra interface{}) string {
+	opts := (&jose.SignerOptions{}).WithHeader(jose.HeaderKey("kid"), kid)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := jwt.Signed(signer).Claims(claims).Claims(extra).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestTokenValidator_jwks(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	ts := newTestJWKSServer(t)
+	defer ts.Close()
+	key1 := ts.addKey(t, "key1")
+
+	tv, err := newTokenValidator([]oauthServerConfig{{
+		Server:        ts.URL,
+		Verification:  tokenVerificationJWKS,
+		Audiences:     []string{"api://wiresteward"},
+		UsernameClaim: usernameClaimSub,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.Claims{
+		Subject:  "alice@example.com",
+		Issuer:   ts.URL,
+		Audience: jwt.Audience{"api://wiresteward"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	groups := map[string]interface{}{"groups": []string{"staff"}}
+
+	tokenInfo, err := tv.validate(signTestToken(t, key1, "key1", claims, groups), "access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, tokenInfo.Active)
+	assert.Equal(t, "alice@example.com", tokenInfo.UserName)
+	assert.Equal(t, []string{"staff"}, tokenInfo.Groups)
+	assert.Equal(t, ts.URL, tokenInfo.Issuer)
+	assert.Equal(t, claims.Expiry.Time().Unix(), tokenInfo.Exp)
+
+	// A token for another application.
+	other := claims
+	other.Audience = jwt.Audience{"api://other"}
+	tokenInfo, err = tv.validate(signTestToken(t, key1, "key1", other, groups), "access_token")
+	assert.NoError(t, err)
+	assert.False(t, tokenInfo.Active)
+
+	// A token without an expiry.
+	noExpiry := claims
+	noExpiry.Expiry = nil
+	_, err = tv.validate(signTestToken(t, key1, "key1", noExpiry, groups), "access_token")
+	assert.Error(t, err)
+
+	// A token signed with a key that is not published.
+	forged, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenInfo, err = tv.validate(signTestToken(t, forged, "key1", claims, groups), "access_token")
+	assert.NoError(t, err)
+	assert.False(t, tokenInfo.Active)
+
+	// Rotated keys are fetched on a key id miss, but not more often than
+	// the minimum refresh interval.
+	key2 := ts.addKey(t, "key2")
+	rotated := signTestToken(t, key2, "key2", claims, groups)
+	tokenInfo, err = tv.validate(rotated, "access_token")
+	assert.NoError(t, err)
+	assert.False(t, tokenInfo.Active)
+	tv.servers[ts.URL].jwks.minRefreshInterval = 0
+	tokenInfo, err = tv.validate(rotated, "access_token")
+	assert.NoError(t, err)
+	assert.True(t, tokenInfo.Active)
+
+	// Claims missing from the token are not looked up, so the token does
+	// not identify the user.
+	byEmail, err := newTokenValidator([]oauthServerConfig{{
+		Server:        ts.URL,
+		Verification:  tokenVerificationJWKS,
+		Audiences:     []string{"api://wiresteward"},
+		UsernameClaim: usernameClaimEmail,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenInfo, err = byEmail.validate(signTestToken(t, key1, "key1", claims, groups), "access_token")
+	assert.NoError(t, err)
+	assert.True(t, tokenInfo.Active)
+	assert.Empty(t, tokenInfo.UserName)
+
+	// Known keys keep working while the IdP is unavailable.
+	ts.Close()
+	tokenInfo, err = tv.validate(signTestToken(t, key1, "key1", claims, groups), "access_token")
+	assert.NoError(t, err)
+	assert.True(t, tokenInfo.Active)
+	_, err = tv.validate(signTestToken(t, forged, "key3", claims, groups), "access_token")
+	assert.Error(t, err)
+}
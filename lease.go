@@ -3,12 +3,10 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"net/netip"
-	"os"
-	"path/filepath"
-	"strings"
+	"slices"
 	"sync"
 	"time"
 
@@ -16,43 +14,166 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// WGRecord describes a lease entry for a peer.
+// WGRecord describes a lease entry for a peer. IP6 is only set when the
+// server is configured with an IPv6 address range. PresharedKey is only set
+// when the server generates preshared keys. Networks holds the networks the
+// peer was granted access to by the server policies. token is the access token
+// the lease was last granted for, which is persisted along with the lease so
+// that it can be re-validated after a restart. issuer and sourceIP are where
+// the token was issued and the lease requested from. renewed is when the lease
+// was last granted or loaded, and presharedKeyCreated when PresharedKey was
+// generated or loaded. idle is set while the peer is removed from the device
+// for inactivity. These last five are only held in memory, and never persisted
+// by lease stores.
 type WGRecord struct {
-	PubKey  string
-	IP      netip.Addr
-	expires time.Time
+	PubKey              string
+	PresharedKey        string
+	IP                  netip.Addr
+	IP6                 netip.Addr
+	Hostname            string
+	Networks            []string
+	expires             time.Time
+	token               string
+	issuer              string
+	sourceIP            string
+	renewed             time.Time
+	presharedKeyCreated time.Time
+	idle                bool
+}
+
+// allowedIPs returns the addresses the peer may send traffic from.
+func (wgr WGRecord) allowedIPs() []string {
+	ips := []string{fmt.Sprintf("%s/32", wgr.IP.String())}
+	if wgr.IP6.IsValid() {
+		ips = append(ips, fmt.Sprintf("%s/128", wgr.IP6.String()))
+	}
+	return ips
 }
 
 func (wgr WGRecord) String() string {
 	return wgr.PubKey + " " + wgr.IP.String() + " " + wgr.expires.Format(time.RFC3339)
 }
 
-// fileLeaseManager implements functionality for managing address leases for
-// peers, using a file as a state backend.
-type fileLeaseManager struct {
-	deviceName     string
-	filename       string
-	ipPrefix       netip.Prefix
-	wgRecords      map[string]WGRecord
-	wgRecordsMutex sync.Mutex
+// leaseKey identifies a lease. A user may hold one lease per device, where
+// devices are told apart by the stable identifier that agents send along with
+// lease requests. Agents that do not send one share the empty device ID.
+type leaseKey struct {
+	Username string
+	DeviceID string
 }
 
-func newFileLeaseManager(cfg *serverConfig) (*fileLeaseManager, error) {
-	if cfg.LeasesFilename == "" {
-		return nil, fmt.Errorf("file name cannot be empty")
-	}
-	logger.Verbosef("leases filename: %s\n", cfg.LeasesFilename)
-	leaseDir := filepath.Dir(cfg.LeasesFilename)
-	err := os.MkdirAll(leaseDir, 0755)
-	if err != nil {
-		logger.Errorf("Unable to create directory=%s", leaseDir)
-		return nil, err
+func (k leaseKey) String() string {
+	if k.DeviceID == "" {
+		return k.Username
 	}
+	return k.Username + "/" + k.DeviceID
+}
 
-	lm := &fileLeaseManager{
-		ipPrefix:   cfg.WireguardIPPrefix,
-		deviceName: cfg.DeviceName,
-		filename:   cfg.LeasesFilename,
+// leaseParams describes the peer a lease is requested for. Groups holds the
+// group claims of the user's token, and Token the token itself so that it can
+// be re-validated for as long as the lease is active. Networks are the
+// networks granted to the user. Issuer and SourceIP are recorded in audit
+// events.
+type leaseParams struct {
+	Username string
+	Groups   []string
+	DeviceID string
+	Hostname string
+	PubKey   string
+	Expiry   time.Time
+	Token    string
+	Networks []string
+	Issuer   string
+	SourceIP string
+}
+
+func (p leaseParams) key() leaseKey {
+	return leaseKey{Username: p.Username, DeviceID: p.DeviceID}
+}
+
+const (
+	// poolExhaustionReject rejects new leases while the address pool is full.
+	poolExhaustionReject = "reject"
+	// poolExhaustionReclaim revokes the lease of the peer with the least
+	// recent handshake to make room for a new lease.
+	poolExhaustionReclaim = "reclaim"
+)
+
+var (
+	// errDeviceLimitReached is returned when a lease is requested for a new
+	// device of a user that already holds the maximum number of leases.
+	errDeviceLimitReached = errors.New("device limit reached")
+	// errAddressPoolExhausted is returned when there are no addresses left
+	// to lease to a new peer.
+	errAddressPoolExhausted = errors.New("address pool exhausted")
+)
+
+// recentAddress holds the addresses of an expired lease, which are preferred
+// when the same user device requests a new lease before the deadline.
+type recentAddress struct {
+	IP       netip.Addr
+	IP6      netip.Addr
+	deadline time.Time
+}
+
+// leaseManager implements functionality for managing address leases for
+// peers, persisting them via a LeaseStore.
+type leaseManager struct {
+	addressReuseGracePeriod time.Duration
+	audit                   *auditLog // nil unless auditing is enabled
+	deviceName              string
+	firewall                *peerFirewall // nil unless the peer firewall is enabled
+	idlePeerTimeout         time.Duration
+	ipPrefix                netip.Prefix
+	ip6Prefix               netip.Prefix
+	maxDevicesPerUser       int
+	poolPolicy              string
+	presharedKeys           bool
+	reservations            map[string]netip.Addr // keyed by username or group
+	store                   LeaseStore
+	wgClient                wgClient // nil to open a wgctrl client for every update
+	wgRecords               map[leaseKey]WGRecord
+	wgRecordsMutex          sync.Mutex
+	// recentAddresses remembers the addresses of leases that expired within
+	// addressReuseGracePeriod. It is only kept in memory and seeded from the
+	// store on start.
+	recentAddresses map[leaseKey]recentAddress
+	// lastHandshakes returns the last handshake time of the device peers,
+	// keyed by public key. It is used to pick a lease to reclaim when the
+	// address pool is exhausted.
+	lastHandshakes func() (map[string]time.Time, error)
+}
+
+// minIdlePeerTimeout is the shortest accepted idlePeerTimeout. Active peers
+// complete a handshake at least every two minutes, as the server sends them
+// keepalives.
+const minIdlePeerTimeout = 5 * time.Minute
+
+// presharedKeyRotationInterval is how long a preshared key is kept across
+// lease renewals. WireGuard holds a single preshared key per peer, so the peer
+// cannot complete a handshake from when the key changes until the agent
+// applies the new one; rotating less often than leases are renewed keeps such
+// interruptions, and reconfigurations of the device, rare.
+const presharedKeyRotationInterval = 24 * time.Hour
+
+func newLeaseManager(cfg *serverConfig, store LeaseStore, firewall *peerFirewall, audit *auditLog) (*leaseManager, error) {
+	lm := &leaseManager{
+		audit:                   audit,
+		firewall:                firewall,
+		idlePeerTimeout:         cfg.IdlePeerTimeout,
+		addressReuseGracePeriod: cfg.AddressReuseGracePeriod,
+		recentAddresses:         make(map[leaseKey]recentAddress),
+		ipPrefix:                cfg.WireguardIPPrefix,
+		ip6Prefix:               cfg.WireguardIP6Prefix,
+		deviceName:              cfg.DeviceName,
+		maxDevicesPerUser:       cfg.MaxDevicesPerUser,
+		poolPolicy:              cfg.PoolExhaustionPolicy,
+		presharedKeys:           cfg.PresharedKeys,
+		reservations:            cfg.ReservedAddresses,
+		store:                   store,
+		lastHandshakes: func() (map[string]time.Time, error) {
+			return peerHandshakes(cfg.DeviceName)
+		},
 	}
 
 	if err := lm.loadWgRecords(); err != nil {
@@ -67,172 +188,646 @@ func newFileLeaseManager(cfg *serverConfig) (*fileLeaseManager, error) {
 	return lm, nil
 }
 
-func (lm *fileLeaseManager) loadWgRecords() error {
+// loadWgRecords loads the persisted leases from the store, dropping any that
+// have already expired. The addresses of leases that expired within the reuse
+// grace period are remembered.
+func (lm *leaseManager) loadWgRecords() error {
 	lm.wgRecordsMutex.Lock()
 	defer lm.wgRecordsMutex.Unlock()
 
-	lm.wgRecords = make(map[string]WGRecord)
-
-	r, err := os.Open(lm.filename)
+	if err := lm.store.Load(); err != nil {
+		return err
+	}
+	records, err := lm.store.List()
 	if err != nil {
-		logger.Errorf("unable to open leases file: %v", err)
-		return nil
+		return err
 	}
-	defer r.Close()
-
-	sc := bufio.NewScanner(r)
-	for sc.Scan() {
-		line := sc.Text()
-		if len(line) == 0 {
-			continue
-		}
-		tokens := strings.Fields(line)
-		if len(tokens) != 4 {
-			return fmt.Errorf("malformed line, want 3 fields, got %d: %s", len(tokens), line)
-		}
-
-		username := tokens[0]
-		pubKey := tokens[1]
-		ipaddr := netip.MustParseAddr(tokens[2])
-		expires, err := time.Parse(time.RFC3339, tokens[3])
-		if err != nil {
-			return fmt.Errorf("expected time of exipry in RFC3339 format, got: %v", tokens[2])
-		}
-		if expires.After(time.Now()) {
-			lm.wgRecords[username] = WGRecord{
-				PubKey:  pubKey,
-				IP:      ipaddr,
-				expires: expires,
-			}
+	now := time.Now()
+	expired, err := lm.store.Expire(now)
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		lm.rememberAddress(k, records[k], records[k].expires)
+		ev := newLeaseEvent(leaseEventExpired, k, records[k])
+		ev.Reason = "expired while the server was not running"
+		lm.audit.record(ev)
+		delete(records, k)
+	}
+	for k, r := range records {
+		r.renewed = now
+		if r.PresharedKey != "" {
+			r.presharedKeyCreated = now
 		}
+		records[k] = r
 	}
-
-	logger.Verbosef("records loaded")
+	lm.wgRecords = records
+	lm.pruneRecentAddresses(now)
 	return nil
 }
 
-func (lm *fileLeaseManager) saveWgRecords() error {
+func (lm *leaseManager) syncWgRecords() error {
 	lm.wgRecordsMutex.Lock()
-	defer lm.wgRecordsMutex.Unlock()
-	f, err := os.OpenFile(lm.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	now := time.Now()
+	expired, err := lm.store.Expire(now)
 	if err != nil {
+		lm.wgRecordsMutex.Unlock()
 		return err
 	}
-	defer f.Close()
-	for username, record := range lm.wgRecords {
-		if _, err := fmt.Fprintf(f, "%s %s\n", username, record); err != nil {
+	for _, k := range expired {
+		lm.rememberAddress(k, lm.wgRecords[k], now)
+		lm.audit.record(newLeaseEvent(leaseEventExpired, k, lm.wgRecords[k]))
+		delete(lm.wgRecords, k)
+	}
+	lm.pruneRecentAddresses(now)
+	idle := lm.markIdlePeers(now)
+	lm.wgRecordsMutex.Unlock()
+	if len(expired) > 0 || idle > 0 {
+		if err := lm.updateWgPeers(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (lm *fileLeaseManager) syncWgRecords() error {
-	lm.wgRecordsMutex.Lock()
-	changed := false
+// markIdlePeers marks the leases whose peers have not completed a handshake
+// within idlePeerTimeout, nor renewed the lease, as idle, so that their peers
+// are removed from the device until the next renewal. It returns the number
+// of leases newly marked idle. The caller must hold wgRecordsMutex.
+func (lm *leaseManager) markIdlePeers(now time.Time) int {
+	if lm.idlePeerTimeout <= 0 {
+		return 0
+	}
+	handshakes, err := lm.lastHandshakes()
+	if err != nil {
+		logger.Errorf("Cannot check for idle peers: %v", err)
+		return 0
+	}
+	n := 0
 	for k, r := range lm.wgRecords {
-		if r.expires.Before(time.Now()) {
-			delete(lm.wgRecords, k)
-			changed = true
+		if r.idle {
+			continue
 		}
-	}
-	lm.wgRecordsMutex.Unlock()
-	if changed {
-		if err := lm.updateWgPeers(); err != nil {
-			return err
+		lastActive := r.renewed
+		if hs := handshakes[r.PubKey]; hs.After(lastActive) {
+			lastActive = hs
 		}
-		if err := lm.saveWgRecords(); err != nil {
-			return err
+		if now.Sub(lastActive) < lm.idlePeerTimeout {
+			continue
 		}
+		logger.Verbosef("Removing idle peer for %s, last active at %s", k, lastActive.Format(time.RFC3339))
+		r.idle = true
+		lm.wgRecords[k] = r
+		n++
 	}
-	return nil
+	return n
 }
 
-func (lm *fileLeaseManager) updateWgPeers() error {
+func (lm *leaseManager) updateWgPeers() error {
 	lm.wgRecordsMutex.Lock()
 	defer lm.wgRecordsMutex.Unlock()
 	peers := []wgtypes.PeerConfig{}
 	for _, r := range lm.wgRecords {
-		peerConfig, err := newPeerConfig(r.PubKey, "", "", []string{fmt.Sprintf("%s/32", r.IP.String())})
+		if r.idle {
+			continue
+		}
+		peerConfig, err := newPeerConfig(r.PubKey, r.PresharedKey, "", r.allowedIPs())
 		if err != nil {
 			logger.Errorf("error calculating peer config %v", err)
 			continue
 		}
 		peers = append(peers, *peerConfig)
 	}
-	return setPeers(lm.deviceName, peers)
+	var err error
+	if lm.wgClient != nil {
+		err = configurePeers(lm.wgClient, lm.deviceName, peers)
+	} else {
+		err = setPeers(lm.deviceName, peers)
+	}
+	if err != nil {
+		return err
+	}
+	if lm.firewall != nil {
+		return lm.firewall.reconcile(lm.wgRecords)
+	}
+	return nil
 }
 
-// createOrUpdatePeer creates or updates the WGRecord for the given user and
-// returns the record, a bool needToUpdateWGPeers indicating whether the
-// WireGuard interface configuration must be updated, and any error.
+// createOrUpdatePeer creates or updates the WGRecord for the given user
+// device and returns the record, a bool needToUpdateWGPeers indicating whether
+// the WireGuard interface configuration must be updated, and any error.
 // needToUpdateWGPeers is false when an existing record already holds the same
 // public key, meaning only the lease expiry changed and no interface
-// reconfiguration is required.
-func (lm *fileLeaseManager) createOrUpdatePeer(username, pubKey string, expiry time.Time) (WGRecord, bool, error) {
-	if username == "" {
+// reconfiguration is required. If preshared keys are enabled, a new key is
+// generated for new leases and public keys, and otherwise only once the key
+// is presharedKeyRotationInterval old.
+func (lm *leaseManager) createOrUpdatePeer(p leaseParams) (WGRecord, bool, error) {
+	if p.Username == "" {
 		return WGRecord{}, false, fmt.Errorf("Cannot add peer for empty username")
 	}
-	if pubKey == "" {
+	if p.PubKey == "" {
 		return WGRecord{}, false, fmt.Errorf("Cannot add peer for empty public key")
 	}
 	lm.wgRecordsMutex.Lock()
 	defer lm.wgRecordsMutex.Unlock()
-	if record, ok := lm.wgRecords[username]; ok {
-		if record.PubKey == pubKey {
-			record.expires = expiry
-			lm.wgRecords[username] = record
-			return lm.wgRecords[username], false, nil
+	key := p.key()
+	record, ok := lm.wgRecords[key]
+	previousPubKey := record.PubKey
+	needToUpdateWGPeers := !ok || record.PubKey != p.PubKey
+	if !ok {
+		if lm.maxDevicesPerUser > 0 && lm.userDevices(p.Username) >= lm.maxDevicesPerUser {
+			return WGRecord{}, false, fmt.Errorf(
+				"%w: user %s already holds %d leases",
+				errDeviceLimitReached,
+				p.Username,
+				lm.maxDevicesPerUser,
+			)
+		}
+		ip, err := lm.allocateAddress(p)
+		if err != nil {
+			return WGRecord{}, false, err
 		}
-		record.PubKey = pubKey
-		record.expires = expiry
-		lm.wgRecords[username] = record
-		return lm.wgRecords[username], true, nil
+		record.IP = ip
 	}
-	lm.wgRecords[username] = WGRecord{
-		PubKey:  pubKey,
-		IP:      lm.nextAvailableAddress(),
-		expires: expiry,
+	// Leases created before an IPv6 range was configured get an IPv6
+	// address on renewal.
+	if lm.ip6Prefix.IsValid() && !record.IP6.IsValid() {
+		record.IP6 = lm.allocateAddress6(key)
+		needToUpdateWGPeers = needToUpdateWGPeers || record.IP6.IsValid()
 	}
-	return lm.wgRecords[username], true, nil
+	if !slices.Equal(record.Networks, p.Networks) {
+		needToUpdateWGPeers = true
+	}
+	// Idle peers are added back to the device when the agent renews.
+	if record.idle {
+		record.idle = false
+		needToUpdateWGPeers = true
+	}
+	now := time.Now()
+	if lm.presharedKeys {
+		if record.PresharedKey == "" || previousPubKey != p.PubKey ||
+			now.Sub(record.presharedKeyCreated) >= presharedKeyRotationInterval {
+			psk, err := wgtypes.GenerateKey()
+			if err != nil {
+				return WGRecord{}, false, fmt.Errorf("cannot generate preshared key: %w", err)
+			}
+			record.PresharedKey = psk.String()
+			record.presharedKeyCreated = now
+			needToUpdateWGPeers = true
+		}
+	} else if record.PresharedKey != "" {
+		record.PresharedKey = ""
+		needToUpdateWGPeers = true
+	}
+	record.PubKey = p.PubKey
+	record.Hostname = p.Hostname
+	record.Networks = p.Networks
+	record.expires = p.Expiry
+	record.token = p.Token
+	record.issuer = p.Issuer
+	record.sourceIP = p.SourceIP
+	record.renewed = now
+	if err := lm.store.Upsert(key, record); err != nil {
+		return WGRecord{}, false, err
+	}
+	lm.wgRecords[key] = record
+	delete(lm.recentAddresses, key)
+	switch {
+	case !ok:
+		lm.audit.record(newLeaseEvent(leaseEventCreated, key, record))
+	case previousPubKey != p.PubKey:
+		ev := newLeaseEvent(leaseEventKeyChanged, key, record)
+		ev.PreviousPubKey = previousPubKey
+		lm.audit.record(ev)
+	default:
+		lm.audit.record(newLeaseEvent(leaseEventExtended, key, record))
+	}
+	return record, needToUpdateWGPeers, nil
 }
 
-func (lm *fileLeaseManager) addNewPeer(username, pubKey string, expiry time.Time) (WGRecord, error) {
-	record, needToUpdateWGPeers, err := lm.createOrUpdatePeer(username, pubKey, expiry)
+// userDevices returns the number of leases held by the given user. The caller
+// must hold wgRecordsMutex.
+func (lm *leaseManager) userDevices(username string) int {
+	n := 0
+	for k := range lm.wgRecords {
+		if k.Username == username {
+			n++
+		}
+	}
+	return n
+}
+
+func (lm *leaseManager) addNewPeer(p leaseParams) (WGRecord, error) {
+	record, needToUpdateWGPeers, err := lm.createOrUpdatePeer(p)
 	if err != nil {
 		return WGRecord{}, err
 	}
 	if needToUpdateWGPeers {
-		logger.Verbosef("Updating WireGuard peer for user %s (new peer or public key change)", username)
+		logger.Verbosef("Updating WireGuard peer for %s (new peer or public key change)", p.key())
 		if err := lm.updateWgPeers(); err != nil {
 			return WGRecord{}, err
 		}
 	} else {
-		logger.Verbosef("Extending lease expiry for user %s, skipping WireGuard reconfiguration", username)
-	}
-	if err := lm.saveWgRecords(); err != nil {
-		return WGRecord{}, err
+		logger.Verbosef("Extending lease expiry for %s, skipping WireGuard reconfiguration", p.key())
 	}
 	return record, nil
 }
 
-// nextAvailableAddress returns an available IP address within subnet
+// allocateAddress returns the address for a new lease. An address reserved
+// for the user, or failing that for the first of the user's groups that has a
+// reservation, is preferred as long as no other lease holds it. Otherwise the
+// next available address from the pool is returned. If the pool is exhausted
+// and the reclaim policy is configured, the address of the lease with the
+// least recent handshake is reused. The caller must hold wgRecordsMutex.
+func (lm *leaseManager) allocateAddress(p leaseParams) (netip.Addr, error) {
+	if ip, ok := lm.reservedAddress(p); ok {
+		if lm.isLeased(ip) {
+			logger.Verbosef("Reserved address %s for %s is in use, allocating from pool", ip, p.key())
+		} else {
+			return ip, nil
+		}
+	}
+	if ra, ok := lm.recentAddresses[p.key()]; ok {
+		if lm.addressPool().Contains(ra.IP) && !lm.isLeased(ra.IP) {
+			logger.Verbosef("Reusing recent address %s for %s", ra.IP, p.key())
+			return ra.IP, nil
+		}
+	}
+	ip, err := lm.nextAvailableAddress()
+	if errors.Is(err, errAddressPoolExhausted) && lm.poolPolicy == poolExhaustionReclaim {
+		return lm.reclaimAddress()
+	}
+	return ip, err
+}
+
+// reclaimAddress revokes the pool lease whose peer has the least recent
+// handshake, preferring leases that expire sooner on ties, and returns its
+// address. Peers that never completed a handshake are reclaimed first. The
+// caller must hold wgRecordsMutex.
+func (lm *leaseManager) reclaimAddress() (netip.Addr, error) {
+	handshakes, err := lm.lastHandshakes()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w: cannot reclaim a lease: %v", errAddressPoolExhausted, err)
+	}
+	pool := lm.addressPool()
+	var (
+		victim       leaseKey
+		victimRecord WGRecord
+		found        bool
+	)
+	for k, r := range lm.wgRecords {
+		// Leases of reserved addresses do not free up pool addresses.
+		if !pool.Contains(r.IP) {
+			continue
+		}
+		if found {
+			hs, victimHS := handshakes[r.PubKey], handshakes[victimRecord.PubKey]
+			if hs.After(victimHS) || (hs.Equal(victimHS) && !r.expires.Before(victimRecord.expires)) {
+				continue
+			}
+		}
+		victim, victimRecord, found = k, r, true
+	}
+	if !found {
+		return netip.Addr{}, errAddressPoolExhausted
+	}
+	if err := lm.store.Delete(victim); err != nil {
+		return netip.Addr{}, err
+	}
+	delete(lm.wgRecords, victim)
+	ev := newLeaseEvent(leaseEventRevoked, victim, victimRecord)
+	ev.Reason = "address reclaimed for a new lease"
+	lm.audit.record(ev)
+	logger.Verbosef(
+		"Address pool exhausted, reclaimed %s from %s (last handshake: %s)",
+		victimRecord.IP,
+		victim,
+		handshakes[victimRecord.PubKey],
+	)
+	return victimRecord.IP, nil
+}
+
+func (lm *leaseManager) reservedAddress(p leaseParams) (netip.Addr, bool) {
+	if ip, ok := lm.reservations[p.Username]; ok {
+		return ip, true
+	}
+	for _, g := range p.Groups {
+		if ip, ok := lm.reservations[g]; ok {
+			return ip, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// isLeased returns whether the address is held by any lease. The caller must
+// hold wgRecordsMutex.
+func (lm *leaseManager) isLeased(ip netip.Addr) bool {
+	for _, r := range lm.wgRecords {
+		if r.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// addressPool returns the addresses that can be leased from the pool:
 //   - Add the whole subnet
 //   - remove the gateway address
 //   - remove the *first* and *last* address (reserved)
 //     https://en.wikipedia.org/wiki/IPv4#First_and_last_subnet_addresses
-//   - remove all already leased addresses
-//
-// Remaining IPs are "available", get the first one
-func (lm *fileLeaseManager) nextAvailableAddress() netip.Addr {
+//   - remove all statically reserved addresses
+func (lm *leaseManager) addressPool() *netipx.IPSet {
 	var b netipx.IPSetBuilder
 	b.AddPrefix(lm.ipPrefix)
 	b.Remove(lm.ipPrefix.Addr())
 	b.Remove(lm.ipPrefix.Masked().Addr())
 	b.Remove(netipx.PrefixLastIP(lm.ipPrefix))
+	for _, ip := range lm.reservations {
+		b.Remove(ip)
+	}
+	a, _ := b.IPSet()
+	return a
+}
+
+// nextAvailableAddress returns the first address of the pool that is not
+// already leased, or errAddressPoolExhausted if there is none. Addresses
+// remembered for other recently expired leases are only handed out once
+// there are no other free addresses. The caller must hold wgRecordsMutex.
+func (lm *leaseManager) nextAvailableAddress() (netip.Addr, error) {
+	var b netipx.IPSetBuilder
+	b.AddSet(lm.addressPool())
 	for _, r := range lm.wgRecords {
 		b.Remove(r.IP)
 	}
+	free, _ := b.IPSet()
+	for _, ra := range lm.recentAddresses {
+		b.Remove(ra.IP)
+	}
+	a, _ := b.IPSet()
+	if prefixes := a.Prefixes(); len(prefixes) > 0 {
+		return prefixes[0].Addr(), nil
+	}
+	if prefixes := free.Prefixes(); len(prefixes) > 0 {
+		return prefixes[0].Addr(), nil
+	}
+	return netip.Addr{}, fmt.Errorf("%w: no free addresses in %s", errAddressPoolExhausted, lm.ipPrefix)
+}
+
+// allocateAddress6 returns the IPv6 address for a lease, preferring the one
+// remembered for the same user device if it is still free. The caller must
+// hold wgRecordsMutex.
+func (lm *leaseManager) allocateAddress6(key leaseKey) netip.Addr {
+	if ra, ok := lm.recentAddresses[key]; ok && ra.IP6.IsValid() && lm.ip6Prefix.Masked().Contains(ra.IP6) {
+		leased := false
+		for _, r := range lm.wgRecords {
+			if r.IP6 == ra.IP6 {
+				leased = true
+				break
+			}
+		}
+		if !leased {
+			return ra.IP6
+		}
+	}
+	return lm.nextAvailableAddress6()
+}
+
+// rememberAddress records the addresses of an expired lease for reuse until
+// the grace period after expiredAt has passed. The caller must hold
+// wgRecordsMutex.
+func (lm *leaseManager) rememberAddress(key leaseKey, record WGRecord, expiredAt time.Time) {
+	if lm.addressReuseGracePeriod <= 0 || !record.IP.IsValid() {
+		return
+	}
+	lm.recentAddresses[key] = recentAddress{
+		IP:       record.IP,
+		IP6:      record.IP6,
+		deadline: expiredAt.Add(lm.addressReuseGracePeriod),
+	}
+}
+
+// pruneRecentAddresses forgets the addresses whose grace period has passed.
+// The caller must hold wgRecordsMutex.
+func (lm *leaseManager) pruneRecentAddresses(now time.Time) {
+	for k, ra := range lm.recentAddresses {
+		if ra.deadline.Before(now) {
+			delete(lm.recentAddresses, k)
+		}
+	}
+}
+
+// poolStats returns the number of addresses in the pool and how many of them
+// are not leased.
+func (lm *leaseManager) poolStats() (size, free int) {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	pool := lm.addressPool()
+	size = countAddresses(pool)
+	free = size
+	for _, r := range lm.wgRecords {
+		if pool.Contains(r.IP) {
+			free--
+		}
+	}
+	return size, free
+}
+
+// countAddresses returns the number of IPv4 addresses in the set.
+func countAddresses(s *netipx.IPSet) int {
+	n := 0
+	for _, p := range s.Prefixes() {
+		n += 1 << (32 - p.Bits())
+	}
+	return n
+}
+
+// nextAvailableAddress6 returns the first available address in the IPv6
+// range, skipping the server and Subnet-Router anycast addresses and all
+// already leased addresses. Like nextAvailableAddress, it avoids addresses
+// remembered for recently expired leases while others are free. It returns
+// the zero Addr if the range is full.
+func (lm *leaseManager) nextAvailableAddress6() netip.Addr {
+	var b netipx.IPSetBuilder
+	b.AddPrefix(lm.ip6Prefix.Masked())
+	b.Remove(lm.ip6Prefix.Addr())
+	b.Remove(lm.ip6Prefix.Masked().Addr())
+	for _, r := range lm.wgRecords {
+		if r.IP6.IsValid() {
+			b.Remove(r.IP6)
+		}
+	}
+	free, _ := b.IPSet()
+	for _, ra := range lm.recentAddresses {
+		if ra.IP6.IsValid() {
+			b.Remove(ra.IP6)
+		}
+	}
 	a, _ := b.IPSet()
-	return a.Prefixes()[0].Addr()
+	if prefixes := a.Prefixes(); len(prefixes) > 0 {
+		return prefixes[0].Addr()
+	}
+	if prefixes := free.Prefixes(); len(prefixes) > 0 {
+		return prefixes[0].Addr()
+	}
+	logger.Errorf("No IPv6 addresses available in %s", lm.ip6Prefix)
+	return netip.Addr{}
+}
+
+// listLeases returns a copy of all current leases.
+func (lm *leaseManager) listLeases() map[leaseKey]WGRecord {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	records := make(map[leaseKey]WGRecord, len(lm.wgRecords))
+	for k, r := range lm.wgRecords {
+		records[k] = r
+	}
+	return records
+}
+
+// removeLeases deletes all leases for which match returns true from the store
+// and returns them, recording the revocation with the given reason. The caller
+// is responsible for updating the WireGuard peers afterwards.
+func (lm *leaseManager) removeLeases(match func(leaseKey, WGRecord) bool, reason string) (map[leaseKey]WGRecord, error) {
+	lm.wgRecordsMutex.Lock()
+	defer lm.wgRecordsMutex.Unlock()
+	removed := make(map[leaseKey]WGRecord)
+	for k, r := range lm.wgRecords {
+		if !match(k, r) {
+			continue
+		}
+		if err := lm.store.Delete(k); err != nil {
+			return removed, err
+		}
+		delete(lm.wgRecords, k)
+		removed[k] = r
+		ev := newLeaseEvent(leaseEventRevoked, k, r)
+		ev.Reason = reason
+		lm.audit.record(ev)
+	}
+	return removed, nil
+}
+
+// revokeLeases removes all leases for which match returns true and removes
+// their peers from the WireGuard device.
+func (lm *leaseManager) revokeLeases(match func(leaseKey, WGRecord) bool, reason string) (map[leaseKey]WGRecord, error) {
+	removed, err := lm.removeLeases(match, reason)
+	if len(removed) > 0 {
+		for k := range removed {
+			logger.Verbosef("Revoked lease for %s", k)
+		}
+		if uerr := lm.updateWgPeers(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	return removed, err
+}
+
+// revalidateTokens re-validates the tokens that the current leases were
+// granted for and revokes the leases whose tokens are no longer active.
+// Leases are kept if validation fails, for example when the identity provider
+// is unreachable, and leases loaded from stores written by older releases have
+// no token to check until they are renewed.
+func (lm *leaseManager) revalidateTokens(validate func(token string) (*introspectionResponse, error)) error {
+	inactive := make(map[leaseKey]string)
+	for k, r := range lm.listLeases() {
+		if r.token == "" {
+			continue
+		}
+		tokenInfo, err := validate(r.token)
+		if err != nil {
+			logger.Errorf("Cannot re-validate token for %s, keeping lease: %v", k, err)
+			continue
+		}
+		if !tokenInfo.Active {
+			logger.Verbosef("Token for %s is no longer active, revoking lease", k)
+			inactive[k] = r.token
+		}
+	}
+	if len(inactive) == 0 {
+		return nil
+	}
+	// The lease may have been renewed with a new token in the meantime.
+	_, err := lm.revokeLeases(func(k leaseKey, r WGRecord) bool {
+		token, ok := inactive[k]
+		return ok && r.token == token
+	}, "token is no longer active")
+	return err
+}
+
+// reauthorizeLeases checks the current leases against the authorization rules
+// and policies of conf, like lease requests are, so that a config reload
+// applies to existing leases and not only to new and renewed ones. Leases that
+// conf no longer authorizes are revoked, and the granted networks of the
+// others are updated. Tokens are checked with validate. Leases whose token
+// cannot be validated are kept as they are, and so are leases without a token
+// until they are renewed.
+func (lm *leaseManager) reauthorizeLeases(conf *serverConfig, validate func(token string) (*introspectionResponse, error)) error {
+	type grant struct {
+		token    string
+		networks []string
+	}
+	refused := make(map[leaseKey]string)
+	regranted := make(map[leaseKey]grant)
+	for k, r := range lm.listLeases() {
+		if r.token == "" {
+			continue
+		}
+		tokenInfo, err := validate(r.token)
+		if err != nil {
+			logger.Errorf("Cannot validate token for %s, keeping lease: %v", k, err)
+			continue
+		}
+		if !tokenInfo.Active {
+			logger.Verbosef("Token for %s is no longer active, revoking lease", k)
+			refused[k] = r.token
+			continue
+		}
+		if err := authorize(conf, tokenInfo); err != nil {
+			logger.Verbosef("Revoking lease for %s: %v", k, err)
+			refused[k] = r.token
+			continue
+		}
+		networks, ok := grantedNetworks(conf, tokenInfo)
+		if !ok {
+			logger.Verbosef("Revoking lease for %s: no policy grants access to any network", k)
+			refused[k] = r.token
+			continue
+		}
+		if !slices.Equal(networks, r.Networks) {
+			regranted[k] = grant{token: r.token, networks: networks}
+		}
+	}
+
+	// Leases may have been renewed with a new token in the meantime, which
+	// was checked against conf already.
+	lm.wgRecordsMutex.Lock()
+	updated := 0
+	for k, g := range regranted {
+		r, ok := lm.wgRecords[k]
+		if !ok || r.token != g.token {
+			continue
+		}
+		r.Networks = g.networks
+		if err := lm.store.Upsert(k, r); err != nil {
+			lm.wgRecordsMutex.Unlock()
+			return err
+		}
+		lm.wgRecords[k] = r
+		updated++
+		logger.Verbosef("Updated the networks granted to %s", k)
+	}
+	lm.wgRecordsMutex.Unlock()
+	removed, err := lm.removeLeases(func(k leaseKey, r WGRecord) bool {
+		token, ok := refused[k]
+		return ok && r.token == token
+	}, "no longer authorized by the config")
+	for k := range removed {
+		logger.Verbosef("Revoked lease for %s", k)
+	}
+	if updated > 0 || len(removed) > 0 {
+		if uerr := lm.updateWgPeers(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	return err
 }
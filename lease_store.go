@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	leaseStoreFile = "file"
+	leaseStoreBolt = "bolt"
+)
+
+// LeaseStore is the persistence backend for peer address leases, keyed by
+// user and device.
+type LeaseStore interface {
+	// Load reads the persisted leases from the backend.
+	Load() error
+	// Upsert creates or replaces the lease with the given key.
+	Upsert(key leaseKey, record WGRecord) error
+	// Delete removes the lease with the given key, if any.
+	Delete(key leaseKey) error
+	// List returns a copy of all the leases currently held by the store.
+	List() (map[leaseKey]WGRecord, error)
+	// Expire removes all leases that expired before the given time and
+	// returns their keys.
+	Expire(now time.Time) ([]leaseKey, error)
+	// Close releases any resources held by the backend.
+	Close() error
+}
+
+// newLeaseStore returns the LeaseStore implementation selected in the server
+// config.
+func newLeaseStore(cfg *serverConfig) (LeaseStore, error) {
+	if cfg.LeasesFilename == "" {
+		return nil, fmt.Errorf("file name cannot be empty")
+	}
+	logger.Verbosef("leases filename: %s\n", cfg.LeasesFilename)
+	leaseDir := filepath.Dir(cfg.LeasesFilename)
+	if err := os.MkdirAll(leaseDir, 0755); err != nil {
+		logger.Errorf("Unable to create directory=%s", leaseDir)
+		return nil, err
+	}
+	switch cfg.LeaseStore {
+	case leaseStoreFile:
+		return newFileLeaseStore(cfg.LeasesFilename), nil
+	case leaseStoreBolt:
+		return newBoltLeaseStore(cfg.LeasesFilename)
+	default:
+		return nil, fmt.Errorf("unknown lease store %q", cfg.LeaseStore)
+	}
+}
+
+const (
+	leasesFileHeader  = "# wiresteward leases"
+	leasesFileVersion = 7
+	// leasesFileEmptyField is written in place of empty optional fields, so
+	// that lines always carry the same number of fields.
+	leasesFileEmptyField = "-"
+	// leasesFileVersionUnknown is used when the header of the leases file is
+	// malformed. The version of each line is then told by its number of
+	// fields.
+	leasesFileVersionUnknown = -1
+)
+
+// errLeasesFileTooNew is returned when loading a leases file written by a
+// newer release, which may hold leases this one cannot represent.
+var errLeasesFileTooNew = errors.New("leases file is newer than supported")
+
+// fileLeaseStore implements a LeaseStore that keeps leases in memory and
+// rewrites a whitespace-delimited text file on every change.
+//
+// The file is replaced atomically: records are written to a temporary file
+// which is synced and then renamed over the previous generation, a copy of
+// which is kept as a backup. Lines that cannot be parsed on load are moved to
+// a quarantine file rather than failing the load.
+type fileLeaseStore struct {
+	filename       string
+	wgRecords      map[leaseKey]WGRecord
+	wgRecordsMutex sync.Mutex
+}
+
+func newFileLeaseStore(filename string) *fileLeaseStore {
+	return &fileLeaseStore{
+		filename:  filename,
+		wgRecords: make(map[leaseKey]WGRecord),
+	}
+}
+
+func (fs *fileLeaseStore) backupFilename() string {
+	return fs.filename + ".bak"
+}
+
+func (fs *fileLeaseStore) quarantineFilename() string {
+	return fs.filename + ".quarantine"
+}
+
+// Load implements LeaseStore. If the leases file does not exist, the backup
+// of the previous generation is loaded instead, if present. If any lines are
+// quarantined, the file is saved again without them.
+func (fs *fileLeaseStore) Load() error {
+	fs.wgRecordsMutex.Lock()
+	defer fs.wgRecordsMutex.Unlock()
+
+	fs.wgRecords = make(map[leaseKey]WGRecord)
+
+	r, err := os.Open(fs.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		r, err = os.Open(fs.backupFilename())
+		if err == nil {
+			logger.Errorf("leases file missing, loading backup %s", fs.backupFilename())
+		}
+	}
+	if err != nil {
+		logger.Errorf("unable to open leases file: %v", err)
+		return nil
+	}
+	defer r.Close()
+
+	quarantined := 0
+	version := 0
+	n := 0
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		n++
+		line := sc.Text()
+		if len(line) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if strings.HasPrefix(line, leasesFileHeader) {
+				v, err := parseLeasesFileHeader(line)
+				if errors.Is(err, errLeasesFileTooNew) {
+					return err
+				}
+				if err != nil {
+					logger.Errorf("Quarantining leases file header, telling versions by the number of fields: %v", err)
+					if err := fs.quarantine(n, line, err); err != nil {
+						logger.Errorf("Cannot write to quarantine file: %v", err)
+					}
+					leaseFileMalformedLines.Inc()
+					quarantined++
+					v = leasesFileVersionUnknown
+				}
+				version = v
+			}
+			continue
+		}
+		key, record, err := parseWGRecordLine(version, line)
+		if err != nil {
+			logger.Errorf("Quarantining malformed line %d in leases file: %v", n, err)
+			if err := fs.quarantine(n, line, err); err != nil {
+				logger.Errorf("Cannot write to quarantine file: %v", err)
+			}
+			leaseFileMalformedLines.Inc()
+			quarantined++
+			continue
+		}
+		fs.wgRecords[key] = record
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("error reading leases file: %w", err)
+	}
+	// Rewrite the file without the quarantined lines, so that they are not
+	// quarantined again on every start until a lease changes.
+	if quarantined > 0 {
+		if err := fs.save(); err != nil {
+			logger.Errorf("Cannot rewrite leases file without the quarantined lines: %v", err)
+		}
+	}
+
+	logger.Verbosef(
+		"records loaded, version=%d records=%d quarantined=%d",
+		version,
+		len(fs.wgRecords),
+		quarantined,
+	)
+	return nil
+}
+
+// parseLeasesFileHeader returns the format version from a header line of the
+// form "# wiresteward leases v<version>". Files written by older releases do
+// not carry a header and are treated as version 0, which shares the format of
+// version 1.
+func parseLeasesFileHeader(line string) (int, error) {
+	var version int
+	if _, err := fmt.Sscanf(line, leasesFileHeader+" v%d", &version); err != nil {
+		return 0, fmt.Errorf("malformed leases file header %q: %w", line, err)
+	}
+	if version > leasesFileVersion {
+		return 0, fmt.Errorf(
+			"%w: version %d, supported version %d",
+			errLeasesFileTooNew,
+			version,
+			leasesFileVersion,
+		)
+	}
+	return version, nil
+}
+
+// parseWGRecordLine parses a single lease line of the form
+// "<username> <public key> <ip> <expiry> <device id> <hostname> <ipv6>
+// <networks> <preshared key> <token>", where networks is a comma separated
+// list. Versions prior to 2 do not carry the device id and hostname fields,
+// versions prior to 3 do not carry the IPv6 address field, versions prior to 4
+// do not carry the networks field, versions prior to 5 do not carry the
+// preshared key field and versions prior to 7 do not carry the token field.
+// From version 6 the username is escaped by escapeLeasesFileField, and so is
+// the token. If the version is unknown, it is told by the number of fields.
+func parseWGRecordLine(version int, line string) (leaseKey, WGRecord, error) {
+	tokens := strings.Fields(line)
+	if version == leasesFileVersionUnknown {
+		version = leasesFileVersionForFields(len(tokens))
+	}
+	want := leasesFileFields(version)
+	if len(tokens) != want {
+		return leaseKey{}, WGRecord{}, fmt.Errorf("malformed line, want %d fields, got %d", want, len(tokens))
+	}
+	ipaddr, err := netip.ParseAddr(tokens[2])
+	if err != nil {
+		return leaseKey{}, WGRecord{}, fmt.Errorf("invalid ip address: %w", err)
+	}
+	expires, err := time.Parse(time.RFC3339, tokens[3])
+	if err != nil {
+		return leaseKey{}, WGRecord{}, fmt.Errorf("expected time of expiry in RFC3339 format, got: %v", tokens[3])
+	}
+	key := leaseKey{Username: tokens[0]}
+	if version >= 6 {
+		if key.Username, err = url.PathUnescape(tokens[0]); err != nil {
+			return leaseKey{}, WGRecord{}, fmt.Errorf("invalid username: %w", err)
+		}
+	}
+	record := WGRecord{
+		PubKey:  tokens[1],
+		IP:      ipaddr,
+		expires: expires,
+	}
+	if version >= 2 {
+		key.DeviceID = parseLeasesFileField(tokens[4])
+		record.Hostname = parseLeasesFileField(tokens[5])
+	}
+	if version >= 3 {
+		if ip6 := parseLeasesFileField(tokens[6]); ip6 != "" {
+			record.IP6, err = netip.ParseAddr(ip6)
+			if err != nil {
+				return leaseKey{}, WGRecord{}, fmt.Errorf("invalid ipv6 address: %w", err)
+			}
+		}
+	}
+	if version >= 4 {
+		if networks := parseLeasesFileField(tokens[7]); networks != "" {
+			record.Networks = strings.Split(networks, ",")
+		}
+	}
+	if version >= 5 {
+		record.PresharedKey = parseLeasesFileField(tokens[8])
+	}
+	if version >= 7 {
+		if record.token, err = url.PathUnescape(parseLeasesFileField(tokens[9])); err != nil {
+			return leaseKey{}, WGRecord{}, fmt.Errorf("invalid token: %w", err)
+		}
+	}
+	return key, record, nil
+}
+
+// leasesFileFields returns the number of fields of the lines of a version.
+func leasesFileFields(version int) int {
+	switch {
+	case version < 2:
+		return 4
+	case version < 3:
+		return 6
+	case version < 4:
+		return 7
+	case version < 5:
+		return 8
+	case version < 7:
+		return 9
+	}
+	return 10
+}
+
+// leasesFileVersionForFields returns the newest version whose lines have n
+// fields, or the current version if there is none.
+func leasesFileVersionForFields(n int) int {
+	for v := leasesFileVersion; v >= 0; v-- {
+		if leasesFileFields(v) == n {
+			return v
+		}
+	}
+	return leasesFileVersion
+}
+
+// formatWGRecordLine returns the leases file line for the given lease.
+func formatWGRecordLine(key leaseKey, record WGRecord) string {
+	return strings.Join([]string{
+		escapeLeasesFileField(key.Username),
+		record.String(),
+		formatLeasesFileField(key.DeviceID),
+		formatLeasesFileField(record.Hostname),
+		formatLeasesFileField(formatAddr(record.IP6)),
+		formatLeasesFileField(strings.Join(record.Networks, ",")),
+		formatLeasesFileField(record.PresharedKey),
+		formatLeasesFileField(escapeLeasesFileField(record.token)),
+	}, " ")
+}
+
+// formatAddr returns the string representation of an address, or the empty
+// string for the zero Addr.
+func formatAddr(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
+	}
+	return ip.String()
+}
+
+func parseLeasesFileField(f string) string {
+	if f == leasesFileEmptyField {
+		return ""
+	}
+	return f
+}
+
+func formatLeasesFileField(f string) string {
+	if f == "" {
+		return leasesFileEmptyField
+	}
+	return f
+}
+
+// escapeLeasesFileField percent-encodes the characters of f that would break
+// up the fields of a line, so that fields taken from tokens cannot inject
+// lines. The result is decoded with url.PathUnescape.
+func escapeLeasesFileField(f string) string {
+	var b strings.Builder
+	for i := 0; i < len(f); {
+		r, size := utf8.DecodeRuneInString(f[i:])
+		if r == '%' || r == utf8.RuneError || unicode.IsSpace(r) || unicode.IsControl(r) {
+			for _, c := range []byte(f[i : i+size]) {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		} else {
+			b.WriteString(f[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// quarantine appends a malformed line, preceded by a comment describing why
+// it was rejected, to the quarantine file.
+func (fs *fileLeaseStore) quarantine(n int, line string, reason error) error {
+	f, err := os.OpenFile(fs.quarantineFilename(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(
+		f,
+		"# %s line %d: %v\n%s\n",
+		time.Now().Format(time.RFC3339),
+		n,
+		reason,
+		line,
+	)
+	return err
+}
+
+// Upsert implements LeaseStore.
+func (fs *fileLeaseStore) Upsert(key leaseKey, record WGRecord) error {
+	fs.wgRecordsMutex.Lock()
+	defer fs.wgRecordsMutex.Unlock()
+	fs.wgRecords[key] = record
+	return fs.save()
+}
+
+// Delete implements LeaseStore.
+func (fs *fileLeaseStore) Delete(key leaseKey) error {
+	fs.wgRecordsMutex.Lock()
+	defer fs.wgRecordsMutex.Unlock()
+	if _, ok := fs.wgRecords[key]; !ok {
+		return nil
+	}
+	delete(fs.wgRecords, key)
+	return fs.save()
+}
+
+// List implements LeaseStore.
+func (fs *fileLeaseStore) List() (map[leaseKey]WGRecord, error) {
+	fs.wgRecordsMutex.Lock()
+	defer fs.wgRecordsMutex.Unlock()
+	records := make(map[leaseKey]WGRecord, len(fs.wgRecords))
+	for k, r := range fs.wgRecords {
+		records[k] = r
+	}
+	return records, nil
+}
+
+// Expire implements LeaseStore.
+func (fs *fileLeaseStore) Expire(now time.Time) ([]leaseKey, error) {
+	fs.wgRecordsMutex.Lock()
+	defer fs.wgRecordsMutex.Unlock()
+	expired := []leaseKey{}
+	for k, r := range fs.wgRecords {
+		if r.expires.Before(now) {
+			delete(fs.wgRecords, k)
+			expired = append(expired, k)
+		}
+	}
+	if len(expired) == 0 {
+		return expired, nil
+	}
+	return expired, fs.save()
+}
+
+// Close implements LeaseStore.
+func (fs *fileLeaseStore) Close() error {
+	return nil
+}
+
+// save writes all records to the leases file. The caller must hold
+// wgRecordsMutex.
+func (fs *fileLeaseStore) save() error {
+	dir := filepath.Dir(fs.filename)
+	f, err := os.CreateTemp(dir, filepath.Base(fs.filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpFilename := f.Name()
+	defer os.Remove(tmpFilename)
+	if err := fs.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// Leases may hold preshared keys, so keep them private.
+	if err := os.Chmod(tmpFilename, 0600); err != nil {
+		return err
+	}
+	// Keep the previous generation around as a backup. This is best effort
+	// and should not prevent the new records from being written.
+	if err := os.Remove(fs.backupFilename()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Errorf("Cannot remove leases backup file: %v", err)
+	}
+	if err := os.Link(fs.filename, fs.backupFilename()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Errorf("Cannot back up leases file: %v", err)
+	}
+	if err := os.Rename(tmpFilename, fs.filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func (fs *fileLeaseStore) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "%s v%d\n", leasesFileHeader, leasesFileVersion); err != nil {
+		return err
+	}
+	for key, record := range fs.wgRecords {
+		if _, err := fmt.Fprintln(bw, formatWGRecordLine(key, record)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// syncDir flushes a directory, making any preceding renames in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
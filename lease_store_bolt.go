@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+var boltLeasesBucket = []byte("leases")
+
+// boltRecord is the on-disk representation of a WGRecord in the bolt store.
+type boltRecord struct {
+	Username     string     `json:"username"`
+	DeviceID     string     `json:"deviceID"`
+	Hostname     string     `json:"hostname"`
+	PubKey       string     `json:"pubKey"`
+	PresharedKey string     `json:"presharedKey,omitempty"`
+	IP           netip.Addr `json:"ip"`
+	IP6          netip.Addr `json:"ip6"`
+	Networks     []string   `json:"networks,omitempty"`
+	Expires      time.Time  `json:"expires"`
+	Token        string     `json:"token,omitempty"`
+}
+
+func newBoltRecord(k leaseKey, r WGRecord) boltRecord {
+	return boltRecord{
+		Username:     k.Username,
+		DeviceID:     k.DeviceID,
+		Hostname:     r.Hostname,
+		PubKey:       r.PubKey,
+		PresharedKey: r.PresharedKey,
+		IP:           r.IP,
+		IP6:          r.IP6,
+		Networks:     r.Networks,
+		Expires:      r.expires,
+		Token:        r.token,
+	}
+}
+
+func (br boltRecord) leaseKey() leaseKey {
+	return leaseKey{Username: br.Username, DeviceID: br.DeviceID}
+}
+
+func (br boltRecord) wgRecord() WGRecord {
+	return WGRecord{
+		PubKey:       br.PubKey,
+		PresharedKey: br.PresharedKey,
+		IP:           br.IP,
+		IP6:          br.IP6,
+		Hostname:     br.Hostname,
+		Networks:     br.Networks,
+		expires:      br.Expires,
+		token:        br.Token,
+	}
+}
+
+// boltKey returns the database key for a lease. The NUL separator cannot
+// appear in usernames or device IDs.
+func boltKey(k leaseKey) []byte {
+	return []byte(k.Username + "\x00" + k.DeviceID)
+}
+
+// decodeBoltRecord decodes a database value. Records written before leases
+// were keyed by device only carry the username in their key.
+func decodeBoltRecord(k, v []byte) (boltRecord, error) {
+	br := boltRecord{}
+	if err := json.Unmarshal(v, &br); err != nil {
+		return boltRecord{}, fmt.Errorf("cannot decode lease for %q: %w", k, err)
+	}
+	if br.Username == "" {
+		br.Username = string(k)
+	}
+	return br, nil
+}
+
+// boltLeaseStore implements a LeaseStore backed by an embedded bbolt
+// database. Every change is committed in its own transaction, so a crash
+// can never leave a partially written lease behind.
+type boltLeaseStore struct {
+	db *bolt.DB
+}
+
+func newBoltLeaseStore(filename string) (*boltLeaseStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, berrors.ErrInvalid) {
+		return nil, fmt.Errorf(
+			"cannot open leases database: %s is not a bolt database, if it is the leases file of the `file` store set `leasesFilename` to a new path for the `bolt` store: %w",
+			filename, err,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open leases database: %w", err)
+	}
+	return &boltLeaseStore{db: db}, nil
+}
+
+// Load implements LeaseStore. Records written before leases were keyed by
+// device are moved to the key of their lease, so that they are replaced and
+// deleted like any other.
+func (bs *boltLeaseStore) Load() error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltLeasesBucket)
+		if err != nil {
+			return err
+		}
+		legacy := map[string]boltRecord{}
+		if err := b.ForEach(func(k, v []byte) error {
+			if bytes.IndexByte(k, 0) >= 0 {
+				return nil
+			}
+			br, err := decodeBoltRecord(k, v)
+			if err != nil {
+				return err
+			}
+			legacy[string(k)] = br
+			return nil
+		}); err != nil {
+			return err
+		}
+		// Keys are changed after iterating, as modifying a bucket during
+		// ForEach is not supported.
+		for k, br := range legacy {
+			// A lease renewed since holds the current record already.
+			if b.Get(boltKey(br.leaseKey())) == nil {
+				v, err := json.Marshal(br)
+				if err != nil {
+					return err
+				}
+				if err := b.Put(boltKey(br.leaseKey()), v); err != nil {
+					return err
+				}
+			}
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		if len(legacy) > 0 {
+			logger.Verbosef("Migrated %d leases to per device keys", len(legacy))
+		}
+		return nil
+	})
+}
+
+// Upsert implements LeaseStore.
+func (bs *boltLeaseStore) Upsert(key leaseKey, record WGRecord) error {
+	v, err := json.Marshal(newBoltRecord(key, record))
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLeasesBucket).Put(boltKey(key), v)
+	})
+}
+
+// Delete implements LeaseStore.
+func (bs *boltLeaseStore) Delete(key leaseKey) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLeasesBucket).Delete(boltKey(key))
+	})
+}
+
+// List implements LeaseStore.
+func (bs *boltLeaseStore) List() (map[leaseKey]WGRecord, error) {
+	records := make(map[leaseKey]WGRecord)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLeasesBucket).ForEach(func(k, v []byte) error {
+			br, err := decodeBoltRecord(k, v)
+			if err != nil {
+				return err
+			}
+			records[br.leaseKey()] = br.wgRecord()
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Expire implements LeaseStore.
+func (bs *boltLeaseStore) Expire(now time.Time) ([]leaseKey, error) {
+	expired := []leaseKey{}
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltLeasesBucket)
+		dbKeys := [][]byte{}
+		if err := b.ForEach(func(k, v []byte) error {
+			br, err := decodeBoltRecord(k, v)
+			if err != nil {
+				return err
+			}
+			if br.Expires.Before(now) {
+				expired = append(expired, br.leaseKey())
+				dbKeys = append(dbKeys, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		// Keys are deleted after iterating, as modifying a bucket during
+		// ForEach is not supported.
+		for _, k := range dbKeys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// Close implements LeaseStore.
+func (bs *boltLeaseStore) Close() error {
+	return bs.db.Close()
+}
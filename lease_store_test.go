@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestLeaseStores(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	stores := map[string]func(filename string) (LeaseStore, error){
+		leaseStoreFile: func(filename string) (LeaseStore, error) {
+			return newFileLeaseStore(filename), nil
+		},
+		leaseStoreBolt: func(filename string) (LeaseStore, error) {
+			return newBoltLeaseStore(filename)
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "leases")
+			store, err := newStore(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Load(); err != nil {
+				t.Fatal(err)
+			}
+
+			now := time.Now().Truncate(time.Second)
+			r1 := WGRecord{
+				PubKey:  "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+				IP:      netip.MustParseAddr("10.90.0.2"),
+				expires: now.Add(time.Hour),
+			}
+			r2 := WGRecord{
+				PubKey:       "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=",
+				PresharedKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+				IP:           netip.MustParseAddr("10.90.0.3"),
+				IP6:          netip.MustParseAddr("fd00:10::3"),
+				Hostname:     "laptop.example.com",
+				Networks:     []string{"10.1.0.0/16", "10.90.0.1/32"},
+				expires:      now.Add(-time.Hour),
+				token:        "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJ1c2VyMiJ9.c2ln",
+			}
+			r3 := WGRecord{
+				PubKey:  "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=",
+				IP:      netip.MustParseAddr("10.90.0.4"),
+				expires: now.Add(-time.Minute),
+			}
+			k1 := leaseKey{Username: "user1"}
+			k2 := leaseKey{Username: "user2", DeviceID: "device-a"}
+			k3 := leaseKey{Username: "user2", DeviceID: "device-b"}
+			for k, r := range map[leaseKey]WGRecord{k1: r1, k2: r2, k3: r3} {
+				if err := store.Upsert(k, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Upsert replaces existing records.
+			r1.expires = now.Add(2 * time.Hour)
+			if err := store.Upsert(k1, r1); err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 3, len(records))
+			assert.True(t, r1.expires.Equal(records[k1].expires))
+			assert.Equal(t, r1.IP, records[k1].IP)
+
+			expired, err := store.Expire(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(expired, func(i, j int) bool {
+				return expired[i].String() < expired[j].String()
+			})
+			assert.Equal(t, []leaseKey{k2, k3}, expired)
+
+			if err := store.Delete(k1); err != nil {
+				t.Fatal(err)
+			}
+			// Deleting a missing record is not an error.
+			if err := store.Delete(k1); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Upsert(k2, r2); err != nil {
+				t.Fatal(err)
+			}
+
+			// State must survive reopening the store.
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			store, err = newStore(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if err := store.Load(); err != nil {
+				t.Fatal(err)
+			}
+			records, err = store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 1, len(records))
+			assert.Equal(t, r2.PubKey, records[k2].PubKey)
+			assert.Equal(t, r2.PresharedKey, records[k2].PresharedKey)
+			assert.Equal(t, r2.IP, records[k2].IP)
+			assert.Equal(t, r2.IP6, records[k2].IP6)
+			assert.Equal(t, r2.Networks, records[k2].Networks)
+			assert.Equal(t, r2.Hostname, records[k2].Hostname)
+			assert.True(t, r2.expires.Equal(records[k2].expires))
+			assert.Equal(t, r2.token, records[k2].token)
+		})
+	}
+}
+
+func TestFileLeaseStore_load(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "leases")
+	// A file written by an older release, without a header, containing a
+	// couple of corrupted lines.
+	legacy := `a@example.com k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY= 10.90.0.2 2030-01-01T00:00:00Z
+b@example.com E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo= 10.90.0.x 2030-01-01T00:00:00Z
+c@example.com NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00= 10.90.0.4
+
+d@example.com NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00= 10.90.0.5 2030-01-01T00:00:00Z
+`
+	if err := os.WriteFile(filename, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(leaseFileMalformedLines)
+	fs := newFileLeaseStore(filename)
+	if err := fs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	records, err := fs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, netip.MustParseAddr("10.90.0.2"), records[leaseKey{Username: "a@example.com"}].IP)
+	assert.Equal(t, netip.MustParseAddr("10.90.0.5"), records[leaseKey{Username: "d@example.com"}].IP)
+	assert.Equal(t, float64(2), testutil.ToFloat64(leaseFileMalformedLines)-before)
+	quarantined, err := os.ReadFile(fs.quarantineFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(quarantined), "b@example.com")
+	assert.Contains(t, string(quarantined), "c@example.com")
+
+	// The file is saved again without the quarantined lines, with a
+	// versioned header, keeping the previous generation.
+	saved, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(string(saved), fmt.Sprintf("%s v%d\n", leasesFileHeader, leasesFileVersion)))
+	assert.NotContains(t, string(saved), "b@example.com")
+	assert.NotContains(t, string(saved), "c@example.com")
+	backup, err := os.ReadFile(fs.backupFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, legacy, string(backup))
+
+	// Loading again quarantines nothing new.
+	if err := fs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	requarantined, err := os.ReadFile(fs.quarantineFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(quarantined), string(requarantined))
+	assert.Equal(t, float64(2), testutil.ToFloat64(leaseFileMalformedLines)-before)
+
+	// Saving keeps the previous generation.
+	if err := fs.Delete(leaseKey{Username: "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	backup, err = os.ReadFile(fs.backupFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(saved), string(backup))
+	// No temporary files should be left behind.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, len(entries))
+
+	// The backup is loaded when the leases file is missing.
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	records, err = fs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(records))
+
+	// Files written by a newer release must not be loaded.
+	newer := fmt.Sprintf("%s v%d\n", leasesFileHeader, leasesFileVersion+1)
+	if err := os.WriteFile(filename, []byte(newer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, fs.Load())
+}
+
+func TestFileLeaseStore_loadMalformedHeader(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	filename := filepath.Join(t.TempDir(), "leases")
+	content := leasesFileHeader + ` vfive
+a@example.com k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY= 10.90.0.2 2030-01-01T00:00:00Z laptop host - - -
+b@example.com E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo= 10.90.0.3 2030-01-01T00:00:00Z
+`
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := newFileLeaseStore(filename)
+	if err := fs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	records, err := fs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "host", records[leaseKey{Username: "a@example.com", DeviceID: "laptop"}].Hostname)
+	assert.Equal(t, netip.MustParseAddr("10.90.0.3"), records[leaseKey{Username: "b@example.com"}].IP)
+	quarantined, err := os.ReadFile(fs.quarantineFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(quarantined), "vfive")
+}
+
+func TestBoltLeaseStore_legacyKeys(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	filename := filepath.Join(t.TempDir(), "leases.db")
+	bs, err := newBoltLeaseStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records written before leases were keyed by device carry the
+	// username in their key only.
+	if err := bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltLeasesBucket)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("a@example.com"), []byte(`{"pubKey": "old", "ip": "10.90.0.2", "ip6": "", "expires": "2030-01-01T00:00:00Z"}`)); err != nil {
+			return err
+		}
+		// One that was renewed since, and has a current record too.
+		if err := b.Put([]byte("b@example.com"), []byte(`{"pubKey": "old", "ip": "10.90.0.3", "ip6": "", "expires": "2030-01-01T00:00:00Z"}`)); err != nil {
+			return err
+		}
+		return b.Put(boltKey(leaseKey{Username: "b@example.com"}), []byte(`{"username": "b@example.com", "pubKey": "new", "ip": "10.90.0.3", "ip6": "", "expires": "2030-01-01T00:00:00Z"}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	records, err := bs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "old", records[leaseKey{Username: "a@example.com"}].PubKey)
+	assert.Equal(t, "new", records[leaseKey{Username: "b@example.com"}].PubKey)
+
+	// Migrated leases are deleted for good.
+	if err := bs.Delete(leaseKey{Username: "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	records, err = bs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(records))
+	assert.NoError(t, bs.Close())
+}
+
+func TestBoltLeaseStore_fileStoreLeases(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases")
+	if err := os.WriteFile(filename, []byte(leasesFileHeader+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := newBoltLeaseStore(filename)
+	assert.ErrorContains(t, err, "is not a bolt database")
+}
+
+func TestWGRecordLine_escapedUsername(t *testing.T) {
+	key := leaseKey{Username: "corp/a b\n%20", DeviceID: "laptop"}
+	record := WGRecord{
+		PubKey:  "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+		IP:      netip.MustParseAddr("10.90.0.2"),
+		expires: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	line := formatWGRecordLine(key, record)
+	assert.Equal(t, "corp/a%20b%0A%2520", strings.Fields(line)[0])
+	parsedKey, parsed, err := parseWGRecordLine(leasesFileVersion, line)
+	if assert.NoError(t, err) {
+		assert.Equal(t, key, parsedKey)
+		assert.Equal(t, record.IP, parsed.IP)
+	}
+
+	// Usernames of older versions are not escaped.
+	parsedKey, _, err = parseWGRecordLine(5, strings.Join(strings.Fields(line)[:leasesFileFields(5)], " "))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "corp/a%20b%0A%2520", parsedKey.Username)
+	}
+	_, _, err = parseWGRecordLine(leasesFileVersion, strings.Replace(line, "%20b", "%zzb", 1))
+	assert.ErrorContains(t, err, "invalid username")
+}
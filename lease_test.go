@@ -3,26 +3,31 @@ package main
 import (
 	"fmt"
 	"net/netip"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func TestFileLeaseManager_createOrUpdatePeer(t *testing.T) {
+func TestLeaseManager_createOrUpdatePeer(t *testing.T) {
 	ipPrefix := netip.MustParsePrefix("10.90.0.1/20")
-	lm := &fileLeaseManager{
-		wgRecords: map[string]WGRecord{},
+	store := newFileLeaseStore(filepath.Join(t.TempDir(), "leases"))
+	lm := &leaseManager{
+		wgRecords: map[leaseKey]WGRecord{},
 		ipPrefix:  ipPrefix,
+		store:     store,
 	}
 	testPubKey1 := "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY="
 	testPubKey2 := "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo="
 	testUsername := "test@example.com"
+	testKey := leaseKey{Username: testUsername}
 	testExpiry := time.Unix(0, 0)
 
 	// New peer: lm.ip (subnet address) must be skipped; needToUpdateWGPeers
 	// must be true so the interface is configured for the first time.
-	record, needsUpdate, err := lm.createOrUpdatePeer(testUsername, testPubKey1, testExpiry)
+	record, needsUpdate, err := lm.createOrUpdatePeer(leaseParams{Username: testUsername, PubKey: testPubKey1, Expiry: testExpiry})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -31,41 +36,641 @@ func TestFileLeaseManager_createOrUpdatePeer(t *testing.T) {
 	}
 	assert.True(t, needsUpdate, "new peer should require a WireGuard config update")
 	assert.Equal(t, 1, len(lm.wgRecords))
-	assert.Equal(t, testPubKey1, lm.wgRecords[testUsername].PubKey)
+	assert.Equal(t, testPubKey1, lm.wgRecords[testKey].PubKey)
 
 	// Same public key: only the expiry changes, no interface reconfiguration
 	// needed (needToUpdateWGPeers must be false).
 	newExpiry := time.Unix(9999, 0)
-	record1b, needsUpdate, err := lm.createOrUpdatePeer(testUsername, testPubKey1, newExpiry)
+	record1b, needsUpdate, err := lm.createOrUpdatePeer(leaseParams{Username: testUsername, PubKey: testPubKey1, Expiry: newExpiry})
 	if err != nil {
 		t.Fatal(err)
 	}
 	assert.False(t, needsUpdate, "expiry-only renewal should not require a WireGuard config update")
 	assert.Equal(t, 1, len(lm.wgRecords))
-	assert.Equal(t, testPubKey1, lm.wgRecords[testUsername].PubKey)
-	assert.Equal(t, newExpiry, lm.wgRecords[testUsername].expires)
+	assert.Equal(t, testPubKey1, lm.wgRecords[testKey].PubKey)
+	assert.Equal(t, newExpiry, lm.wgRecords[testKey].expires)
 	if record.IP.Compare(record1b.IP) != 0 {
 		t.Fatalf("Expected the same ip address on expiry-only renewal, got %v", record1b.IP)
 	}
 
 	// Different public key: record is updated in place (same IP) and
 	// needToUpdateWGPeers must be true so the interface reflects the new key.
-	record2, needsUpdate, err := lm.createOrUpdatePeer(testUsername, testPubKey2, testExpiry)
+	record2, needsUpdate, err := lm.createOrUpdatePeer(leaseParams{Username: testUsername, PubKey: testPubKey2, Expiry: testExpiry})
 	if err != nil {
 		t.Fatal(err)
 	}
 	assert.True(t, needsUpdate, "pubkey change should require a WireGuard config update")
 	assert.Equal(t, 1, len(lm.wgRecords))
-	assert.Equal(t, testPubKey2, lm.wgRecords[testUsername].PubKey)
+	assert.Equal(t, testPubKey2, lm.wgRecords[testKey].PubKey)
 	if record.IP.Compare(record2.IP) != 0 {
 		t.Fatalf("Expected the same ip address for the same user, got %v", record2.IP)
 	}
 
+	// Every change must be persisted to the store.
+	stored, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, lm.wgRecords, stored)
+
 	// Empty username must error.
-	_, _, err = lm.createOrUpdatePeer("", testPubKey2, testExpiry)
+	_, _, err = lm.createOrUpdatePeer(leaseParams{PubKey: testPubKey2, Expiry: testExpiry})
 	assert.Equal(t, err, fmt.Errorf("Cannot add peer for empty username"))
 }
 
+func TestLeaseManager_multipleDevices(t *testing.T) {
+	lm := &leaseManager{
+		wgRecords:         map[leaseKey]WGRecord{},
+		ipPrefix:          netip.MustParsePrefix("10.90.0.1/20"),
+		maxDevicesPerUser: 2,
+		store:             newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+	}
+	testExpiry := time.Unix(9999, 0)
+	laptop := leaseParams{
+		Username: "test@example.com",
+		DeviceID: "laptop",
+		Hostname: "laptop.example.com",
+		PubKey:   "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+		Expiry:   testExpiry,
+	}
+	desktop := leaseParams{
+		Username: "test@example.com",
+		DeviceID: "desktop",
+		PubKey:   "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=",
+		Expiry:   testExpiry,
+	}
+
+	// Each device of the same user gets its own lease.
+	r1, _, err := lm.createOrUpdatePeer(laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, needsUpdate, err := lm.createOrUpdatePeer(desktop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, needsUpdate, "new device should require a WireGuard config update")
+	assert.Equal(t, 2, len(lm.wgRecords))
+	assert.NotEqual(t, r1.IP, r2.IP)
+	assert.Equal(t, laptop.PubKey, lm.wgRecords[laptop.key()].PubKey)
+	assert.Equal(t, "laptop.example.com", lm.wgRecords[laptop.key()].Hostname)
+	assert.Equal(t, desktop.PubKey, lm.wgRecords[desktop.key()].PubKey)
+
+	// Renewing an existing device is not affected by the limit.
+	_, needsUpdate, err = lm.createOrUpdatePeer(laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, needsUpdate)
+
+	// A third device exceeds the limit.
+	_, _, err = lm.createOrUpdatePeer(leaseParams{
+		Username: "test@example.com",
+		DeviceID: "tablet",
+		PubKey:   "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=",
+		Expiry:   testExpiry,
+	})
+	assert.ErrorIs(t, err, errDeviceLimitReached)
+	assert.Equal(t, 2, len(lm.wgRecords))
+}
+
+func TestLeaseManager_reservations(t *testing.T) {
+	lm := &leaseManager{
+		wgRecords: map[leaseKey]WGRecord{},
+		ipPrefix:  netip.MustParsePrefix("10.90.0.1/20"),
+		reservations: map[string]netip.Addr{
+			"oncall@example.com": netip.MustParseAddr("10.90.0.2"),
+			"sre":                netip.MustParseAddr("10.90.0.10"),
+		},
+		store: newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+	}
+	testExpiry := time.Unix(9999, 0)
+
+	// Reserved addresses are skipped when allocating from the pool.
+	r, _, err := lm.createOrUpdatePeer(leaseParams{
+		Username: "dev@example.com",
+		PubKey:   "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+		Expiry:   testExpiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.90.0.3"), r.IP)
+
+	// User reservations take precedence over group reservations.
+	r, _, err = lm.createOrUpdatePeer(leaseParams{
+		Username: "oncall@example.com",
+		Groups:   []string{"sre"},
+		DeviceID: "laptop",
+		PubKey:   "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=",
+		Expiry:   testExpiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.90.0.2"), r.IP)
+
+	// A reserved address already in use falls back to the pool.
+	r, _, err = lm.createOrUpdatePeer(leaseParams{
+		Username: "oncall@example.com",
+		Groups:   []string{"sre"},
+		DeviceID: "desktop",
+		PubKey:   "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=",
+		Expiry:   testExpiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.90.0.4"), r.IP)
+
+	// Group reservations apply to members.
+	r, _, err = lm.createOrUpdatePeer(leaseParams{
+		Username: "sre@example.com",
+		Groups:   []string{"everyone", "sre"},
+		PubKey:   "f8uJJbPUlSU5cD5v0N1YJ2nU4CbUI1KpUzR2d6T2UVc=",
+		Expiry:   testExpiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.90.0.10"), r.IP)
+}
+
+func TestLeaseManager_presharedKeys(t *testing.T) {
+	lm := &leaseManager{
+		wgRecords:     map[leaseKey]WGRecord{},
+		ipPrefix:      netip.MustParsePrefix("10.90.0.1/20"),
+		presharedKeys: true,
+		store:         newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+	}
+	p := leaseParams{
+		Username: "a@example.com",
+		PubKey:   "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+		Expiry:   time.Unix(9999, 0),
+	}
+	r1, needsUpdate, err := lm.createOrUpdatePeer(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, needsUpdate)
+	assert.NotEmpty(t, r1.PresharedKey)
+
+	// Renewals keep the key, so the peer does not need updating.
+	r2, needsUpdate, err := lm.createOrUpdatePeer(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, needsUpdate)
+	assert.Equal(t, r1.PresharedKey, r2.PresharedKey)
+
+	// Until the key is due for rotation.
+	r2.presharedKeyCreated = r2.presharedKeyCreated.Add(-presharedKeyRotationInterval)
+	lm.wgRecords[p.key()] = r2
+	r2, needsUpdate, err = lm.createOrUpdatePeer(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, needsUpdate)
+	assert.NotEmpty(t, r2.PresharedKey)
+	assert.NotEqual(t, r1.PresharedKey, r2.PresharedKey)
+	assert.Equal(t, r1.IP, r2.IP)
+	stored, err := lm.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, r2.PresharedKey, stored[p.key()].PresharedKey)
+
+	// A new public key gets a new preshared key straight away.
+	p.PubKey = "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo="
+	r3, needsUpdate, err := lm.createOrUpdatePeer(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, needsUpdate)
+	assert.NotEqual(t, r2.PresharedKey, r3.PresharedKey)
+
+	// Disabling preshared keys clears the key on renewal.
+	lm.presharedKeys = false
+	r4, needsUpdate, err := lm.createOrUpdatePeer(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, needsUpdate)
+	assert.Empty(t, r4.PresharedKey)
+}
+
+func TestLeaseManager_ipv6(t *testing.T) {
+	lm := &leaseManager{
+		wgRecords: map[leaseKey]WGRecord{},
+		ipPrefix:  netip.MustParsePrefix("10.90.0.1/20"),
+		ip6Prefix: netip.MustParsePrefix("fd00:10::1/126"),
+		store:     newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+	}
+	testExpiry := time.Unix(9999, 0)
+
+	r, needsUpdate, err := lm.createOrUpdatePeer(leaseParams{
+		Username: "a@example.com",
+		PubKey:   "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+		Expiry:   testExpiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, needsUpdate)
+	assert.Equal(t, netip.MustParseAddr("fd00:10::2"), r.IP6)
+	assert.Equal(t, []string{"10.90.0.2/32", "fd00:10::2/128"}, r.allowedIPs())
+
+	// Existing leases without an IPv6 address get one on renewal.
+	lm.wgRecords[leaseKey{Username: "b@example.com"}] = WGRecord{
+		PubKey:  "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=",
+		IP:      netip.MustParseAddr("10.90.0.3"),
+		expires: testExpiry,
+	}
+	r, needsUpdate, err = lm.createOrUpdatePeer(leaseParams{
+		Username: "b@example.com",
+		PubKey:   "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=",
+		Expiry:   testExpiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, needsUpdate)
+	assert.Equal(t, netip.MustParseAddr("10.90.0.3"), r.IP)
+	assert.Equal(t, netip.MustParseAddr("fd00:10::3"), r.IP6)
+
+	// An exhausted IPv6 range still leaves IPv4 leases working.
+	r, _, err = lm.createOrUpdatePeer(leaseParams{
+		Username: "c@example.com",
+		PubKey:   "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=",
+		Expiry:   testExpiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.90.0.4"), r.IP)
+	assert.False(t, r.IP6.IsValid())
+	assert.Equal(t, []string{"10.90.0.4/32"}, r.allowedIPs())
+}
+
+func TestLeaseManager_poolExhausted(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	// 10.90.0.0/29 leaves 10.90.0.2-6 for peers, minus the reservation.
+	lm := &leaseManager{
+		wgRecords: map[leaseKey]WGRecord{},
+		ipPrefix:  netip.MustParsePrefix("10.90.0.1/29"),
+		reservations: map[string]netip.Addr{
+			"oncall@example.com": netip.MustParseAddr("10.90.0.6"),
+		},
+		store: newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+	}
+	testExpiry := time.Unix(9999, 0)
+	keys := []string{}
+	for i := 0; i < 7; i++ {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key.String())
+	}
+	users := []string{"a", "b", "c", "oncall@example.com"}
+	for i, u := range users {
+		if _, _, err := lm.createOrUpdatePeer(leaseParams{
+			Username: u,
+			PubKey:   keys[i],
+			Expiry:   testExpiry.Add(time.Duration(i) * time.Second),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, free := lm.poolStats()
+	assert.Equal(t, 4, size)
+	assert.Equal(t, 1, free)
+	if _, _, err := lm.createOrUpdatePeer(leaseParams{Username: "d", PubKey: keys[4], Expiry: testExpiry}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejected by default once the pool is full.
+	_, _, err := lm.createOrUpdatePeer(leaseParams{Username: "e", PubKey: keys[5], Expiry: testExpiry})
+	assert.ErrorIs(t, err, errAddressPoolExhausted)
+	_, free = lm.poolStats()
+	assert.Equal(t, 0, free)
+
+	// With the reclaim policy the lease with the oldest handshake is
+	// revoked. Leases of reserved addresses are never reclaimed.
+	lm.poolPolicy = poolExhaustionReclaim
+	lm.lastHandshakes = func() (map[string]time.Time, error) {
+		return map[string]time.Time{
+			keys[0]: time.Unix(300, 0),
+			keys[1]: time.Unix(100, 0),
+			keys[2]: time.Unix(200, 0),
+			keys[4]: time.Unix(400, 0),
+		}, nil
+	}
+	r, _, err := lm.createOrUpdatePeer(leaseParams{Username: "e", PubKey: keys[5], Expiry: testExpiry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.90.0.3"), r.IP)
+	_, ok := lm.wgRecords[leaseKey{Username: "b"}]
+	assert.False(t, ok)
+	records, err := lm.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok = records[leaseKey{Username: "b"}]
+	assert.False(t, ok)
+
+	// Peers that never completed a handshake go first.
+	r, _, err = lm.createOrUpdatePeer(leaseParams{Username: "f", PubKey: keys[6], Expiry: testExpiry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.90.0.3"), r.IP)
+	_, ok = lm.wgRecords[leaseKey{Username: "e"}]
+	assert.False(t, ok)
+}
+
+func TestLeaseManager_addressReuse(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	store := newFileLeaseStore(filepath.Join(t.TempDir(), "leases"))
+	now := time.Now()
+	for k, r := range map[leaseKey]WGRecord{
+		{Username: "a", DeviceID: "laptop"}: {
+			PubKey:  "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+			IP:      netip.MustParseAddr("10.90.0.2"),
+			expires: now.Add(-10 * time.Minute),
+		},
+		{Username: "b"}: {
+			PubKey:  "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=",
+			IP:      netip.MustParseAddr("10.90.0.3"),
+			expires: now.Add(-2 * time.Hour),
+		},
+		{Username: "c"}: {
+			PubKey:  "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=",
+			IP:      netip.MustParseAddr("10.90.0.4"),
+			expires: now.Add(time.Hour),
+		},
+	} {
+		if err := store.Upsert(k, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lm := &leaseManager{
+		addressReuseGracePeriod: time.Hour,
+		ipPrefix:                netip.MustParsePrefix("10.90.0.1/20"),
+		store:                   store,
+		recentAddresses:         make(map[leaseKey]recentAddress),
+	}
+	if err := lm.loadWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(lm.wgRecords))
+	// Only the lease that expired within the grace period is remembered.
+	assert.Equal(t, 1, len(lm.recentAddresses))
+
+	// Other users are not given the remembered address while there are
+	// others free.
+	r, _, err := lm.createOrUpdatePeer(leaseParams{
+		Username: "d",
+		PubKey:   "f8uJJbPUlSU5cD5v0N1YJ2nU4CbUI1KpUzR2d6T2UVc=",
+		Expiry:   now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.90.0.3"), r.IP)
+
+	// The same user device gets its previous address back.
+	r, _, err = lm.createOrUpdatePeer(leaseParams{
+		Username: "a",
+		DeviceID: "laptop",
+		PubKey:   "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=",
+		Expiry:   now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.90.0.2"), r.IP)
+	assert.Equal(t, 0, len(lm.recentAddresses))
+}
+
+func TestLeaseManager_idlePeers(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	now := time.Now()
+	handshakes := map[string]time.Time{}
+	lm := &leaseManager{
+		idlePeerTimeout: time.Hour,
+		wgRecords:       map[leaseKey]WGRecord{},
+		ipPrefix:        netip.MustParsePrefix("10.90.0.1/20"),
+		store:           newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+		lastHandshakes: func() (map[string]time.Time, error) {
+			return handshakes, nil
+		},
+	}
+	active := leaseParams{Username: "a", PubKey: "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=", Expiry: now.Add(24 * time.Hour)}
+	idle := leaseParams{Username: "b", PubKey: "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=", Expiry: now.Add(24 * time.Hour)}
+	renewed := leaseParams{Username: "c", PubKey: "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=", Expiry: now.Add(24 * time.Hour)}
+	for _, p := range []leaseParams{active, idle, renewed} {
+		if _, _, err := lm.createOrUpdatePeer(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handshakes[active.PubKey] = now.Add(-time.Minute)
+	handshakes[idle.PubKey] = now.Add(-2 * time.Hour)
+
+	// Two hours later, only the peer that keeps completing handshakes and
+	// the one that was just renewed are active.
+	later := now.Add(2 * time.Hour)
+	handshakes[active.PubKey] = later.Add(-time.Minute)
+	if _, _, err := lm.createOrUpdatePeer(renewed); err != nil {
+		t.Fatal(err)
+	}
+	r := lm.wgRecords[renewed.key()]
+	r.renewed = later.Add(-time.Minute)
+	lm.wgRecords[renewed.key()] = r
+
+	assert.Equal(t, 1, lm.markIdlePeers(later))
+	assert.False(t, lm.wgRecords[active.key()].idle)
+	assert.True(t, lm.wgRecords[idle.key()].idle)
+	assert.False(t, lm.wgRecords[renewed.key()].idle)
+	// Idle leases are kept, and not counted again.
+	assert.Equal(t, 3, len(lm.listLeases()))
+	assert.Equal(t, 0, lm.markIdlePeers(later))
+
+	// Renewing an idle lease adds the peer back.
+	record, needsUpdate, err := lm.createOrUpdatePeer(idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, needsUpdate)
+	assert.False(t, record.idle)
+	assert.False(t, lm.wgRecords[idle.key()].idle)
+}
+
+func TestLeaseManager_removeLeases(t *testing.T) {
+	lm := &leaseManager{
+		wgRecords: map[leaseKey]WGRecord{},
+		ipPrefix:  netip.MustParsePrefix("10.90.0.1/20"),
+		store:     newFileLeaseStore(filepath.Join(t.TempDir(), "leases")),
+	}
+	testExpiry := time.Unix(9999, 0)
+	for _, p := range []leaseParams{
+		{Username: "a", DeviceID: "laptop", PubKey: "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY="},
+		{Username: "a", DeviceID: "desktop", PubKey: "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo="},
+		{Username: "b", PubKey: "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00="},
+	} {
+		p.Expiry = testExpiry
+		if _, _, err := lm.createOrUpdatePeer(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := lm.removeLeases(func(k leaseKey, _ WGRecord) bool {
+		return k.Username == "a"
+	}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(removed))
+	assert.Equal(t, 1, len(lm.listLeases()))
+	records, err := lm.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, lm.listLeases(), records)
+}
+
+func TestLeaseManager_revalidateTokens(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	dir := t.TempDir()
+	lm := &leaseManager{
+		wgRecords: map[leaseKey]WGRecord{},
+		ipPrefix:  netip.MustParsePrefix("10.90.0.1/20"),
+		store:     newFileLeaseStore(filepath.Join(dir, "leases")),
+	}
+	testExpiry := time.Now().Add(time.Hour)
+	for _, p := range []leaseParams{
+		{Username: "active", PubKey: "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=", Token: "active-token"},
+		{Username: "disabled", PubKey: "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=", Token: "disabled-token"},
+		{Username: "unreachable", PubKey: "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=", Token: "error-token"},
+		// Leases loaded from older leases files carry no token.
+		{Username: "loaded", PubKey: "f8uJJbPUlSU5cD5v0N1YJ2nU4CbUI1KpUzR2d6T2UVc="},
+	} {
+		p.Expiry = testExpiry
+		if _, _, err := lm.createOrUpdatePeer(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	validated := []string{}
+	// Updating the WireGuard peers fails without a device, which is fine
+	// here as only the lease state is checked.
+	_ = lm.revalidateTokens(func(token string) (*introspectionResponse, error) {
+		validated = append(validated, token)
+		switch token {
+		case "active-token":
+			return &introspectionResponse{Active: true}, nil
+		case "disabled-token":
+			return &introspectionResponse{Active: false}, nil
+		}
+		return nil, fmt.Errorf("connection refused")
+	})
+	assert.ElementsMatch(t, []string{"active-token", "disabled-token", "error-token"}, validated)
+	leases := lm.listLeases()
+	assert.Equal(t, 3, len(leases))
+	_, ok := leases[leaseKey{Username: "disabled"}]
+	assert.False(t, ok)
+	records, err := lm.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok = records[leaseKey{Username: "disabled"}]
+	assert.False(t, ok)
+
+	// Tokens are re-validated after a restart too.
+	restarted := &leaseManager{ipPrefix: lm.ipPrefix, store: newFileLeaseStore(filepath.Join(dir, "leases"))}
+	if err := restarted.loadWgRecords(); err != nil {
+		t.Fatal(err)
+	}
+	validated = []string{}
+	_ = restarted.revalidateTokens(func(token string) (*introspectionResponse, error) {
+		validated = append(validated, token)
+		return &introspectionResponse{Active: true}, nil
+	})
+	assert.ElementsMatch(t, []string{"active-token", "error-token"}, validated)
+}
+
+func TestLeaseManager_reauthorizeLeases(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	dir := t.TempDir()
+	wg := &fakeWgClient{peers: map[wgtypes.Key]wgtypes.Peer{}}
+	lm := &leaseManager{
+		deviceName: "wg0",
+		wgRecords:  map[leaseKey]WGRecord{},
+		ipPrefix:   netip.MustParsePrefix("10.90.0.1/20"),
+		store:      newFileLeaseStore(filepath.Join(dir, "leases")),
+		wgClient:   wg,
+	}
+	networks := []string{"10.1.0.0/16", "10.2.0.0/16", "10.90.0.1/32"}
+	testExpiry := time.Now().Add(time.Hour)
+	for _, p := range []leaseParams{
+		{Username: "alice", PubKey: "k1a1fEw+lqB/JR1pKjI597R54xzfP9Kxv4M7hufyNAY=", Token: "alice-token"},
+		{Username: "bob", PubKey: "E1gSkv2jS/P+p8YYmvm7ByEvwpLPqQBdx70SPtNSwCo=", Token: "bob-token"},
+		{Username: "mallory", PubKey: "NkEtSA6GosX40iZFNe9+byAkXweYKvQe3utnFYkQ+00=", Token: "mallory-token"},
+		{Username: "unreachable", PubKey: "f8uJJbPUlSU5cD5v0N1YJ2nU4CbUI1KpUzR2d6T2UVc=", Token: "error-token"},
+		// Leases loaded from older leases files carry no token.
+		{Username: "loaded", PubKey: "2Gc3iYl0w8EkZpM1HfOquHbOiHMQ5Wb+Nbi3wgq2Cjo="},
+	} {
+		p.Expiry = testExpiry
+		p.Networks = networks
+		if _, _, err := lm.createOrUpdatePeer(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The reloaded config denies mallory and only grants the staff network
+	// to staff.
+	conf := &serverConfig{
+		WireguardIPPrefix: lm.ipPrefix,
+		OauthServers:      []oauthServerConfig{{Server: "https://idp.example.com", DeniedUsers: []string{"mallory"}}},
+		Policies:          []accessPolicy{{Groups: []string{"staff"}, AllowedIPs: []string{"10.1.0.0/16"}}},
+	}
+	groups := map[string][]string{"alice-token": {"staff"}, "bob-token": {"contractors"}, "mallory-token": {"staff"}}
+	err := lm.reauthorizeLeases(conf, func(token string) (*introspectionResponse, error) {
+		if token == "error-token" {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return &introspectionResponse{
+			Active:   true,
+			Issuer:   "https://idp.example.com",
+			UserName: token[:len(token)-len("-token")],
+			Groups:   groups[token],
+		}, nil
+	})
+	assert.NoError(t, err)
+	leases := lm.listLeases()
+	assert.Equal(t, 3, len(leases))
+	assert.Equal(t, []string{"10.1.0.0/16", "10.90.0.1/32"}, leases[leaseKey{Username: "alice"}].Networks)
+	assert.Equal(t, networks, leases[leaseKey{Username: "unreachable"}].Networks)
+	assert.Equal(t, networks, leases[leaseKey{Username: "loaded"}].Networks)
+	records, err := lm.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, []string{"10.1.0.0/16", "10.90.0.1/32"}, records[leaseKey{Username: "alice"}].Networks)
+	assert.Equal(t, 3, len(wg.peers))
+}
+
 func TestGetAvailableIPAddresses(t *testing.T) {
 	ipPrefix := netip.MustParsePrefix("10.90.0.1/20")
 	r1 := WGRecord{
@@ -78,22 +683,25 @@ func TestGetAvailableIPAddresses(t *testing.T) {
 		IP:      netip.MustParseAddr("10.90.0.4"),
 		expires: time.Unix(0, 0)}
 
-	lm := &fileLeaseManager{
-		wgRecords: map[string]WGRecord{"r1": r1, "r2": r2},
+	lm := &leaseManager{
+		wgRecords: map[leaseKey]WGRecord{{Username: "r1"}: r1, {Username: "r2"}: r2},
 		ipPrefix:  ipPrefix,
 	}
 
 	testCases := []struct {
-		t fileLeaseManager
+		t *leaseManager
 		e netip.Addr
 	}{
 		{
-			t: *lm,
+			t: lm,
 			e: netip.MustParseAddr("10.90.0.3"),
 		},
 	}
 	for _, test := range testCases {
-		a := test.t.nextAvailableAddress()
+		a, err := test.t.nextAvailableAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
 		if a.Compare(test.e) != 0 {
 			t.Errorf("getNextAvailableAddress: expected=%s got=%s", test.e.String(), a.String())
 		}
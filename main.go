@@ -20,20 +20,25 @@ var (
 	// By default the agent runs at a high obscure port. 7773 is chosen by
 	// looking wiresteward initials hex on ascii table (w = 0x77 and s = 0x73)
 	flagAgentAddress = flag.String("agent-listen-address", "localhost:7773", "Address where the agent http server runs.\nThe URL http://<agent-listen-address>/oauth2/callback must be a valid callback url for the oauth2 application.")
-	flagConfig       = flag.String("config", "/etc/wiresteward/config.json", "Config file")
+	flagConfig       = flag.String("config", "/etc/wiresteward/config.json", "Config file, in JSON or, with a .yaml or .yml extension, YAML format")
 	flagDeviceType   = flag.String("device-type", "", "Type of the network device to use for the agent, 'tun' or 'wireguard'.\nThe tun device relies on the wireguard-go userspace implementation that is compatible with all platforms.\nA wireguard device relies on wireguard-enabled linux kernels (5.6 or newer or wireguard-dkms module + Linux headers).")
 	flagLogLevel     = flag.String("log-level", "error", "Log Level (debug|error)")
 	flagMetricsAddr  = flag.String("metrics-address", ":8081", "Metrics server address, meaningful when combined with -server flag")
 	flagServer       = flag.Bool("server", false, "Run application in \"server\" mode")
+	flagValidate     = flag.Bool("validate-config", false, "Validate the agent or server config, print the effective config and exit.\nUnknown config keys are rejected and nothing is checked over the network.")
 	flagVersion      = flag.Bool("version", false, "Prints out application version")
 )
 
 func main() {
 	flag.Parse()
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	buildInfo, _ := debug.ReadBuildInfo()
 
-	if len(os.Args) < 2 {
+	if flag.NFlag() == 0 {
 		flag.PrintDefaults()
 		return
 	}
@@ -52,6 +57,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *flagValidate {
+		if !*flagAgent && !*flagServer {
+			logger.Errorf("Must set -agent or -server with -validate-config")
+			os.Exit(1)
+		}
+		if err := validateConfig(os.Stdout, *flagConfig, *flagAgent, *flagAllowPublicRoutes); err != nil {
+			logger.Errorf("Invalid config: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	*flagDeviceType = strings.ToLower(*flagDeviceType)
 	if *flagDeviceType == "" {
 		if wgDevTypeSupported() {
@@ -109,7 +126,44 @@ func server() {
 		}
 	}()
 
-	lm, err := newFileLeaseManager(cfg)
+	prometheus.MustRegister(leaseFileMalformedLines)
+	store, err := newLeaseStore(cfg)
+	if err != nil {
+		logger.Errorf("Cannot open lease store: %v", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			logger.Errorf("Cannot close lease store: %v", err)
+		}
+	}()
+	audit, err := newAuditLog(cfg)
+	if err != nil {
+		logger.Errorf("Cannot open audit log: %v", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := audit.Close(); err != nil {
+			logger.Errorf("Cannot close audit log: %v", err)
+		}
+	}()
+	var fw *peerFirewall
+	if cfg.PeerFirewall {
+		fw, err = newPeerFirewall(cfg)
+		if err == nil {
+			err = fw.setup()
+		}
+		if err != nil {
+			logger.Errorf("Cannot set up peer firewall: %v", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := fw.teardown(); err != nil {
+				logger.Errorf("Cannot clean up peer firewall: %v", err)
+			}
+		}()
+	}
+	lm, err := newLeaseManager(cfg, store, fw, audit)
 	if err != nil {
 		logger.Errorf("Cannot start lease server: %v", err)
 		os.Exit(1)
@@ -119,11 +173,8 @@ func server() {
 		logger.Errorf("Cannot initialise token validator: %v", err)
 		os.Exit(1)
 	}
-	issuers := make([]string, 0, len(tv.servers))
-	for iss := range tv.servers {
-		issuers = append(issuers, iss)
-	}
-	initTokenValidationMetrics(issuers)
+	tv.cache = newIntrospectionCache(cfg)
+	initTokenValidationMetrics(tv.issuers())
 
 	// Start metrics server
 	client, err := wgctrl.New()
@@ -139,14 +190,69 @@ func server() {
 	prometheus.MustRegister(mc)
 	go startMetricsServer(*flagMetricsAddr)
 
-	lh := HTTPLeaseHandler{
+	var certs *certReloader
+	if cfg.TLSCertFile != "" {
+		certs, err = newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.ClientCAFile)
+		if err != nil {
+			logger.Errorf("Cannot load TLS certificate: %v", err)
+			os.Exit(1)
+		}
+	}
+	lh := &HTTPLeaseHandler{
+		audit:          audit,
+		certs:          certs,
 		leaseManager:   lm,
 		serverConfig:   cfg,
 		tokenValidator: tv,
 	}
 	go lh.start()
+
+	// The revalidation ticker is created stopped when revalidation is
+	// disabled, so that a config reload can enable it.
+	revalidationTicker := time.NewTicker(time.Hour)
+	defer revalidationTicker.Stop()
+	resetTicker(revalidationTicker, cfg.TokenRevalidationInterval)
+	go func() {
+		for range revalidationTicker.C {
+			if err := lm.revalidateTokens(func(token string) (*introspectionResponse, error) {
+				return tv.revalidate(token, "access_token")
+			}); err != nil {
+				logger.Errorf("Cannot revoke leases: %v", err)
+			}
+		}
+	}()
 	ticker := time.NewTicker(cfg.LeaserSyncInterval)
 	defer ticker.Stop()
+
+	reloader := &serverReloader{
+		allowPublicRoutes:  *flagAllowPublicRoutes,
+		configFile:         *flagConfig,
+		config:             cfg,
+		device:             wg,
+		firewall:           fw,
+		leaseHandler:       lh,
+		leaseManager:       lm,
+		revalidationTicker: revalidationTicker,
+		syncTicker:         ticker,
+		tokenValidator:     tv,
+	}
+	// Reloads requested via the admin API are applied by the leaser loop, so
+	// that they never run concurrently with a SIGHUP reload.
+	reloadRequests := make(chan chan error)
+	if cfg.AdminListenAddress != "" {
+		ah, err := newHTTPAdminHandler(cfg, lm, tv, func() error {
+			errc := make(chan error, 1)
+			reloadRequests <- errc
+			return <-errc
+		})
+		if err != nil {
+			logger.Errorf("Cannot initialise admin server: %v", err)
+			os.Exit(1)
+		}
+		go ah.start(cfg.AdminListenAddress, certs)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM)
 	signal.Notify(quit, os.Interrupt)
@@ -157,6 +263,12 @@ func server() {
 			if err := lm.syncWgRecords(); err != nil {
 				logger.Errorf("%v", err)
 			}
+		case <-hup:
+			if err := reloader.reload(); err != nil {
+				logger.Errorf("Cannot reload config: %v", err)
+			}
+		case errc := <-reloadRequests:
+			errc <- reloader.reload()
 		case <-quit:
 			logger.Verbosef("Quitting")
 			return
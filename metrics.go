@@ -21,18 +21,48 @@ var tokenValidations = prometheus.NewCounterVec(
 	[]string{"issuer", "result"},
 )
 
-// initTokenValidationMetrics registers the tokenValidations counter and
-// pre-initialises every (issuer, result) series to 0 so that unused oauth
-// servers are visible as flat-zero counters rather than missing series.
+// tokenValidationCacheLookups counts lookups of introspection results in the
+// cache, labelled by oauth server issuer and whether the result was cached
+// (hit, miss).
+var tokenValidationCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "wiresteward_token_validation_cache_lookups_total",
+		Help: "Number of introspection cache lookups, labelled by oauth server issuer and outcome.",
+	},
+	[]string{"issuer", "result"},
+)
+
+// initTokenValidationMetrics registers the tokenValidations and
+// tokenValidationCacheLookups counters and pre-initialises every (issuer,
+// result) series to 0 so that unused oauth servers are visible as flat-zero
+// counters rather than missing series.
 func initTokenValidationMetrics(issuers []string) {
-	prometheus.MustRegister(tokenValidations)
+	prometheus.MustRegister(tokenValidations, tokenValidationCacheLookups)
+	initTokenValidationSeries(issuers)
+}
+
+// initTokenValidationSeries pre-initialises the token validation series of
+// the given issuers, for example of oauth servers added on config reload.
+func initTokenValidationSeries(issuers []string) {
 	for _, iss := range issuers {
 		for _, r := range []string{"active", "inactive", "error"} {
 			tokenValidations.WithLabelValues(iss, r).Add(0)
 		}
+		for _, r := range []string{"hit", "miss"} {
+			tokenValidationCacheLookups.WithLabelValues(iss, r).Add(0)
+		}
 	}
 }
 
+// leaseFileMalformedLines counts the lines of the leases file that could not
+// be parsed on load and were moved to the quarantine file.
+var leaseFileMalformedLines = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "wiresteward_lease_file_malformed_lines_total",
+		Help: "Number of malformed leases file lines that were quarantined on load.",
+	},
+)
+
 // A collector is a prometheus.Collector for a WireGuard device.
 type collector struct {
 	DeviceInfo          *prometheus.Desc
@@ -42,14 +72,16 @@ type collector struct {
 	PeerTransmitBytes   *prometheus.Desc
 	PeerLastHandshake   *prometheus.Desc
 	PeerLeaseExpiryTime *prometheus.Desc
+	PoolUtilisation     *prometheus.Desc
+	PoolFreeAddresses   *prometheus.Desc
 
 	devices      func() ([]*wgtypes.Device, error)
-	leaseManager *fileLeaseManager
+	leaseManager *leaseManager
 }
 
 // NewMetricsCollector constructs a prometheus.Collector to collect metrics for
 // all present wg devices and correlate with user if possible
-func newMetricsCollector(devices func() ([]*wgtypes.Device, error), lm *fileLeaseManager) prometheus.Collector {
+func newMetricsCollector(devices func() ([]*wgtypes.Device, error), lm *leaseManager) prometheus.Collector {
 	// common labels for all metrics
 	labels := []string{"device", "public_key"}
 
@@ -96,6 +128,18 @@ func newMetricsCollector(devices func() ([]*wgtypes.Device, error), lm *fileLeas
 			[]string{"address", "public_key", "username"},
 			nil,
 		),
+		PoolUtilisation: prometheus.NewDesc(
+			"wiresteward_address_pool_utilisation_ratio",
+			"Fraction of the addresses in the lease pool that are leased.",
+			nil,
+			nil,
+		),
+		PoolFreeAddresses: prometheus.NewDesc(
+			"wiresteward_address_pool_free_addresses",
+			"Number of addresses in the lease pool that are not leased.",
+			nil,
+			nil,
+		),
 		devices:      devices,
 		leaseManager: lm,
 	}
@@ -111,6 +155,8 @@ func (c *collector) Describe(ch chan<- *prometheus.Desc) {
 		c.PeerTransmitBytes,
 		c.PeerLastHandshake,
 		c.PeerLeaseExpiryTime,
+		c.PoolUtilisation,
+		c.PoolFreeAddresses,
 	}
 
 	for _, d := range ds {
@@ -183,7 +229,7 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 			)
 		}
 	}
-	for username, record := range c.leaseManager.wgRecords {
+	for key, record := range c.leaseManager.wgRecords {
 		// Expose expiry time of 0 if not set.
 		var expiry float64
 		if !record.expires.IsZero() {
@@ -195,15 +241,34 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 			prometheus.GaugeValue,
 			expiry,
 			record.IP.String(),
-			record.PubKey, username,
+			record.PubKey, key.Username,
 		)
 	}
+	c.collectPoolStats(ch)
+}
+
+func (c *collector) collectPoolStats(ch chan<- prometheus.Metric) {
+	size, free := c.leaseManager.poolStats()
+	var utilisation float64
+	if size > 0 {
+		utilisation = float64(size-free) / float64(size)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.PoolUtilisation,
+		prometheus.GaugeValue,
+		utilisation,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.PoolFreeAddresses,
+		prometheus.GaugeValue,
+		float64(free),
+	)
 }
 
 func (c *collector) getUserFromPubKey(pub string) string {
-	for username, wgRecord := range c.leaseManager.wgRecords {
+	for key, wgRecord := range c.leaseManager.wgRecords {
 		if pub == wgRecord.PubKey {
-			return username
+			return key.Username
 		}
 	}
 	return ""
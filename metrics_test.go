@@ -26,7 +26,7 @@ func TestCollector(t *testing.T) {
 	tests := []struct {
 		name         string
 		devices      func() ([]*wgtypes.Device, error)
-		leaseManager *fileLeaseManager
+		leaseManager *leaseManager
 		metrics      []string
 	}{
 		{
@@ -83,14 +83,15 @@ func TestCollector(t *testing.T) {
 					},
 				}, nil
 			},
-			leaseManager: &fileLeaseManager{
-				wgRecords: map[string]WGRecord{
-					userA: WGRecord{
+			leaseManager: &leaseManager{
+				ipPrefix: netip.MustParsePrefix("10.0.0.5/29"),
+				wgRecords: map[leaseKey]WGRecord{
+					{Username: userA}: WGRecord{
 						PubKey:  pubPeerA.String(),
 						IP:      netip.MustParseAddr("10.0.0.1"),
 						expires: time.Unix(100, 0),
 					},
-					userB: WGRecord{
+					{Username: userB, DeviceID: "device-b"}: WGRecord{
 						PubKey: pubPeerB.String(),
 						IP:     netip.MustParseAddr("10.0.0.3"),
 					},
@@ -117,6 +118,8 @@ func TestCollector(t *testing.T) {
 				fmt.Sprintf(`wiresteward_wg_peer_transmit_bytes_total{device="wg1",public_key="%v",username=""} 0`, pubPeerC.String()),
 				fmt.Sprintf(`wiresteward_peer_lease_expiry_time{address="10.0.0.1",public_key="%v",username="%s"} 100`, pubPeerA.String(), userA),
 				fmt.Sprintf(`wiresteward_peer_lease_expiry_time{address="10.0.0.3",public_key="%v",username="%s"} 0`, pubPeerB.String(), userB),
+				`wiresteward_address_pool_free_addresses 3`,
+				`wiresteward_address_pool_utilisation_ratio 0.4`,
 			},
 		},
 	}
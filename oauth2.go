@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,6 +33,7 @@ var (
 	// make sure `none` is not used as one of the `alg` value in token
 	supportedAlgValues = []jose.SignatureAlgorithm{
 		jose.HS256, jose.RS256, jose.RS384, jose.RS512, jose.ES256, jose.ES384, jose.ES512,
+		jose.PS256, jose.PS384, jose.PS512, jose.EdDSA,
 	}
 )
 
@@ -203,11 +205,16 @@ func (oa *oauthTokenHandler) ExchangeToken(code string) (*oauth2.Token, error) {
 	return tok, nil
 }
 
-// oauthServer holds the data needed to introspect tokens for a single
-// OAuth server, after discovery has been performed at startup.
+// oauthServer holds the data needed to introspect or verify tokens for a
+// single OAuth server, after discovery has been performed at startup.
 type oauthServer struct {
 	IntrospectionURL string
+	UserinfoURL      string
 	ClientID         string
+	Audiences        []string
+	UsernameClaim    string
+	UsernamePrefix   string
+	jwks             *jwksCache // nil unless tokens are verified locally
 }
 
 // oidcDiscoveryDoc is the subset of fields we read from the OIDC discovery
@@ -215,17 +222,77 @@ type oauthServer struct {
 type oidcDiscoveryDoc struct {
 	Issuer                string `json:"issuer"`
 	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
 }
 
 type tokenValidator struct {
-	httpClient *http.Client
-	servers    map[string]oauthServer // keyed by issuer (matches JWT `iss`)
+	cache        *introspectionCache // nil unless caching is enabled
+	httpClient   *http.Client
+	servers      map[string]oauthServer // keyed by issuer (matches JWT `iss`)
+	serversMutex sync.RWMutex
 }
 
 type introspectionResponse struct {
-	Active   bool   `json:"active"`
-	Exp      int64  `json:"exp"`
-	UserName string `json:"username"`
+	Active            bool         `json:"active"`
+	Exp               int64        `json:"exp"`
+	UserName          string       `json:"username"`
+	Email             string       `json:"email"`
+	EmailVerified     *claimBool   `json:"email_verified"` // nil if absent
+	Groups            []string     `json:"groups"`
+	Issuer            string       `json:"iss"`
+	Audience          jwt.Audience `json:"aud"` // a single string or a list
+	Subject           string       `json:"sub"`
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+// claimBool is a boolean claim, which some identity providers send as a
+// string.
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*b = claimBool(v)
+	case string:
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean claim %q", v)
+		}
+		*b = claimBool(parsed)
+	default:
+		return fmt.Errorf("invalid boolean claim %s", data)
+	}
+	return nil
+}
+
+// claim returns the value of the claim that identifies the user, `username`
+// unless another one is configured. An email the identity provider says is
+// not verified does not identify anyone, as users may be able to set it to
+// the address of someone else.
+func (r *introspectionResponse) claim(name string) string {
+	switch name {
+	case usernameClaimSub:
+		return r.Subject
+	case usernameClaimEmail:
+		return r.verifiedEmail()
+	case usernameClaimPreferredUsername:
+		return r.PreferredUsername
+	}
+	return r.UserName
+}
+
+// verifiedEmail returns the email claim, or an empty string if the identity
+// provider says it is not verified.
+func (r *introspectionResponse) verifiedEmail() string {
+	if r.EmailVerified != nil && !bool(*r.EmailVerified) {
+		return ""
+	}
+	return r.Email
 }
 
 // newTokenValidator builds a tokenValidator by performing OIDC discovery
@@ -233,10 +300,29 @@ type introspectionResponse struct {
 // request fails, returns an `issuer` that does not match the configured
 // server URL, or omits the `introspection_endpoint` field.
 func newTokenValidator(servers []oauthServerConfig) (*tokenValidator, error) {
-	tv := &tokenValidator{
-		httpClient: &http.Client{},
-		servers:    make(map[string]oauthServer, len(servers)),
+	tv := &tokenValidator{httpClient: &http.Client{}}
+	if err := tv.setServers(servers); err != nil {
+		return nil, err
 	}
+	return tv, nil
+}
+
+// setServers performs OIDC discovery against the given OAuth servers and
+// replaces the servers used to validate tokens. The servers are left
+// unchanged if discovery fails for any of them.
+func (tv *tokenValidator) setServers(servers []oauthServerConfig) error {
+	discovered, err := tv.discoverServers(servers)
+	if err != nil {
+		return err
+	}
+	tv.replaceServers(discovered)
+	return nil
+}
+
+// discoverServers performs OIDC discovery against the given OAuth servers and
+// returns them keyed by issuer, without changing the servers in use.
+func (tv *tokenValidator) discoverServers(servers []oauthServerConfig) (map[string]oauthServer, error) {
+	discovered := make(map[string]oauthServer, len(servers))
 	for _, s := range servers {
 		doc, err := fetchOIDCDiscovery(tv.httpClient, s.Server)
 		if err != nil {
@@ -245,15 +331,59 @@ func newTokenValidator(servers []oauthServerConfig) (*tokenValidator, error) {
 		if doc.Issuer != s.Server {
 			return nil, fmt.Errorf("oauth server %q: discovery returned mismatched issuer %q", s.Server, doc.Issuer)
 		}
+		if s.Verification == tokenVerificationJWKS {
+			if doc.JWKSURI == "" {
+				return nil, fmt.Errorf("oauth server %q: discovery missing `jwks_uri`", s.Server)
+			}
+			jwks, err := newJWKSCache(doc.JWKSURI)
+			if err != nil {
+				return nil, fmt.Errorf("oauth server %q: %w", s.Server, err)
+			}
+			// Tokens are verified locally so that the server does not
+			// depend on the IdP for every request; the userinfo endpoint
+			// is not used either, and tokens must carry the claims.
+			discovered[doc.Issuer] = oauthServer{
+				ClientID:       s.ClientID,
+				Audiences:      s.Audiences,
+				UsernameClaim:  s.UsernameClaim,
+				UsernamePrefix: s.UsernamePrefix,
+				jwks:           jwks,
+			}
+			continue
+		}
 		if doc.IntrospectionEndpoint == "" {
 			return nil, fmt.Errorf("oauth server %q: discovery missing `introspection_endpoint`", s.Server)
 		}
-		tv.servers[doc.Issuer] = oauthServer{
+		discovered[doc.Issuer] = oauthServer{
 			IntrospectionURL: doc.IntrospectionEndpoint,
+			UserinfoURL:      doc.UserinfoEndpoint,
 			ClientID:         s.ClientID,
+			UsernameClaim:    s.UsernameClaim,
+			UsernamePrefix:   s.UsernamePrefix,
 		}
 	}
-	return tv, nil
+	return discovered, nil
+}
+
+// replaceServers replaces the servers used to validate tokens with the ones
+// returned by discoverServers.
+func (tv *tokenValidator) replaceServers(discovered map[string]oauthServer) {
+	tv.serversMutex.Lock()
+	defer tv.serversMutex.Unlock()
+	tv.servers = discovered
+	// Results may have come from servers that are gone or changed.
+	tv.cache.clear()
+}
+
+// issuers returns the issuers of the configured OAuth servers.
+func (tv *tokenValidator) issuers() []string {
+	tv.serversMutex.RLock()
+	defer tv.serversMutex.RUnlock()
+	issuers := make([]string, 0, len(tv.servers))
+	for iss := range tv.servers {
+		issuers = append(issuers, iss)
+	}
+	return issuers
 }
 
 func fetchOIDCDiscovery(client *http.Client, server string) (*oidcDiscoveryDoc, error) {
@@ -309,19 +439,48 @@ func (tv *tokenValidator) requestIntospection(token, tokenTypeHint string, s oau
 }
 
 // validate takes a token, parses its issuer from the JWT, and queries the
-// matching introspection endpoint.
+// matching introspection endpoint, unless the result is cached.
 // https://tools.ietf.org/html/rfc7662#section-2.2
 func (tv *tokenValidator) validate(token, tokenTypeHint string) (*introspectionResponse, error) {
+	return tv.check(token, tokenTypeHint, true)
+}
+
+// revalidate is like validate, but always queries the introspection endpoint,
+// so that tokens revoked at the IdP are noticed. The result is still cached.
+func (tv *tokenValidator) revalidate(token, tokenTypeHint string) (*introspectionResponse, error) {
+	return tv.check(token, tokenTypeHint, false)
+}
+
+func (tv *tokenValidator) check(token, tokenTypeHint string, useCache bool) (*introspectionResponse, error) {
 	issuer, err := validateJWTToken(token)
 	if err != nil {
 		return nil, fmt.Errorf("Validation failed: %v", err)
 	}
+	tv.serversMutex.RLock()
 	s, ok := tv.servers[issuer]
+	tv.serversMutex.RUnlock()
 	if !ok {
 		logger.Errorf("No oauth server configured for issuer %q", issuer)
 		return nil, fmt.Errorf("no oauth server configured for issuer %q", issuer)
 	}
 	logger.Verbosef("Token matched oauth server for issuer %q", issuer)
+	if s.jwks != nil {
+		response, err := verifyJWT(token, issuer, s)
+		if err != nil || !response.Active {
+			return response, err
+		}
+		if err := tv.identify(token, s, response); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+	if useCache && tv.cache != nil {
+		if response, ok := tv.cache.get(token); ok {
+			tokenValidationCacheLookups.WithLabelValues(issuer, "hit").Inc()
+			return response, nil
+		}
+		tokenValidationCacheLookups.WithLabelValues(issuer, "miss").Inc()
+	}
 	body, err := tv.requestIntospection(token, tokenTypeHint, s)
 	if err != nil {
 		tokenValidations.WithLabelValues(issuer, "error").Inc()
@@ -333,14 +492,75 @@ func (tv *tokenValidator) validate(token, tokenTypeHint string) (*introspectionR
 		tokenValidations.WithLabelValues(issuer, "error").Inc()
 		return nil, err
 	}
+	// Not all introspection endpoints return the issuer, fall back to the
+	// one the token was routed by.
+	if response.Issuer == "" {
+		response.Issuer = issuer
+	}
+	if response.Active {
+		if err := tv.identify(token, s, response); err != nil {
+			tokenValidations.WithLabelValues(issuer, "error").Inc()
+			return nil, err
+		}
+	}
 	result := "inactive"
 	if response.Active {
 		result = "active"
 	}
 	tokenValidations.WithLabelValues(issuer, result).Inc()
+	tv.cache.put(token, response)
 	return response, nil
 }
 
+// identify sets the username of an active token to the value of the claim
+// configured for its server, with the server's prefix. If the token info does
+// not carry the claim, it is looked up at the userinfo endpoint, when the
+// server has one. The username is left empty if neither has the claim.
+func (tv *tokenValidator) identify(token string, s oauthServer, response *introspectionResponse) error {
+	username := response.claim(s.UsernameClaim)
+	if username == "" && s.UserinfoURL != "" {
+		logger.Verbosef("Token info does not identify the user, requesting %s", s.UserinfoURL)
+		info, err := tv.requestUserinfo(token, s)
+		if err != nil {
+			return err
+		}
+		username = info.claim(s.UsernameClaim)
+	}
+	if username != "" {
+		username = s.UsernamePrefix + username
+	}
+	response.UserName = username
+	return nil
+}
+
+// requestUserinfo returns the claims about the user that the OIDC userinfo
+// endpoint of the server returns for the token.
+// https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+func (tv *tokenValidator) requestUserinfo(token string, s oauthServer) (*introspectionResponse, error) {
+	req, err := http.NewRequest("GET", s.UserinfoURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating userinfo request: %v", err)
+	}
+	req.Header.Set("Authorization", bearerSchema+token)
+	resp, err := tv.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("userinfo request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo response status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading userinfo response body: %w", err)
+	}
+	info := &introspectionResponse{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return nil, fmt.Errorf("cannot decode userinfo response: %w", err)
+	}
+	return info, nil
+}
+
 // validateJWTToken takes a string and tries to validate it as a jwt token. On
 // success it returns the issuer (`iss` claim) found in the token. It returns
 // an error if parsing or validation fails.
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -159,3 +162,105 @@ func TestNewTokenValidator_unreachable(t *testing.T) {
 	})
 	assert.Error(t, err)
 }
+
+func TestTokenValidator_usernameClaim(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+
+	var serverURL string
+	var userinfoRequests atomic.Int32
+	userinfoStatus := http.StatusOK
+	userinfo := `{"sub": "00u1", "username": "alice", "email": "alice@example.com", "email_verified": true}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": "%[1]s", "introspection_endpoint": "%[1]s/introspect", "userinfo_endpoint": "%[1]s/userinfo"}`, serverURL)
+	})
+	mux.HandleFunc("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"active": true, "sub": "00u1", "exp": %d}`, time.Now().Add(time.Hour).Unix())
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		userinfoRequests.Add(1)
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(userinfoStatus)
+		fmt.Fprint(w, userinfo)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	serverURL = srv.URL
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("0102030405060708090A0B0C0D0E0F10")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer: serverURL,
+		Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	validate := func(conf oauthServerConfig) (*introspectionResponse, error) {
+		conf.Server, conf.ClientID = serverURL, "test-client"
+		tv, err := newTokenValidator([]oauthServerConfig{conf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tv.validate(token, "access_token")
+	}
+
+	tokenInfo, err := validate(oauthServerConfig{UsernameClaim: "sub", UsernamePrefix: "corp/"})
+	assert.NoError(t, err)
+	assert.Equal(t, "corp/00u1", tokenInfo.UserName)
+	assert.Equal(t, int32(0), userinfoRequests.Load())
+
+	// Claims missing from the introspection response are looked up, the
+	// subject does not stand in for a missing username.
+	tokenInfo, err = validate(oauthServerConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", tokenInfo.UserName)
+	assert.Equal(t, int32(1), userinfoRequests.Load())
+
+	tokenInfo, err = validate(oauthServerConfig{UsernameClaim: "email", UsernamePrefix: "corp/"})
+	assert.NoError(t, err)
+	assert.Equal(t, "corp/alice@example.com", tokenInfo.UserName)
+	assert.Equal(t, int32(2), userinfoRequests.Load())
+
+	// Unverified emails do not identify the user.
+	userinfo = `{"sub": "00u1", "email": "bob@example.com", "email_verified": false}`
+	tokenInfo, err = validate(oauthServerConfig{UsernameClaim: "email"})
+	assert.NoError(t, err)
+	assert.True(t, tokenInfo.Active)
+	assert.Empty(t, tokenInfo.UserName)
+
+	tokenInfo, err = validate(oauthServerConfig{UsernameClaim: "preferred_username", UsernamePrefix: "corp/"})
+	assert.NoError(t, err)
+	assert.True(t, tokenInfo.Active)
+	assert.Empty(t, tokenInfo.UserName)
+
+	userinfoStatus = http.StatusInternalServerError
+	_, err = validate(oauthServerConfig{UsernameClaim: "email"})
+	assert.ErrorContains(t, err, "userinfo response status")
+}
+
+func TestIntrospectionResponse_emailVerified(t *testing.T) {
+	for input, want := range map[string]*bool{
+		`{}`:                          nil,
+		`{"email_verified": true}`:    boolPtr(true),
+		`{"email_verified": false}`:   boolPtr(false),
+		`{"email_verified": "false"}`: boolPtr(false),
+	} {
+		var r introspectionResponse
+		if assert.NoError(t, json.Unmarshal([]byte(input), &r), input) {
+			assert.Equal(t, want, (*bool)(r.EmailVerified), input)
+		}
+	}
+	var r introspectionResponse
+	assert.Error(t, json.Unmarshal([]byte(`{"email_verified": "maybe"}`), &r))
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
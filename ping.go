@@ -1,5 +1,4 @@
 // Based on https://github.com/google/seesaw/blob/master/healthcheck/ping.go
-// only for ipv4.
 package main
 
 import (
@@ -11,6 +10,14 @@ import (
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ICMP protocol numbers, see
+// https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xhtml
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
 )
 
 var nextPingCheckerID = os.Getpid() & 0xffff
@@ -41,7 +48,7 @@ func newPingChecker(device, address string, timeout Duration) (*pingChecker, err
 func (pc *pingChecker) Check() error {
 	seq := pc.Seqnum
 	pc.Seqnum++
-	echo, err := newICMPv4EchoRequest(pc.ID, seq, []byte("Healthcheck"))
+	echo, err := newICMPEchoRequest(pc.IP, pc.ID, seq, []byte("Healthcheck"))
 	if err != nil {
 		return fmt.Errorf("Cannot construct icmp echo: %v", err)
 	}
@@ -53,10 +60,15 @@ func (pc *pingChecker) TargetIP() string {
 	return pc.IP.String()
 }
 
-func newICMPv4EchoRequest(id, seqnum int, data []byte) ([]byte, error) {
-
+// newICMPEchoRequest returns an ICMP echo request of the family matching the
+// target ip.
+func newICMPEchoRequest(ip netip.Addr, id, seqnum int, data []byte) ([]byte, error) {
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if ip.Is6() {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
 	wm := icmp.Message{
-		Type: ipv4.ICMPTypeEcho, Code: 0,
+		Type: typ, Code: 0,
 		Body: &icmp.Echo{
 			ID:   id,
 			Seq:  seqnum,
@@ -67,7 +79,13 @@ func newICMPv4EchoRequest(id, seqnum int, data []byte) ([]byte, error) {
 }
 
 func exchangeICMPEcho(ip netip.Addr, timeout time.Duration, echo []byte) error {
-	c, err := net.ListenPacket("ip4:icmp", "")
+	network, proto := "ip4:icmp", protocolICMP
+	var replyType icmp.Type = ipv4.ICMPTypeEchoReply
+	if ip.Is6() {
+		network, proto = "ip6:ipv6-icmp", protocolIPv6ICMP
+		replyType = ipv6.ICMPTypeEchoReply
+	}
+	c, err := net.ListenPacket(network, "")
 	if err != nil {
 		return err
 	}
@@ -93,16 +111,14 @@ func exchangeICMPEcho(ip netip.Addr, timeout time.Duration, echo []byte) error {
 		if ip != rip {
 			continue
 		}
-		// 1 == ipv4 ICMP proto number
-		// https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xhtml
-		rm, err := icmp.ParseMessage(1, reply[:n])
+		rm, err := icmp.ParseMessage(proto, reply[:n])
 		if err != nil {
 			return fmt.Errorf("Cannot parse icmp response: %v", err)
 		}
-		if rm.Type != ipv4.ICMPTypeEchoReply {
+		if rm.Type != replyType {
 			continue
 		}
-		em, err := icmp.ParseMessage(1, echo)
+		em, err := icmp.ParseMessage(proto, echo)
 		if err != nil {
 			return fmt.Errorf("Cannot parse echo request for veryfication: %v", err)
 		}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// accessPolicy grants the networks in AllowedIPs to users whose token claims
+// match it. A policy matches when every non-empty criterion matches: one of
+// the user's groups is in Groups, the domain of the user's email is in
+// EmailDomains and the token was issued by one of Issuers. A policy without
+// criteria matches everyone.
+type accessPolicy struct {
+	Groups       []string `json:"groups"`
+	EmailDomains []string `json:"emailDomains"`
+	Issuers      []string `json:"issuers"`
+	AllowedIPs   []string `json:"allowedIPs"`
+}
+
+func (p accessPolicy) matches(tokenInfo *introspectionResponse) bool {
+	if len(p.Groups) > 0 && !containsAny(tokenInfo.Groups, p.Groups) {
+		return false
+	}
+	if len(p.EmailDomains) > 0 && !containsFold(p.EmailDomains, emailDomain(tokenInfo)) {
+		return false
+	}
+	if len(p.Issuers) > 0 && !contains(p.Issuers, tokenInfo.Issuer) {
+		return false
+	}
+	return true
+}
+
+// emailDomain returns the domain of the token's email claim, or an empty
+// string if there is none or the identity provider says it is not verified.
+func emailDomain(tokenInfo *introspectionResponse) string {
+	email := tokenInfo.verifiedEmail()
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+	return email[i+1:]
+}
+
+// authorize checks the token against the authorization rules of the OAuth
+// server that issued it, and returns the reason the user is refused a lease,
+// if they are. Denied users are always refused. Otherwise every non-empty rule
+// must match: the user is one of AllowedUsers, the token was issued for one of
+// Audiences, the domain of the user's email is one of EmailDomains and one of
+// the user's groups is in Groups. Usernames and email domains are compared
+// case-insensitively. Tokens of issuers that are not configured, as happens
+// if the config is reloaded meanwhile, are refused.
+func authorize(conf *serverConfig, tokenInfo *introspectionResponse) error {
+	var server *oauthServerConfig
+	for i, s := range conf.OauthServers {
+		if s.Server == tokenInfo.Issuer {
+			server = &conf.OauthServers[i]
+			break
+		}
+	}
+	if server == nil {
+		return fmt.Errorf("no oauth server configured for issuer %q", tokenInfo.Issuer)
+	}
+	if containsFold(server.DeniedUsers, tokenInfo.UserName) {
+		return fmt.Errorf("user %q is denied", tokenInfo.UserName)
+	}
+	if len(server.AllowedUsers) > 0 && !containsFold(server.AllowedUsers, tokenInfo.UserName) {
+		return fmt.Errorf("user %q is not allowed", tokenInfo.UserName)
+	}
+	if len(server.Audiences) > 0 && !containsAny(tokenInfo.Audience, server.Audiences) {
+		return fmt.Errorf("token is not issued for any of the allowed audiences")
+	}
+	if len(server.EmailDomains) > 0 {
+		domain := emailDomain(tokenInfo)
+		if domain == "" {
+			return fmt.Errorf("token has no verified email")
+		}
+		if !containsFold(server.EmailDomains, domain) {
+			return fmt.Errorf("email domain %q is not allowed", domain)
+		}
+	}
+	if len(server.Groups) > 0 && !containsAny(tokenInfo.Groups, server.Groups) {
+		return fmt.Errorf("user is not a member of any of the required groups")
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny reports whether any of the values is in the list.
+func containsAny(list, values []string) bool {
+	for _, v := range values {
+		if contains(list, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// grantedNetworks returns the networks of all the policies matching the token,
+// in the order they are configured, along with the server's own addresses.
+// With no policies configured it returns nil, meaning that all of the
+// server's allowed IPs are granted. The boolean is false if policies are
+// configured but none of them match.
+func grantedNetworks(conf *serverConfig, tokenInfo *introspectionResponse) ([]string, bool) {
+	if len(conf.Policies) == 0 {
+		return nil, true
+	}
+	networks := []string{}
+	matched := false
+	for _, p := range conf.Policies {
+		if !p.matches(tokenInfo) {
+			continue
+		}
+		matched = true
+		for _, n := range p.AllowedIPs {
+			if !contains(networks, n) {
+				networks = append(networks, n)
+			}
+		}
+	}
+	if !matched {
+		return nil, false
+	}
+	// Agents may always reach the server's wireguard addresses, for health
+	// checking.
+	for _, n := range serverAddressCIDRs(conf) {
+		if !contains(networks, n) {
+			networks = append(networks, n)
+		}
+	}
+	return networks, true
+}
+
+// serverAddressCIDRs returns the single address CIDRs of the server's
+// wireguard addresses.
+func serverAddressCIDRs(conf *serverConfig) []string {
+	cidrs := []string{fmt.Sprintf("%s/32", conf.WireguardIPPrefix.Addr().String())}
+	if conf.WireguardIP6Prefix.IsValid() {
+		cidrs = append(cidrs, fmt.Sprintf("%s/128", conf.WireguardIP6Prefix.Addr().String()))
+	}
+	return cidrs
+}
+
+// verifyPolicies checks that every policy grants at least one network and
+// that all the networks are within the server's allowed IPs.
+func verifyPolicies(conf *serverConfig) error {
+	allowed := make([]netip.Prefix, 0, len(conf.AllowedIPs))
+	for _, cidr := range conf.AllowedIPs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid `allowedIPs` entry %q: %w", cidr, err)
+		}
+		allowed = append(allowed, p.Masked())
+	}
+	for i, p := range conf.Policies {
+		if len(p.AllowedIPs) == 0 {
+			return fmt.Errorf("policies[%d] missing `allowedIPs`", i)
+		}
+		for _, cidr := range p.AllowedIPs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("policies[%d]: invalid `allowedIPs` entry %q: %w", i, cidr, err)
+			}
+			if !prefixWithinAny(prefix.Masked(), allowed) {
+				return fmt.Errorf("policies[%d]: %s is not within the server `allowedIPs`", i, cidr)
+			}
+		}
+	}
+	return nil
+}
+
+func prefixWithinAny(p netip.Prefix, prefixes []netip.Prefix) bool {
+	for _, q := range prefixes {
+		if q.Bits() <= p.Bits() && q.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrantedNetworks(t *testing.T) {
+	conf := &serverConfig{
+		AllowedIPs:        []string{"10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16", "10.90.0.1/32"},
+		WireguardIPPrefix: netip.MustParsePrefix("10.90.0.1/20"),
+		Policies: []accessPolicy{
+			{Groups: []string{"staff"}, AllowedIPs: []string{"10.1.0.0/16", "10.2.0.0/16"}},
+			{EmailDomains: []string{"contractor.example.com"}, AllowedIPs: []string{"10.2.0.0/16"}},
+			{
+				Groups:     []string{"sre"},
+				Issuers:    []string{"https://idp.example.com"},
+				AllowedIPs: []string{"10.2.0.0/16", "10.3.0.0/16"},
+			},
+		},
+	}
+	testCases := []struct {
+		name      string
+		tokenInfo *introspectionResponse
+		networks  []string
+		ok        bool
+	}{
+		{
+			"single group",
+			&introspectionResponse{UserName: "a@example.com", Groups: []string{"staff"}},
+			[]string{"10.1.0.0/16", "10.2.0.0/16", "10.90.0.1/32"},
+			true,
+		},
+		{
+			"email domain",
+			&introspectionResponse{UserName: "b", Email: "b@Contractor.example.com"},
+			[]string{"10.2.0.0/16", "10.90.0.1/32"},
+			true,
+		},
+		{
+			"unverified email",
+			&introspectionResponse{UserName: "b", Email: "b@contractor.example.com", EmailVerified: new(claimBool)},
+			nil,
+			false,
+		},
+		{
+			"username is not an email",
+			&introspectionResponse{UserName: "b@contractor.example.com"},
+			nil,
+			false,
+		},
+		{
+			"union of matching policies",
+			&introspectionResponse{
+				UserName: "c",
+				Email:    "c@contractor.example.com",
+				Groups:   []string{"sre"},
+				Issuer:   "https://idp.example.com",
+			},
+			[]string{"10.2.0.0/16", "10.3.0.0/16", "10.90.0.1/32"},
+			true,
+		},
+		{
+			"all criteria must match",
+			&introspectionResponse{UserName: "d@example.com", Groups: []string{"sre"}, Issuer: "https://other.example.com"},
+			nil,
+			false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			networks, ok := grantedNetworks(conf, tc.tokenInfo)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.networks, networks)
+		})
+	}
+
+	// Without policies all networks are granted.
+	networks, ok := grantedNetworks(&serverConfig{AllowedIPs: conf.AllowedIPs}, &introspectionResponse{})
+	assert.True(t, ok)
+	assert.Nil(t, networks)
+}
+
+func TestVerifyPolicies(t *testing.T) {
+	allowedIPs := []string{"10.1.0.0/16", "fd00:1::/48", "10.90.0.1/32"}
+	testCases := []struct {
+		name     string
+		policies []accessPolicy
+		err      bool
+	}{
+		{"subnets", []accessPolicy{{AllowedIPs: []string{"10.1.2.0/24", "10.1.0.0/16", "fd00:1:0:2::/64"}}}, false},
+		{"server address", []accessPolicy{{AllowedIPs: []string{"10.90.0.1/32"}}}, false},
+		{"no networks", []accessPolicy{{Groups: []string{"staff"}}}, true},
+		{"invalid network", []accessPolicy{{AllowedIPs: []string{"10.1.0.0"}}}, true},
+		{"broader network", []accessPolicy{{AllowedIPs: []string{"10.0.0.0/8"}}}, true},
+		{"other network", []accessPolicy{{AllowedIPs: []string{"10.2.0.0/24"}}}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyPolicies(&serverConfig{AllowedIPs: allowedIPs, Policies: tc.policies})
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	conf := &serverConfig{
+		OauthServers: []oauthServerConfig{
+			{
+				Server:       "https://idp.example.com",
+				Audiences:    []string{"wiresteward"},
+				EmailDomains: []string{"example.com"},
+				Groups:       []string{"engineering"},
+				DeniedUsers:  []string{"Mallory@example.com"},
+			},
+			{Server: "https://open.example.com", AllowedUsers: []string{"alice"}},
+		},
+	}
+	engineer := func() *introspectionResponse {
+		verified := claimBool(true)
+		return &introspectionResponse{
+			UserName:      "a@example.com",
+			Email:         "a@example.com",
+			EmailVerified: &verified,
+			Groups:        []string{"staff", "engineering"},
+			Issuer:        "https://idp.example.com",
+			Audience:      []string{"other", "wiresteward"},
+		}
+	}
+	testCases := []struct {
+		name      string
+		tokenInfo func() *introspectionResponse
+		err       string
+	}{
+		{"all rules match", engineer, ""},
+		{
+			"denied user",
+			func() *introspectionResponse { r := engineer(); r.UserName = "mallory@example.com"; return r },
+			`user "mallory@example.com" is denied`,
+		},
+		{
+			"wrong audience",
+			func() *introspectionResponse { r := engineer(); r.Audience = []string{"other"}; return r },
+			"token is not issued for any of the allowed audiences",
+		},
+		{
+			"no audience",
+			func() *introspectionResponse { r := engineer(); r.Audience = nil; return r },
+			"token is not issued for any of the allowed audiences",
+		},
+		{
+			"email domain",
+			func() *introspectionResponse { r := engineer(); r.Email = "a@partner.example.org"; return r },
+			`email domain "partner.example.org" is not allowed`,
+		},
+		{
+			"unverified email",
+			func() *introspectionResponse { r := engineer(); r.EmailVerified = new(claimBool); return r },
+			"token has no verified email",
+		},
+		{
+			"no email",
+			func() *introspectionResponse { r := engineer(); r.Email = ""; return r },
+			"token has no verified email",
+		},
+		{
+			"missing group",
+			func() *introspectionResponse { r := engineer(); r.Groups = []string{"sales"}; return r },
+			"user is not a member of any of the required groups",
+		},
+		{
+			"allowed user",
+			func() *introspectionResponse {
+				return &introspectionResponse{UserName: "Alice", Issuer: "https://open.example.com"}
+			},
+			"",
+		},
+		{
+			"not allowed user",
+			func() *introspectionResponse {
+				return &introspectionResponse{UserName: "bob", Issuer: "https://open.example.com"}
+			},
+			`user "bob" is not allowed`,
+		},
+		{
+			"unknown issuer",
+			func() *introspectionResponse {
+				return &introspectionResponse{UserName: "alice", Issuer: "https://other.example.com"}
+			},
+			`no oauth server configured for issuer "https://other.example.com"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := authorize(conf, tc.tokenInfo())
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// reloadableConfigFields are the serverConfig fields that can be changed
+// without restarting the server.
+var reloadableConfigFields = map[string]bool{
+	"AllowedIPs":                true,
+	"LeaserSyncInterval":        true,
+	"MaxLeaseDuration":          true,
+	"MinLeaseDuration":          true,
+	"OauthServers":              true,
+	"Policies":                  true,
+	"TokenRevalidationInterval": true,
+}
+
+// derivedConfigFields are the serverConfig fields computed from other fields
+// while verifying the config. Changes to them are reported against the fields
+// they are derived from.
+var derivedConfigFields = map[string]bool{
+	"ReservedAddresses":  true,
+	"WireguardIPPrefix":  true,
+	"WireguardIP6Prefix": true,
+}
+
+// checkReloadableConfig returns an error naming the config keys that differ
+// between the running and the new config and cannot be changed without a
+// restart.
+func checkReloadableConfig(running, cfg *serverConfig) error {
+	rv, cv := reflect.ValueOf(running).Elem(), reflect.ValueOf(cfg).Elem()
+	changed := []string{}
+	for i := 0; i < rv.NumField(); i++ {
+		name := rv.Type().Field(i).Name
+		if reloadableConfigFields[name] || derivedConfigFields[name] {
+			continue
+		}
+		if !reflect.DeepEqual(rv.Field(i).Interface(), cv.Field(i).Interface()) {
+			changed = append(changed, "`"+configKey(name)+"`")
+		}
+	}
+	// Changing how the users of a server are identified renames them, which
+	// would have every agent given a new lease, so it needs a restart too.
+	for i, s := range cfg.OauthServers {
+		for _, r := range running.OauthServers {
+			if r.Server != s.Server {
+				continue
+			}
+			if r.UsernameClaim != s.UsernameClaim {
+				changed = append(changed, fmt.Sprintf("`oauthServers[%d].usernameClaim`", i))
+			}
+			if r.UsernamePrefix != s.UsernamePrefix {
+				changed = append(changed, fmt.Sprintf("`oauthServers[%d].usernamePrefix`", i))
+			}
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("cannot change %s without a restart", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// configKey returns the config file key of a serverConfig field.
+func configKey(field string) string {
+	r, size := utf8.DecodeRuneInString(field)
+	return string(unicode.ToLower(r)) + field[size:]
+}
+
+// resetTicker makes the ticker tick every d, or stops it if d is not
+// positive.
+func resetTicker(t *time.Ticker, d time.Duration) {
+	if d > 0 {
+		t.Reset(d)
+	} else {
+		t.Stop()
+	}
+}
+
+// serverReloader re-reads the server config file and applies the changes that
+// are safe to make while the server is running. A config with any other
+// changes is rejected as a whole and the running config is kept.
+type serverReloader struct {
+	allowPublicRoutes  bool
+	configFile         string
+	config             *serverConfig // the running config
+	device             *ServerDevice
+	firewall           *peerFirewall // nil unless the peer firewall is enabled
+	leaseHandler       *HTTPLeaseHandler
+	leaseManager       *leaseManager
+	revalidationTicker *time.Ticker
+	syncTicker         *time.Ticker
+	tokenValidator     *tokenValidator
+}
+
+// reload reads, verifies and applies the config file. It must not be called
+// concurrently.
+func (sr *serverReloader) reload() error {
+	cfg, err := readServerConfig(sr.configFile, sr.allowPublicRoutes)
+	if err != nil {
+		return err
+	}
+	if err := checkReloadableConfig(sr.config, cfg); err != nil {
+		return err
+	}
+	// Apply the steps that can fail first, so that a failure leaves the
+	// running config in place.
+	serversChanged := !reflect.DeepEqual(sr.config.OauthServers, cfg.OauthServers)
+	var servers map[string]oauthServer
+	if serversChanged {
+		if servers, err = sr.tokenValidator.discoverServers(cfg.OauthServers); err != nil {
+			return err
+		}
+	}
+	if !reflect.DeepEqual(sr.config.AllowedIPs, cfg.AllowedIPs) {
+		if err := sr.applyAllowedIPs(cfg); err != nil {
+			if rerr := sr.applyAllowedIPs(sr.config); rerr != nil {
+				logger.Errorf("Cannot restore the running allowed IPs: %v", rerr)
+			}
+			return err
+		}
+	}
+	if serversChanged {
+		sr.tokenValidator.replaceServers(servers)
+		initTokenValidationSeries(sr.tokenValidator.issuers())
+	}
+	sr.leaseHandler.setConfig(cfg)
+	if cfg.LeaserSyncInterval != sr.config.LeaserSyncInterval {
+		resetTicker(sr.syncTicker, cfg.LeaserSyncInterval)
+	}
+	if cfg.TokenRevalidationInterval != sr.config.TokenRevalidationInterval {
+		resetTicker(sr.revalidationTicker, cfg.TokenRevalidationInterval)
+	}
+	policiesChanged := !reflect.DeepEqual(sr.config.Policies, cfg.Policies)
+	sr.config = cfg
+	logger.Verbosef("Reloaded config from %s", sr.configFile)
+	// The config is in place by now, so failing to apply it to some of the
+	// existing leases does not fail the reload.
+	if serversChanged || policiesChanged {
+		if err := sr.leaseManager.reauthorizeLeases(cfg, func(token string) (*introspectionResponse, error) {
+			return sr.tokenValidator.validate(token, "access_token")
+		}); err != nil {
+			logger.Errorf("Cannot apply the reloaded config to existing leases: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyAllowedIPs updates the masquerade rules, and the peer firewall if it is
+// enabled, to match the allowedIPs of cfg.
+func (sr *serverReloader) applyAllowedIPs(cfg *serverConfig) error {
+	if err := sr.device.updateMasqueradeRules(cfg); err != nil {
+		return fmt.Errorf("cannot update masquerade rules: %w", err)
+	}
+	if sr.firewall != nil {
+		sr.firewall.setAllowedIPs(cfg.AllowedIPs)
+		return sr.leaseManager.updateWgPeers()
+	}
+	return nil
+}
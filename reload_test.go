@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const reloadTestConfig = `{
+	"address": "10.90.0.1/20",
+	"allowedIPs": ["10.1.0.0/16"],
+	"endpoint": "1.2.3.4:51820",
+	"oauthServers": [{"server": "https://idp.example.com", "clientID": "client_id"}]
+	%s
+}`
+
+func writeReloadTestConfig(t *testing.T, filename, extra string) *serverConfig {
+	content := []byte(fmt.Sprintf(reloadTestConfig, extra))
+	if err := os.WriteFile(filename, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readServerConfig(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestCheckReloadableConfig(t *testing.T) {
+	running := &serverConfig{
+		Address:            "10.90.0.1/20",
+		AllowedIPs:         []string{"10.1.0.0/16"},
+		DeviceName:         "wg0",
+		LeaserSyncInterval: time.Minute,
+	}
+	cfg := *running
+	cfg.AllowedIPs = []string{"10.1.0.0/16", "10.2.0.0/16"}
+	cfg.LeaserSyncInterval = 30 * time.Second
+	cfg.MaxLeaseDuration = 8 * time.Hour
+	cfg.Policies = []accessPolicy{{Groups: []string{"staff"}, AllowedIPs: []string{"10.1.0.0/16"}}}
+	cfg.TokenRevalidationInterval = 5 * time.Minute
+	assert.NoError(t, checkReloadableConfig(running, &cfg))
+
+	cfg.DeviceName = "wg1"
+	cfg.Reservations = map[string]string{"alice": "10.90.0.10"}
+	assert.EqualError(
+		t,
+		checkReloadableConfig(running, &cfg),
+		"cannot change `deviceName`, `reservations` without a restart",
+	)
+
+	// Servers can be added, but the users of a server cannot be renamed.
+	running.OauthServers = []oauthServerConfig{{Server: "https://idp.example.com", UsernameClaim: "email"}}
+	cfg = *running
+	cfg.OauthServers = []oauthServerConfig{
+		{Server: "https://other.example.com"},
+		{Server: "https://idp.example.com", UsernameClaim: "email"},
+	}
+	assert.NoError(t, checkReloadableConfig(running, &cfg))
+	cfg.OauthServers[1].UsernameClaim = "sub"
+	cfg.OauthServers[1].UsernamePrefix = "corp/"
+	assert.EqualError(
+		t,
+		checkReloadableConfig(running, &cfg),
+		"cannot change `oauthServers[1].usernameClaim`, `oauthServers[1].usernamePrefix` without a restart",
+	)
+}
+
+func TestServerReloader(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	filename := filepath.Join(t.TempDir(), "config.json")
+	cfg := writeReloadTestConfig(t, filename, "")
+
+	syncTicker := time.NewTicker(cfg.LeaserSyncInterval)
+	defer syncTicker.Stop()
+	revalidationTicker := time.NewTicker(time.Hour)
+	defer revalidationTicker.Stop()
+	resetTicker(revalidationTicker, cfg.TokenRevalidationInterval)
+	lh := &HTTPLeaseHandler{serverConfig: cfg}
+	sr := &serverReloader{
+		configFile:         filename,
+		config:             cfg,
+		leaseHandler:       lh,
+		leaseManager:       &leaseManager{wgRecords: map[leaseKey]WGRecord{}},
+		revalidationTicker: revalidationTicker,
+		syncTicker:         syncTicker,
+	}
+
+	writeReloadTestConfig(t, filename, `,
+	"leaserSyncInterval": "10ms",
+	"maxLeaseDuration": "8h",
+	"policies": [{"groups": ["staff"], "allowedIPs": ["10.1.0.0/16"]}]`)
+	assert.NoError(t, sr.reload())
+	assert.Equal(t, 8*time.Hour, lh.config().MaxLeaseDuration)
+	assert.Equal(t, 1, len(lh.config().Policies))
+	select {
+	case <-syncTicker.C:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync ticker was not reset")
+	}
+
+	// A change that needs a restart is rejected and the running config is
+	// kept.
+	writeReloadTestConfig(t, filename, `,
+	"deviceName": "wg1",
+	"maxLeaseDuration": "4h"`)
+	assert.EqualError(t, sr.reload(), "cannot change `deviceName` without a restart")
+	assert.Equal(t, 8*time.Hour, lh.config().MaxLeaseDuration)
+
+	// So is an invalid config.
+	if err := os.WriteFile(filename, []byte(`{"address": "10.90.0.1/20"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, sr.reload())
+	assert.Equal(t, 8*time.Hour, lh.config().MaxLeaseDuration)
+
+	// A malformed address is an error rather than a panic.
+	content := strings.Replace(fmt.Sprintf(reloadTestConfig, ""), "10.90.0.1/20", "10.90.0.1/", 1)
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorContains(t, sr.reload(), "invalid `address` value")
+	assert.Equal(t, 8*time.Hour, lh.config().MaxLeaseDuration)
+}
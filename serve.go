@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,29 +18,140 @@ const (
 )
 
 // leaseRequest defines the payload of a lease HTTP request submitted by an
-// agent.
+// agent. DeviceID is a stable identifier of the agent machine, which allows a
+// user to hold concurrent leases from multiple machines. Hostname is
+// informational only.
 type leaseRequest struct {
-	PubKey string
+	PubKey   string
+	DeviceID string
+	Hostname string
+}
+
+// leaseRequestFieldRe matches acceptable device IDs and hostnames. Both end
+// up in the leases file, so whitespace in particular must be rejected, as must
+// the marker of empty fields, leasesFileEmptyField.
+var leaseRequestFieldRe = regexp.MustCompile(`^[A-Za-z0-9._-]{0,253}$`)
+
+// usernameRe matches acceptable usernames, including the usernamePrefix of
+// their OAuth server. Usernames end up in the leases file, the audit log and
+// the admin API, so whitespace and control characters are rejected.
+var usernameRe = regexp.MustCompile(`^[^\s\p{Z}\p{C}]{1,256}$`)
+
+func (lr leaseRequest) validate() error {
+	if !validDeviceID(lr.DeviceID) {
+		return fmt.Errorf("invalid device id %q", lr.DeviceID)
+	}
+	if !validHostname(lr.Hostname) {
+		return fmt.Errorf("invalid hostname %q", lr.Hostname)
+	}
+	return nil
+}
+
+// validDeviceID reports whether the device id of a lease request is
+// acceptable. Agents check theirs too, so that they do not send one that every
+// request would be refused for.
+func validDeviceID(deviceID string) bool {
+	return len(deviceID) <= 64 && validHostname(deviceID)
+}
+
+// validHostname reports whether the hostname of a lease request is acceptable.
+func validHostname(hostname string) bool {
+	return leaseRequestFieldRe.MatchString(hostname) && hostname != leasesFileEmptyField
 }
 
 // leaseResponse define the payload of a lease HTTP response returned by a
 // server.
 type leaseResponse struct {
-	Status            string
-	IP                string
-	ServerWireguardIP string
-	AllowedIPs        []string
-	PubKey            string
-	Endpoint          string
+	Status             string
+	IP                 string
+	IP6                string `json:",omitempty"`
+	ServerWireguardIP  string
+	ServerWireguardIP6 string `json:",omitempty"`
+	AllowedIPs         []string
+	PubKey             string
+	PresharedKey       string `json:",omitempty"`
+	Endpoint           string
+	Expires            time.Time `json:",omitzero"`
+}
+
+// errorResponse defines the payload of a lease HTTP response returned by a
+// server when a lease cannot be granted, for errors that the agent should
+// surface to the user.
+type errorResponse struct {
+	Status  string
+	Message string
+}
+
+// writeErrorResponse replies with the given status code and a JSON encoded
+// errorResponse.
+func writeErrorResponse(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(&errorResponse{Status: "error", Message: message}); err != nil {
+		logger.Errorf("Cannot encode error response: %v", err)
+	}
+}
+
+// leaseExpiry returns the expiry of a lease granted at now for a token that
+// expires at tokenExpiry, clamped to the configured lease duration bounds.
+func leaseExpiry(conf *serverConfig, now, tokenExpiry time.Time) time.Time {
+	expiry := tokenExpiry
+	if conf.MaxLeaseDuration > 0 && expiry.After(now.Add(conf.MaxLeaseDuration)) {
+		expiry = now.Add(conf.MaxLeaseDuration)
+	}
+	if conf.MinLeaseDuration > 0 && expiry.Before(now.Add(conf.MinLeaseDuration)) {
+		expiry = now.Add(conf.MinLeaseDuration)
+	}
+	return expiry
 }
 
 // HTTPLeaseHandler implements the HTTP server that manages peer address leases.
 type HTTPLeaseHandler struct {
-	leaseManager   *fileLeaseManager
+	audit          *auditLog
+	certs          *certReloader // nil unless the server serves TLS
+	leaseManager   *leaseManager
 	serverConfig   *serverConfig
+	configMutex    sync.RWMutex
 	tokenValidator *tokenValidator
 }
 
+// config returns the current server configuration.
+func (lh *HTTPLeaseHandler) config() *serverConfig {
+	lh.configMutex.RLock()
+	defer lh.configMutex.RUnlock()
+	return lh.serverConfig
+}
+
+// setConfig replaces the server configuration used for new lease requests.
+func (lh *HTTPLeaseHandler) setConfig(cfg *serverConfig) {
+	lh.configMutex.Lock()
+	defer lh.configMutex.Unlock()
+	lh.serverConfig = cfg
+}
+
+// sourceIP returns the address the request was sent from.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// reject records a rejected lease request in the audit log.
+func (lh *HTTPLeaseHandler) reject(r *http.Request, tokenInfo *introspectionResponse, p leaseRequest, reason string) {
+	lh.audit.record(leaseEvent{
+		Event:    leaseEventRejected,
+		Username: tokenInfo.UserName,
+		DeviceID: p.DeviceID,
+		Hostname: p.Hostname,
+		PubKey:   p.PubKey,
+		Issuer:   tokenInfo.Issuer,
+		SourceIP: sourceIP(r),
+		Reason:   reason,
+	})
+}
+
 func extractBearerTokenFromHeader(req *http.Request, header string) (string, error) {
 	authHeader := req.Header.Get(header)
 	if authHeader == "" {
@@ -73,13 +188,25 @@ func (lh *HTTPLeaseHandler) newPeerLease(w http.ResponseWriter, r *http.Request)
 			return
 		}
 		if !tokenInfo.Active {
+			lh.reject(r, tokenInfo, leaseRequest{}, "invalid token")
 			http.Error(w, "invalid token", http.StatusForbidden)
 			return
 		}
 		if tokenInfo.Exp <= 0 {
+			lh.reject(r, tokenInfo, leaseRequest{}, "token does not expire")
 			http.Error(w, "token does not expire, cannot accept this", http.StatusBadRequest)
 			return
 		}
+		if tokenInfo.UserName == "" {
+			lh.reject(r, tokenInfo, leaseRequest{}, "token does not identify the user")
+			http.Error(w, "token does not identify the user", http.StatusForbidden)
+			return
+		}
+		if !usernameRe.MatchString(tokenInfo.UserName) {
+			lh.reject(r, tokenInfo, leaseRequest{}, "invalid username")
+			http.Error(w, "token username is not valid", http.StatusForbidden)
+			return
+		}
 		decoder := json.NewDecoder(r.Body)
 		var p leaseRequest
 		if err := decoder.Decode(&p); err != nil {
@@ -87,7 +214,52 @@ func (lh *HTTPLeaseHandler) newPeerLease(w http.ResponseWriter, r *http.Request)
 			http.Error(w, "Cannot decode request body", http.StatusInternalServerError)
 			return
 		}
-		wg, err := lh.leaseManager.addNewPeer(tokenInfo.UserName, p.PubKey, time.Unix(tokenInfo.Exp, 0))
+		if err := p.validate(); err != nil {
+			lh.reject(r, tokenInfo, leaseRequest{PubKey: p.PubKey}, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conf := lh.config()
+		if err := authorize(conf, tokenInfo); err != nil {
+			logger.Errorf("Refusing a lease to %s: %v", tokenInfo.UserName, err)
+			lh.reject(r, tokenInfo, p, err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		networks, ok := grantedNetworks(conf, tokenInfo)
+		if !ok {
+			logger.Errorf("No policy grants access to %s", tokenInfo.UserName)
+			lh.reject(r, tokenInfo, p, "no policy grants access to any network")
+			http.Error(w, "no policy grants access to any network", http.StatusForbidden)
+			return
+		}
+		wg, err := lh.leaseManager.addNewPeer(leaseParams{
+			Username: tokenInfo.UserName,
+			Groups:   tokenInfo.Groups,
+			DeviceID: p.DeviceID,
+			Hostname: p.Hostname,
+			PubKey:   p.PubKey,
+			Expiry:   leaseExpiry(conf, time.Now(), time.Unix(tokenInfo.Exp, 0)),
+			Token:    token,
+			Networks: networks,
+			Issuer:   tokenInfo.Issuer,
+			SourceIP: sourceIP(r),
+		})
+		if errors.Is(err, errDeviceLimitReached) {
+			lh.reject(r, tokenInfo, p, err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, errAddressPoolExhausted) {
+			logger.Errorf("Cannot lease an address to %s: %v", tokenInfo.UserName, err)
+			lh.reject(r, tokenInfo, p, err.Error())
+			writeErrorResponse(
+				w,
+				http.StatusServiceUnavailable,
+				"the server has no free addresses left, please try again later",
+			)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -100,10 +272,19 @@ func (lh *HTTPLeaseHandler) newPeerLease(w http.ResponseWriter, r *http.Request)
 		response := &leaseResponse{
 			Status:            "success",
 			IP:                fmt.Sprintf("%s/32", wg.IP.String()),
-			ServerWireguardIP: lh.serverConfig.WireguardIPPrefix.Addr().String(),
-			AllowedIPs:        lh.serverConfig.AllowedIPs,
+			ServerWireguardIP: conf.WireguardIPPrefix.Addr().String(),
+			AllowedIPs:        conf.AllowedIPs,
 			PubKey:            pubKey,
-			Endpoint:          lh.serverConfig.Endpoint,
+			PresharedKey:      wg.PresharedKey,
+			Endpoint:          conf.Endpoint,
+			Expires:           wg.expires.UTC(),
+		}
+		if networks != nil {
+			response.AllowedIPs = networks
+		}
+		if wg.IP6.IsValid() {
+			response.IP6 = fmt.Sprintf("%s/128", wg.IP6.String())
+			response.ServerWireguardIP6 = conf.WireguardIP6Prefix.Addr().String()
 		}
 		r, err := json.Marshal(response)
 		if err != nil {
@@ -120,8 +301,17 @@ func (lh *HTTPLeaseHandler) newPeerLease(w http.ResponseWriter, r *http.Request)
 func (lh *HTTPLeaseHandler) start() {
 	http.HandleFunc("/newPeerLease", lh.newPeerLease)
 
-	logger.Verbosef("Starting server for lease requests")
-	if err := http.ListenAndServe(lh.serverConfig.ServerListenAddress, nil); err != nil {
+	server := &http.Server{Addr: lh.config().ServerListenAddress}
+	var err error
+	if lh.certs != nil {
+		logger.Verbosef("Starting TLS server for lease requests")
+		server.TLSConfig = lh.certs.tlsConfig()
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logger.Verbosef("Starting server for lease requests")
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		logger.Errorf("%v", err)
 		os.Exit(1)
 	}
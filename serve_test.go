@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaseExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		conf        *serverConfig
+		tokenExpiry time.Time
+		expected    time.Time
+	}{
+		// No bounds: the lease lasts as long as the token.
+		{&serverConfig{}, now.Add(24 * time.Hour), now.Add(24 * time.Hour)},
+		// Long-lived tokens are capped.
+		{&serverConfig{MaxLeaseDuration: 8 * time.Hour}, now.Add(24 * time.Hour), now.Add(8 * time.Hour)},
+		{&serverConfig{MaxLeaseDuration: 8 * time.Hour}, now.Add(time.Hour), now.Add(time.Hour)},
+		// Short-lived tokens are extended.
+		{&serverConfig{MinLeaseDuration: 30 * time.Minute}, now.Add(5 * time.Minute), now.Add(30 * time.Minute)},
+		{
+			&serverConfig{MinLeaseDuration: 30 * time.Minute, MaxLeaseDuration: 8 * time.Hour},
+			now.Add(2 * time.Hour),
+			now.Add(2 * time.Hour),
+		},
+	}
+	for i, tc := range testCases {
+		assert.Equal(t, tc.expected, leaseExpiry(tc.conf, now, tc.tokenExpiry), "test case %d", i)
+	}
+}
+
+func TestLeaseRequestValidate(t *testing.T) {
+	testCases := []struct {
+		request leaseRequest
+		valid   bool
+	}{
+		{leaseRequest{}, true},
+		{leaseRequest{DeviceID: "3f2a9c1e-laptop", Hostname: "jane.example.com"}, true},
+		{leaseRequest{DeviceID: "laptop 1"}, false},
+		{leaseRequest{Hostname: "jane\nexample"}, false},
+		{leaseRequest{DeviceID: strings.Repeat("a", 65)}, false},
+		// The marker of empty fields in the leases file.
+		{leaseRequest{DeviceID: "-"}, false},
+		{leaseRequest{Hostname: "-"}, false},
+		{leaseRequest{DeviceID: "--"}, true},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.valid, tc.request.validate() == nil, "%+v", tc.request)
+	}
+}
+
+func TestUsernameRe(t *testing.T) {
+	for username, valid := range map[string]bool{
+		"alice":                  true,
+		"corp/alice@example.com": true,
+		"Zoë":                    true,
+		"":                       false,
+		"alice smith":            false,
+		"alice\nbob":             false,
+		"alice\u00a0smith":       false,
+		"alice\u200b":            false,
+		strings.Repeat("a", 257): false,
+	} {
+		assert.Equal(t, valid, usernameRe.MatchString(username), "%q", username)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate of the lease server, and the CAs that
+// client certificates are verified against, from files. The files are checked
+// for changes on every handshake and loaded again when they change, so that
+// renewed certificates are picked up without a restart. If loading fails, as
+// can happen while the files are being replaced, the previous ones keep being
+// used, and loading is not tried again until the files change again.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string // empty unless client certificates are required
+	config       *tls.Config
+	modTimes     []time.Time
+	mutex        sync.Mutex
+}
+
+func newCertReloader(certFile, keyFile, clientCAFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	modTimes, err := cr.stat()
+	if err != nil {
+		return nil, err
+	}
+	config, err := cr.load()
+	if err != nil {
+		return nil, err
+	}
+	cr.config, cr.modTimes = config, modTimes
+	return cr, nil
+}
+
+func (cr *certReloader) files() []string {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.clientCAFile != "" {
+		files = append(files, cr.clientCAFile)
+	}
+	return files
+}
+
+// stat returns the modification times of the files.
+func (cr *certReloader) stat() ([]time.Time, error) {
+	modTimes := []time.Time{}
+	for _, f := range cr.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// load reads the files and returns the TLS config they describe.
+func (cr *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cr.clientCAFile != "" {
+		pool, err := loadCertPool(cr.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// getConfigForClient returns the config for a handshake, loading the files
+// again first if they have changed. A failed load is logged and the previous
+// config returned, and the files are only loaded again after another change,
+// so that broken files do not cost a parse and an error on every handshake.
+func (cr *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	modTimes, err := cr.stat()
+	if err != nil {
+		logger.Errorf("Cannot check TLS files for changes: %v", err)
+		return cr.config, nil
+	}
+	if equalTimes(modTimes, cr.modTimes) {
+		return cr.config, nil
+	}
+	config, err := cr.load()
+	if err != nil {
+		logger.Errorf("Cannot reload TLS files, keeping the previous ones: %v", err)
+		cr.modTimes = modTimes
+		return cr.config, nil
+	}
+	logger.Verbosef("Reloaded TLS certificate from %s", cr.certFile)
+	cr.config, cr.modTimes = config, modTimes
+	return cr.config, nil
+}
+
+// tlsConfig returns the config for the lease server.
+func (cr *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: cr.getConfigForClient,
+		MinVersion:         tls.VersionTLS12,
+	}
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns the TLS config for requests to the peer, or nil if the
+// defaults will do. The files are read on every call, so that renewed
+// certificates are picked up.
+func (p agentPeerConfig) tlsConfig() (*tls.Config, error) {
+	if p.CAFile == "" && p.CertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if p.CAFile != "" {
+		pool, err := loadCertPool(p.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if p.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "wiresteward test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writeCA writes the CA certificate to a PEM file and returns its path.
+func (ca *testCA) writeCA(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "ca.pem")
+	writePEM(t, path, "CERTIFICATE", ca.cert.Raw)
+	return path
+}
+
+// issue writes a certificate for name, signed by the CA, and its key to files
+// in dir and returns their paths.
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := ca.writeCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "server", 10, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", 20, x509.ExtKeyUsageClientAuth)
+
+	cr, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = cr.tlsConfig()
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(peer agentPeerConfig) (*http.Response, error) {
+		tlsConfig, err := peer.tlsConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}
+		return (&http.Client{Transport: transport}).Get(srv.URL)
+	}
+
+	// Clients must present a certificate issued by the client CA.
+	_, err = get(agentPeerConfig{URL: srv.URL, CAFile: caFile})
+	assert.Error(t, err)
+	resp, err := get(agentPeerConfig{URL: srv.URL, CAFile: caFile, CertFile: clientCert, KeyFile: clientKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, big.NewInt(10), resp.TLS.PeerCertificates[0].SerialNumber)
+
+	// A renewed certificate is served without a restart.
+	ca.issue(t, dir, "server", 11, x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = get(agentPeerConfig{URL: srv.URL, CAFile: caFile, CertFile: clientCert, KeyFile: clientKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, big.NewInt(11), resp.TLS.PeerCertificates[0].SerialNumber)
+
+	// Broken files are not loaded, the previous certificate is kept.
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = get(agentPeerConfig{URL: srv.URL, CAFile: caFile, CertFile: clientCert, KeyFile: clientKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, big.NewInt(11), resp.TLS.PeerCertificates[0].SerialNumber)
+	// The broken files are not loaded again until they change.
+	cr.mutex.Lock()
+	modTimes, err := cr.stat()
+	assert.NoError(t, err)
+	assert.Equal(t, modTimes, cr.modTimes)
+	cr.mutex.Unlock()
+
+	// Fixed files are picked up.
+	ca.issue(t, dir, "server", 12, x509.ExtKeyUsageServerAuth)
+	later = later.Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err = get(agentPeerConfig{URL: srv.URL, CAFile: caFile, CertFile: clientCert, KeyFile: clientKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, big.NewInt(12), resp.TLS.PeerCertificates[0].SerialNumber)
+}
+
+func TestAgentPeerConfig_tlsConfig(t *testing.T) {
+	tlsConfig, err := agentPeerConfig{URL: "https://example.com"}.tlsConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	dir := t.TempDir()
+	_, err = agentPeerConfig{URL: "https://example.com", CAFile: filepath.Join(dir, "missing.pem")}.tlsConfig()
+	assert.ErrorContains(t, err, "cannot read CA file")
+
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = agentPeerConfig{URL: "https://example.com", CAFile: empty}.tlsConfig()
+	assert.ErrorContains(t, err, "no certificates found")
+}
+
+func TestNewCertReloader_invalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, _ := ca.issue(t, dir, "server", 10, x509.ExtKeyUsageServerAuth)
+	_, otherKey := ca.issue(t, dir, "other", 11, x509.ExtKeyUsageServerAuth)
+
+	_, err := newCertReloader(certFile, filepath.Join(dir, "missing.pem"), "")
+	assert.Error(t, err)
+	_, err = newCertReloader(certFile, otherKey, "")
+	assert.ErrorContains(t, err, "cannot load certificate")
+	cr, err := newCertReloader(certFile, filepath.Join(dir, "server-key.pem"), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, tls.NoClientCert, cr.config.ClientAuth)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net"
+	"slices"
 	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
@@ -19,16 +20,23 @@ func newPeerConfig(publicKey string, presharedKey string, endpoint string, allow
 		return nil, err
 	}
 	t := defaultPersistentKeepaliveInterval
-	peer := &wgtypes.PeerConfig{PublicKey: key, PersistentKeepaliveInterval: &t}
+	// An all-zero preshared key disables it, which also clears a key
+	// previously set on an existing peer.
+	psk := wgtypes.Key{}
 	if presharedKey != "" {
-		key, err := wgtypes.ParseKey(presharedKey)
+		psk, err = wgtypes.ParseKey(presharedKey)
 		if err != nil {
 			return nil, err
 		}
-		peer.PresharedKey = &key
 	}
+	peer := &wgtypes.PeerConfig{PublicKey: key, PresharedKey: &psk, PersistentKeepaliveInterval: &t}
 	if endpoint != "" {
+		// Prefer IPv4 endpoints, as before, but allow servers that are only
+		// reachable over IPv6.
 		addr, err := net.ResolveUDPAddr("udp4", endpoint)
+		if err != nil {
+			addr, err = net.ResolveUDPAddr("udp", endpoint)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -44,6 +52,19 @@ func newPeerConfig(publicKey string, presharedKey string, endpoint string, allow
 	return peer, nil
 }
 
+// wgClient is the subset of the wgctrl API used to configure the peers of a
+// device, so that it can be faked in tests.
+type wgClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+// setPeersBatchSize bounds the number of peers sent to the device in a single
+// configuration call, to keep individual netlink messages small.
+const setPeersBatchSize = 500
+
+// setPeers brings the peers of the device in line with the given peers, see
+// configurePeers.
 func setPeers(deviceName string, peers []wgtypes.PeerConfig) error {
 	wg, err := wgctrl.New()
 	if err != nil {
@@ -55,6 +76,13 @@ func setPeers(deviceName string, peers []wgtypes.PeerConfig) error {
 				"Failed to close wireguard client: %v", err)
 		}
 	}()
+	return configurePeers(wg, deviceName, peers)
+}
+
+// configurePeers brings the peers of the device in line with the given peers.
+// Only peers that are missing, differ from the device state or are no longer
+// wanted are sent to the device, in batches of setPeersBatchSize.
+func configurePeers(wg wgClient, deviceName string, peers []wgtypes.PeerConfig) error {
 	if deviceName == "" {
 		deviceName = defaultWireguardDeviceName
 	}
@@ -62,20 +90,102 @@ func setPeers(deviceName string, peers []wgtypes.PeerConfig) error {
 	if err != nil {
 		return err
 	}
-	for _, ep := range device.Peers {
-		found := false
-		for i, np := range peers {
-			peers[i].ReplaceAllowedIPs = true
-			if ep.PublicKey.String() == np.PublicKey.String() {
-				found = true
-				break
-			}
+	changes := diffPeers(device.Peers, peers)
+	if len(changes) == 0 {
+		return nil
+	}
+	logger.Verbosef("Updating %d peers on device %s", len(changes), deviceName)
+	for start := 0; start < len(changes); start += setPeersBatchSize {
+		end := min(start+setPeersBatchSize, len(changes))
+		if err := wg.ConfigureDevice(deviceName, wgtypes.Config{Peers: changes[start:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffPeers returns the peer configurations that turn the current peers of a
+// device into the desired ones: desired peers that are missing or out of date,
+// with their allowed IPs replaced, followed by the removal of current peers
+// that are not desired.
+func diffPeers(current []wgtypes.Peer, desired []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	existing := make(map[wgtypes.Key]int, len(current))
+	for i, p := range current {
+		existing[p.PublicKey] = i
+	}
+	wanted := make(map[wgtypes.Key]bool, len(desired))
+	changes := []wgtypes.PeerConfig{}
+	for _, p := range desired {
+		wanted[p.PublicKey] = true
+		if i, ok := existing[p.PublicKey]; ok && peerUpToDate(current[i], p) {
+			continue
+		}
+		p.ReplaceAllowedIPs = true
+		changes = append(changes, p)
+	}
+	for _, p := range current {
+		if !wanted[p.PublicKey] {
+			changes = append(changes, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+		}
+	}
+	return changes
+}
+
+// peerUpToDate returns whether the device peer already matches every setting
+// of the peer configuration.
+func peerUpToDate(current wgtypes.Peer, desired wgtypes.PeerConfig) bool {
+	if desired.PresharedKey != nil && current.PresharedKey != *desired.PresharedKey {
+		return false
+	}
+	if desired.Endpoint != nil && (current.Endpoint == nil || current.Endpoint.String() != desired.Endpoint.String()) {
+		return false
+	}
+	if desired.PersistentKeepaliveInterval != nil && current.PersistentKeepaliveInterval != *desired.PersistentKeepaliveInterval {
+		return false
+	}
+	if len(current.AllowedIPs) != len(desired.AllowedIPs) {
+		return false
+	}
+	// Peers only hold a handful of allowed IPs, so a quadratic comparison
+	// is cheaper than building a set.
+	for _, c := range current.AllowedIPs {
+		ones, _ := c.Mask.Size()
+		if !slices.ContainsFunc(desired.AllowedIPs, func(d net.IPNet) bool {
+			dOnes, _ := d.Mask.Size()
+			return c.IP.Equal(d.IP) && ones == dOnes
+		}) {
+			return false
 		}
-		if !found {
-			peers = append(peers, wgtypes.PeerConfig{PublicKey: ep.PublicKey, Remove: true})
+	}
+	return true
+}
+
+// peerHandshakes returns the last handshake time of each peer of the device,
+// keyed by public key. Peers that never completed a handshake have the zero
+// time.
+func peerHandshakes(deviceName string) (map[string]time.Time, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := wg.Close(); err != nil {
+			logger.Errorf(
+				"Failed to close wireguard client: %v", err)
 		}
+	}()
+	if deviceName == "" {
+		deviceName = defaultWireguardDeviceName
+	}
+	device, err := wg.Device(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	handshakes := make(map[string]time.Time, len(device.Peers))
+	for _, p := range device.Peers {
+		handshakes[p.PublicKey.String()] = p.LastHandshakeTime
 	}
-	return wg.ConfigureDevice(deviceName, wgtypes.Config{Peers: peers})
+	return handshakes, nil
 }
 
 func setPrivateKey(deviceName string, privKey string) error {
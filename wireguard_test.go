@@ -1,7 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"net"
+	"net/netip"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var (
@@ -36,3 +42,219 @@ func TestNewPeerConfig(t *testing.T) {
 		t.Errorf("newPeerConfig: unexpected error: %v", err)
 	}
 }
+
+// testPeers returns n desired peer configs with distinct keys and addresses,
+// and the device peers that match them.
+func testPeers(t testing.TB, n int) ([]wgtypes.PeerConfig, []wgtypes.Peer) {
+	desired := make([]wgtypes.PeerConfig, 0, n)
+	current := make([]wgtypes.Peer, 0, n)
+	for i := 0; i < n; i++ {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := fmt.Sprintf("10.%d.%d.%d/32", i>>16&0xff, i>>8&0xff, i&0xff)
+		pc, err := newPeerConfig(key.String(), "", "", []string{ip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		desired = append(desired, *pc)
+		current = append(current, wgtypes.Peer{
+			PublicKey:                   pc.PublicKey,
+			PersistentKeepaliveInterval: *pc.PersistentKeepaliveInterval,
+			AllowedIPs:                  pc.AllowedIPs,
+		})
+	}
+	return desired, current
+}
+
+func TestDiffPeers(t *testing.T) {
+	desired, current := testPeers(t, 4)
+
+	// Nothing to do when the device is up to date.
+	assert.Empty(t, diffPeers(current, desired))
+
+	// New, changed and removed peers.
+	added, _ := testPeers(t, 1)
+	changed := desired[1]
+	_, network, _ := net.ParseCIDR("10.1.0.0/24")
+	changed.AllowedIPs = append(changed.AllowedIPs, *network)
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := desired[2]
+	rotated.PresharedKey = &psk
+	changes := diffPeers(current, []wgtypes.PeerConfig{desired[0], changed, rotated, added[0]})
+	if !assert.Equal(t, 4, len(changes)) {
+		return
+	}
+	assert.Equal(t, changed.PublicKey, changes[0].PublicKey)
+	assert.True(t, changes[0].ReplaceAllowedIPs)
+	assert.Equal(t, rotated.PublicKey, changes[1].PublicKey)
+	assert.Equal(t, added[0].PublicKey, changes[2].PublicKey)
+	assert.False(t, changes[2].Remove)
+	assert.Equal(t, desired[3].PublicKey, changes[3].PublicKey)
+	assert.True(t, changes[3].Remove)
+}
+
+func BenchmarkDiffPeers_unchanged(b *testing.B) {
+	desired, current := testPeers(b, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if changes := diffPeers(current, desired); len(changes) != 0 {
+			b.Fatalf("expected no changes, got %d", len(changes))
+		}
+	}
+}
+
+func BenchmarkDiffPeers_newPeer(b *testing.B) {
+	desired, current := testPeers(b, 10000)
+	current = current[1:]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if changes := diffPeers(current, desired); len(changes) != 1 {
+			b.Fatalf("expected 1 change, got %d", len(changes))
+		}
+	}
+}
+
+func BenchmarkDiffPeers_allChanged(b *testing.B) {
+	desired, _ := testPeers(b, 10000)
+	_, current := testPeers(b, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if changes := diffPeers(current, desired); len(changes) != 20000 {
+			b.Fatalf("expected 20000 changes, got %d", len(changes))
+		}
+	}
+}
+
+// fakeWgClient keeps the peers of a single device in memory.
+type fakeWgClient struct {
+	peers map[wgtypes.Key]wgtypes.Peer
+	calls int
+}
+
+func (c *fakeWgClient) Device(name string) (*wgtypes.Device, error) {
+	d := &wgtypes.Device{Name: name, Peers: make([]wgtypes.Peer, 0, len(c.peers))}
+	for _, p := range c.peers {
+		d.Peers = append(d.Peers, p)
+	}
+	return d, nil
+}
+
+func (c *fakeWgClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	c.calls++
+	for _, pc := range cfg.Peers {
+		if pc.Remove {
+			delete(c.peers, pc.PublicKey)
+			continue
+		}
+		p := c.peers[pc.PublicKey]
+		p.PublicKey = pc.PublicKey
+		if pc.PresharedKey != nil {
+			p.PresharedKey = *pc.PresharedKey
+		}
+		if pc.PersistentKeepaliveInterval != nil {
+			p.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+		}
+		if pc.ReplaceAllowedIPs {
+			p.AllowedIPs = nil
+		}
+		p.AllowedIPs = append(p.AllowedIPs, pc.AllowedIPs...)
+		c.peers[pc.PublicKey] = p
+	}
+	return nil
+}
+
+// testLeaseManager returns a leaseManager holding n leases, whose device
+// already has the peers of the leases.
+func testLeaseManager(t testing.TB, n int) (*leaseManager, *fakeWgClient) {
+	wg := &fakeWgClient{peers: map[wgtypes.Key]wgtypes.Peer{}}
+	lm := &leaseManager{
+		deviceName: "wg0",
+		ipPrefix:   netip.MustParsePrefix("10.0.0.0/8"),
+		wgClient:   wg,
+		wgRecords:  make(map[leaseKey]WGRecord, n),
+	}
+	ip := lm.ipPrefix.Addr()
+	for i := 0; i < n; i++ {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip = ip.Next()
+		lm.wgRecords[leaseKey{Username: fmt.Sprintf("user%d", i)}] = WGRecord{PubKey: key.PublicKey().String(), IP: ip}
+	}
+	if err := lm.updateWgPeers(); err != nil {
+		t.Fatal(err)
+	}
+	wg.calls = 0
+	return lm, wg
+}
+
+func TestUpdateWgPeers(t *testing.T) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	lm, wg := testLeaseManager(t, 1200)
+	assert.Equal(t, 1200, len(wg.peers))
+
+	// Nothing is sent to an up to date device.
+	if err := lm.updateWgPeers(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, wg.calls)
+
+	// Changes are sent in batches.
+	for k := range lm.wgRecords {
+		delete(lm.wgRecords, k)
+		if len(lm.wgRecords) == 1200-setPeersBatchSize-1 {
+			break
+		}
+	}
+	if err := lm.updateWgPeers(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, wg.calls)
+	assert.Equal(t, 1200-setPeersBatchSize-1, len(wg.peers))
+}
+
+func BenchmarkUpdateWgPeers_unchanged(b *testing.B) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	lm, wg := testLeaseManager(b, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := lm.updateWgPeers(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if wg.calls != 0 {
+		b.Fatalf("expected no device configuration, got %d calls", wg.calls)
+	}
+}
+
+func BenchmarkUpdateWgPeers_newPeer(b *testing.B) {
+	setLogLevel("error")
+	logger = newLogger("wiresteward-test")
+	lm, wg := testLeaseManager(b, 10000)
+	key := leaseKey{Username: "user0"}
+	record := lm.wgRecords[key]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Alternate between removing and adding back a peer, so that every
+		// update sends a single change to the device.
+		if i%2 == 0 {
+			delete(lm.wgRecords, key)
+		} else {
+			lm.wgRecords[key] = record
+		}
+		if err := lm.updateWgPeers(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if wg.calls != b.N {
+		b.Fatalf("expected %d device configurations, got %d", b.N, wg.calls)
+	}
+}